@@ -0,0 +1,190 @@
+package client
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/HailoOSS/service/config"
+)
+
+// AdaptiveTimeoutOptions turn on timeouts learned from the latency we see, under hailo.platform.timeout.adaptive.
+// Until we have seen enough replies from an endpoint we use its SLA. Either way the min, max and multiplier still apply
+type AdaptiveTimeoutOptions struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// Percentile of the latencies seen that we base the timeout on, eg: 99
+	Percentile float64 `json:"percentile,omitempty"`
+	// MarginMs is added to the percentile, so a few slightly slower replies don't time out
+	MarginMs int64 `json:"marginMs,omitempty"`
+	// MinSamples is how many replies we need to have seen before we trust what we've learned
+	MinSamples int `json:"minSamples,omitempty"`
+	// WindowSize is how many of the most recent replies we learn from
+	WindowSize int `json:"windowSize,omitempty"`
+}
+
+// LearnedTimeout describes what we have learned about an endpoint's latency
+type LearnedTimeout struct {
+	Service  string
+	Endpoint string
+	Samples  int
+	// Latency is the configured percentile of the latencies seen
+	Latency time.Duration
+	// Timeout is what we use for a first attempt, including the margin, multiplier and bounds
+	Timeout time.Duration
+}
+
+var (
+	defaultAdaptiveTimeoutOptions = AdaptiveTimeoutOptions{
+		Percentile: 99,
+		MarginMs:   20,
+		MinSamples: 50,
+		WindowSize: 1000,
+	}
+
+	// how many replies we see between working out the percentile again
+	relearnEvery = 10
+)
+
+// latencyWindow holds the latencies of the most recent replies from an endpoint
+type latencyWindow struct {
+	samples []time.Duration // a ring buffer, once full
+	next    int
+	learned time.Duration
+	unseen  int // replies since we last worked out the percentile
+}
+
+func (w *latencyWindow) add(d time.Duration, size int) {
+	if len(w.samples) < size {
+		w.samples = append(w.samples, d)
+	} else {
+		w.samples[w.next%len(w.samples)] = d
+	}
+	w.next = (w.next + 1) % size
+	w.unseen++
+}
+
+// percentile returns the pth percentile of the samples, using the nearest rank
+func (w *latencyWindow) percentile(p float64) time.Duration {
+	if len(w.samples) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(w.samples))
+	copy(sorted, w.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	} else if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// loadAdaptiveFromConfig grabs the adaptive timeout settings from the config service
+func (t *Timeout) loadAdaptiveFromConfig() {
+	opts := defaultAdaptiveTimeoutOptions
+	config.AtPath("hailo", "platform", "timeout", "adaptive").AsStruct(&opts)
+
+	t.latencyMtx.Lock()
+	defer t.latencyMtx.Unlock()
+	if opts != t.adaptive {
+		log.Infof("[Client] Loaded adaptive timeout configuration from config service %+v", opts)
+	}
+	t.adaptive = opts
+}
+
+// observe records how long an endpoint took to reply
+func (t *Timeout) observe(service, endpoint string, d time.Duration) {
+	t.record(service, endpoint, d, false)
+}
+
+// observeTimeout records an attempt that timed out as taking as long as its timeout, since it took at least that
+// long. Otherwise we would only learn from the replies that came back in time, and time out sooner and sooner. We
+// learn from it straight away, so an endpoint that has gone slow gets a longer timeout quickly
+func (t *Timeout) observeTimeout(service, endpoint string, timeout time.Duration) {
+	t.record(service, endpoint, timeout, true)
+}
+
+// record adds a latency to an endpoint's window, working out the percentile again every so often, or now if asked
+func (t *Timeout) record(service, endpoint string, d time.Duration, relearn bool) {
+	t.latencyMtx.Lock()
+	defer t.latencyMtx.Unlock()
+
+	if !t.adaptive.Enabled || t.adaptive.WindowSize <= 0 {
+		return
+	}
+
+	key := fmt.Sprintf("%s.%s", service, endpoint)
+	w, ok := t.latencies[key]
+	if !ok {
+		w = &latencyWindow{}
+		t.latencies[key] = w
+	}
+	w.add(d, t.adaptive.WindowSize)
+
+	if len(w.samples) >= t.adaptive.MinSamples && (relearn || w.unseen >= relearnEvery) {
+		w.learned, w.unseen = w.percentile(t.adaptive.Percentile), 0
+	}
+}
+
+// fetchLearned returns the timeout learned for an endpoint, if adaptive timeouts are on and we've seen enough replies
+func (t *Timeout) fetchLearned(service, endpoint string) (time.Duration, bool) {
+	t.latencyMtx.Lock()
+	defer t.latencyMtx.Unlock()
+
+	if !t.adaptive.Enabled {
+		return 0, false
+	}
+	w, ok := t.latencies[fmt.Sprintf("%s.%s", service, endpoint)]
+	if !ok || w.learned == 0 || len(w.samples) < t.adaptive.MinSamples {
+		return 0, false
+	}
+
+	return w.learned + time.Duration(t.adaptive.MarginMs)*time.Millisecond, true
+}
+
+// Learned returns what we have learned about the latency of each endpoint we have called, ordered by service and
+// endpoint, to help debug adaptive timeouts
+func (t *Timeout) Learned() []LearnedTimeout {
+	t.latencyMtx.Lock()
+	learned := make([]LearnedTimeout, 0, len(t.latencies))
+	for key, w := range t.latencies {
+		lt := LearnedTimeout{
+			Samples: len(w.samples),
+			Latency: w.learned,
+		}
+		// keys are service.endpoint, and endpoints don't have dots in
+		for i := len(key) - 1; i >= 0; i-- {
+			if key[i] == '.' {
+				lt.Service, lt.Endpoint = key[:i], key[i+1:]
+				break
+			}
+		}
+		learned = append(learned, lt)
+	}
+	t.latencyMtx.Unlock()
+
+	for i := range learned {
+		learned[i].Timeout = t.Get(learned[i].Service, learned[i].Endpoint, 1)
+	}
+	sort.Slice(learned, func(i, j int) bool {
+		if learned[i].Service != learned[j].Service {
+			return learned[i].Service < learned[j].Service
+		}
+		return learned[i].Endpoint < learned[j].Endpoint
+	})
+
+	return learned
+}
+
+// LearnedTimeouts returns what the default client has learned about the latency of each endpoint it has called
+func LearnedTimeouts() []LearnedTimeout {
+	if c, ok := DefaultClient.(*client); ok {
+		return c.timeout.Learned()
+	}
+	return nil
+}
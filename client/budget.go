@@ -0,0 +1,171 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/HailoOSS/service/config"
+	inst "github.com/HailoOSS/service/instrumentation"
+)
+
+// RetryBudgetOptions configure the retry budget for calls to a service, under hailo.platform.client.retryBudget,
+// overridden for a service under hailo.platform.client.retryBudget.services.<service>
+type RetryBudgetOptions struct {
+	Disabled bool `json:"disabled,omitempty"`
+	// Ratio is how many retries each request earns, eg: 0.1 allows retries of up to 10% of requests
+	Ratio float64 `json:"ratio,omitempty"`
+	// MaxTokens caps how many retries we can save up, so a quiet spell doesn't allow a burst of retries later
+	MaxTokens float64 `json:"maxTokens,omitempty"`
+}
+
+// RetryBudgetStats describe the retry budget for calls to a service
+type RetryBudgetStats struct {
+	Service string
+	Tokens  float64
+	Retries uint64
+	Dropped uint64
+}
+
+var (
+	// The default budget, which allows retries of up to 10% of requests
+	defaultRetryBudgetOptions = RetryBudgetOptions{
+		Ratio:     0.1,
+		MaxTokens: 10,
+	}
+
+	retryBudgets   = make(map[string]*retryBudget) // Maps service to retryBudget
+	retryBudgetsMu sync.RWMutex
+)
+
+func init() {
+	onConfigChange(loadRetryBudgets)
+}
+
+// tokenUnit is a whole token. We count in thousandths, so that fractions like 0.1 add up exactly
+const tokenUnit = 1000
+
+// retryBudget is a token bucket, shared by all calls to a service. Each request adds a fraction of a token and each
+// retry takes a whole one, so once a service is struggling and most requests need retrying we stop adding to its load
+type retryBudget struct {
+	sync.Mutex
+	service string
+	opts    RetryBudgetOptions
+	tokens  int64 // in thousandths of a token
+	retries uint64
+	dropped uint64
+}
+
+func newRetryBudget(service string) *retryBudget {
+	b := &retryBudget{service: service}
+	b.configure()
+	b.tokens = b.maxTokens()
+	return b
+}
+
+// configure loads the options for the budget from config - must be called with the lock held, or before the budget
+// is shared
+func (b *retryBudget) configure() {
+	opts := defaultRetryBudgetOptions
+	config.AtPath("hailo", "platform", "client", "retryBudget").AsStruct(&opts)
+	config.AtPath("hailo", "platform", "client", "retryBudget", "services", b.service).AsStruct(&opts)
+	b.opts = opts
+	if b.tokens > b.maxTokens() {
+		b.tokens = b.maxTokens()
+	}
+}
+
+func (b *retryBudget) maxTokens() int64 {
+	return int64(b.opts.MaxTokens * tokenUnit)
+}
+
+// deposit is called for every request
+func (b *retryBudget) deposit() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.tokens += int64(b.opts.Ratio * tokenUnit)
+	if b.tokens > b.maxTokens() {
+		b.tokens = b.maxTokens()
+	}
+	inst.Gauge(1.0, fmt.Sprintf("client.retrybudget.%s.tokens", b.service), int(b.tokens/tokenUnit))
+}
+
+// withdraw is called before every retry, and says whether there is budget left for it
+func (b *retryBudget) withdraw() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if !b.opts.Disabled && b.tokens < tokenUnit {
+		b.dropped++
+		inst.Counter(1.0, fmt.Sprintf("client.retrybudget.%s.dropped", b.service), 1)
+		return false
+	}
+
+	b.retries++
+	if b.tokens >= tokenUnit {
+		b.tokens -= tokenUnit
+	}
+	inst.Gauge(1.0, fmt.Sprintf("client.retrybudget.%s.tokens", b.service), int(b.tokens/tokenUnit))
+	return true
+}
+
+func (b *retryBudget) stats() RetryBudgetStats {
+	b.Lock()
+	defer b.Unlock()
+
+	return RetryBudgetStats{
+		Service: b.service,
+		Tokens:  float64(b.tokens) / tokenUnit,
+		Retries: b.retries,
+		Dropped: b.dropped,
+	}
+}
+
+// retryBudgetFor returns the retry budget for calls to a service
+func retryBudgetFor(service string) *retryBudget {
+	retryBudgetsMu.RLock()
+	b, ok := retryBudgets[service]
+	retryBudgetsMu.RUnlock()
+	if ok {
+		return b
+	}
+
+	retryBudgetsMu.Lock()
+	defer retryBudgetsMu.Unlock()
+	// Double check no one else has created it
+	if b, ok = retryBudgets[service]; !ok {
+		b = newRetryBudget(service)
+		retryBudgets[service] = b
+	}
+
+	return b
+}
+
+func loadRetryBudgets() {
+	retryBudgetsMu.RLock()
+	defer retryBudgetsMu.RUnlock()
+
+	for _, b := range retryBudgets {
+		b.Lock()
+		b.configure()
+		b.Unlock()
+	}
+	log.Debugf("[Client] Reloaded retry budgets for %d services", len(retryBudgets))
+}
+
+// RetryBudgets returns the state of the retry budget for each service we have called, ordered by service
+func RetryBudgets() []RetryBudgetStats {
+	retryBudgetsMu.RLock()
+	defer retryBudgetsMu.RUnlock()
+
+	stats := make([]RetryBudgetStats, 0, len(retryBudgets))
+	for _, b := range retryBudgets {
+		stats = append(stats, b.stats())
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Service < stats[j].Service })
+
+	return stats
+}
@@ -0,0 +1,45 @@
+package client
+
+import (
+	"testing"
+)
+
+func TestRetryBudget(t *testing.T) {
+	b := &retryBudget{
+		service: "com.HailoOSS.service.budget",
+		opts:    RetryBudgetOptions{Ratio: 0.1, MaxTokens: 2},
+		tokens:  2 * tokenUnit,
+	}
+
+	if !b.withdraw() || !b.withdraw() {
+		t.Fatalf("Expected to be able to spend saved up tokens")
+	}
+	if b.withdraw() {
+		t.Errorf("Expected the budget to be spent")
+	}
+
+	// ten requests earn one retry
+	for i := 0; i < 10; i++ {
+		b.deposit()
+	}
+	if !b.withdraw() {
+		t.Errorf("Expected ten requests to earn a retry")
+	}
+	if b.withdraw() {
+		t.Errorf("Expected the budget to be spent again")
+	}
+
+	// tokens can only be saved up to the max
+	for i := 0; i < 100; i++ {
+		b.deposit()
+	}
+	if stats := b.stats(); stats.Tokens != 2 || stats.Retries != 3 || stats.Dropped != 2 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	b.opts.Disabled = true
+	b.tokens = 0
+	if !b.withdraw() {
+		t.Errorf("Expected a disabled budget to allow retries")
+	}
+}
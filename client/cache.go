@@ -0,0 +1,251 @@
+package client
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/streadway/amqp"
+
+	"github.com/HailoOSS/service/config"
+	inst "github.com/HailoOSS/service/instrumentation"
+)
+
+// CacheInvalidationTopic is the topic clients listen on to drop cached replies, see InvalidateCache
+const CacheInvalidationTopic = "com.HailoOSS.kernel.client.cache.invalidate"
+
+// CacheOptions configure the response cache, under hailo.platform.client.cache, overridden for an endpoint under
+// hailo.platform.client.cache.endpoints.<service>.<endpoint>. We only ever cache replies the server says we can
+type CacheOptions struct {
+	Disabled bool `json:"disabled,omitempty"`
+	// MaxEntries caps how many replies we keep for an endpoint, dropping the least recently used first
+	MaxEntries int `json:"maxEntries,omitempty"`
+}
+
+// CacheInvalidation is published as JSON on CacheInvalidationTopic to drop the cached replies from an endpoint, or
+// from every endpoint of a service if Endpoint is empty
+type CacheInvalidation struct {
+	Service  string `json:"service"`
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+var (
+	defaultCacheOptions = CacheOptions{
+		MaxEntries: 100,
+	}
+
+	// cache is shared by all clients, so any of them can fill it, and an invalidation received by any of them clears it
+	cache = &responseCache{endpoints: make(map[string]*endpointCache)}
+)
+
+func init() {
+	onConfigChange(func() { cache.configure() })
+}
+
+// InvalidateCache tells every client to drop its cached replies from an endpoint, or from every endpoint of the
+// service if endpoint is empty
+func InvalidateCache(service, endpoint string) error {
+	b, err := json.Marshal(&CacheInvalidation{Service: service, Endpoint: endpoint})
+	if err != nil {
+		return err
+	}
+	pub, err := NewJsonPublication(CacheInvalidationTopic, b)
+	if err != nil {
+		return err
+	}
+
+	return AsyncTopic(pub)
+}
+
+type cacheEntry struct {
+	key     string
+	rsp     *Response
+	expires time.Time
+}
+
+// endpointCache holds the cached replies from one endpoint, most recently used first
+type endpointCache struct {
+	service, endpoint string
+	opts              CacheOptions
+	lru               *list.List
+	entries           map[string]*list.Element
+}
+
+func newEndpointCache(service, endpoint string) *endpointCache {
+	ec := &endpointCache{
+		service:  service,
+		endpoint: endpoint,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+	ec.configure()
+	return ec
+}
+
+// configure loads the options for the endpoint from config, dropping anything we no longer have room for
+func (ec *endpointCache) configure() {
+	opts := defaultCacheOptions
+	config.AtPath("hailo", "platform", "client", "cache").AsStruct(&opts)
+	config.AtPath("hailo", "platform", "client", "cache", "endpoints", ec.service, ec.endpoint).AsStruct(&opts)
+	ec.opts = opts
+
+	if opts.Disabled {
+		ec.clear()
+	}
+	for ec.lru.Len() > opts.MaxEntries {
+		ec.remove(ec.lru.Back())
+	}
+}
+
+func (ec *endpointCache) remove(e *list.Element) {
+	ec.lru.Remove(e)
+	delete(ec.entries, e.Value.(*cacheEntry).key)
+}
+
+func (ec *endpointCache) clear() {
+	ec.lru.Init()
+	ec.entries = make(map[string]*list.Element)
+}
+
+// responseCache holds replies we have been told we can cache, so identical requests can be answered without a call
+type responseCache struct {
+	sync.Mutex
+	endpoints map[string]*endpointCache // Maps service.endpoint to its cache
+}
+
+// get returns an unexpired reply to an identical request, if we have one
+func (rc *responseCache) get(req *Request) (*Response, bool) {
+	rc.Lock()
+	defer rc.Unlock()
+
+	// endpoints that have never given us a cacheable reply don't count as misses
+	ec, ok := rc.endpoints[fmt.Sprintf("%s.%s", req.service, req.endpoint)]
+	if !ok || ec.opts.Disabled {
+		return nil, false
+	}
+
+	instPrefix := fmt.Sprintf("client.%s.%s.cache", req.service, req.endpoint)
+	if e, ok := ec.entries[cacheKey(req)]; ok {
+		entry := e.Value.(*cacheEntry)
+		if time.Now().Before(entry.expires) {
+			ec.lru.MoveToFront(e)
+			inst.Counter(1.0, instPrefix+".hit", 1)
+			return entry.rsp, true
+		}
+		ec.remove(e)
+	}
+	inst.Counter(1.0, instPrefix+".miss", 1)
+
+	return nil, false
+}
+
+// put caches a reply, if the server said we can
+func (rc *responseCache) put(req *Request, rsp *Response) {
+	ttl := cacheTTL(rsp)
+	if ttl <= 0 {
+		return
+	}
+
+	rc.Lock()
+	defer rc.Unlock()
+
+	name := fmt.Sprintf("%s.%s", req.service, req.endpoint)
+	ec, ok := rc.endpoints[name]
+	if !ok {
+		ec = newEndpointCache(req.service, req.endpoint)
+		rc.endpoints[name] = ec
+	}
+	if ec.opts.Disabled || ec.opts.MaxEntries <= 0 {
+		return
+	}
+
+	key := cacheKey(req)
+	if e, ok := ec.entries[key]; ok {
+		ec.remove(e)
+	}
+	ec.entries[key] = ec.lru.PushFront(&cacheEntry{
+		key:     key,
+		rsp:     rsp,
+		expires: time.Now().Add(ttl),
+	})
+	for ec.lru.Len() > ec.opts.MaxEntries {
+		ec.remove(ec.lru.Back())
+	}
+}
+
+// invalidate drops the cached replies from an endpoint, or every endpoint of a service if endpoint is empty
+func (rc *responseCache) invalidate(service, endpoint string) {
+	rc.Lock()
+	defer rc.Unlock()
+
+	for _, ec := range rc.endpoints {
+		if ec.service == service && (endpoint == "" || ec.endpoint == endpoint) {
+			ec.clear()
+		}
+	}
+	log.Debugf("[Client] Invalidated cached replies from %s.%s", service, endpoint)
+}
+
+func (rc *responseCache) configure() {
+	rc.Lock()
+	defer rc.Unlock()
+
+	for _, ec := range rc.endpoints {
+		ec.configure()
+	}
+}
+
+// handleInvalidation handles a publication on CacheInvalidationTopic
+func (rc *responseCache) handleInvalidation(d amqp.Delivery) {
+	inv := &CacheInvalidation{}
+	if err := json.Unmarshal(newResponseFromDelivery(d).Body(), inv); err != nil || inv.Service == "" {
+		log.Warnf("[Client] Ignoring bad cache invalidation %s: %v", d.MessageId, err)
+		return
+	}
+	rc.invalidate(inv.Service, inv.Endpoint)
+}
+
+// cacheKey identifies identical requests to an endpoint. The session is part of it, so one user is never served a
+// reply meant for another
+func cacheKey(req *Request) string {
+	h := sha1.New()
+	h.Write([]byte(req.sessionID))
+	h.Write([]byte{0})
+	h.Write([]byte(req.contentType))
+	h.Write([]byte{0})
+	h.Write(req.payload)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cacheTTL reads how long we may cache a reply for from its cacheControl header, eg: max-age=60
+func cacheTTL(rsp *Response) time.Duration {
+	if rsp == nil || rsp.IsError() {
+		return 0
+	}
+	cc, _ := rsp.Header()["cacheControl"].(string)
+
+	var ttl time.Duration
+	for _, directive := range strings.Split(cc, ",") {
+		directive = strings.TrimSpace(directive)
+		switch {
+		case directive == "no-cache" || directive == "no-store":
+			return 0
+		case strings.HasPrefix(directive, "max-age="):
+			secs, err := strconv.ParseInt(strings.TrimPrefix(directive, "max-age="), 10, 64)
+			if err != nil {
+				log.Warnf("[Client] Ignoring bad cacheControl header %q: %v", cc, err)
+				return 0
+			}
+			ttl = time.Duration(secs) * time.Second
+		}
+	}
+
+	return ttl
+}
@@ -0,0 +1,175 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/HailoOSS/platform/raven"
+	"github.com/HailoOSS/service/config"
+)
+
+// testCachedResponse is a reply from our fake service that clients may cache
+type testCachedResponse struct {
+	testResponse
+}
+
+func (r *testCachedResponse) CacheControl() string { return "max-age=60" }
+
+func cacheable(cc string) *Response {
+	return newResponseFromDelivery(amqp.Delivery{
+		Headers: amqp.Table{"messageType": "reply", "cacheControl": cc},
+	})
+}
+
+func TestCacheTTL(t *testing.T) {
+	testCases := map[string]time.Duration{
+		"":                     0,
+		"max-age=60":           time.Minute,
+		"public, max-age=5":    5 * time.Second,
+		"max-age=5, no-store":  0,
+		"max-age=soon":         0,
+		"must-revalidate":      0,
+		" max-age=1 , private": time.Second,
+	}
+	for cc, expected := range testCases {
+		if ttl := cacheTTL(cacheable(cc)); ttl != expected {
+			t.Errorf("Expected %q to give a TTL of %v, got %v", cc, expected, ttl)
+		}
+	}
+
+	errRsp := newResponseFromDelivery(amqp.Delivery{
+		Headers: amqp.Table{"messageType": "error", "cacheControl": "max-age=60"},
+	})
+	if ttl := cacheTTL(errRsp); ttl != 0 {
+		t.Errorf("Expected errors never to be cached, got %v", ttl)
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	config.Load(bytes.NewBufferString(`{"hailo":{"platform":{"client":{"cache":{"endpoints":` +
+		`{"com.HailoOSS.service.foo":{"small":{"maxEntries":2}}}}}}}}`))
+	defer config.Load(bytes.NewBufferString(`{}`))
+
+	rc := &responseCache{endpoints: make(map[string]*endpointCache)}
+	req := func(endpoint, payload string) *Request {
+		r, _ := NewJsonRequest("com.HailoOSS.service.foo", endpoint, []byte(payload))
+		return r
+	}
+
+	rc.put(req("small", `{}`), cacheable(""))
+	if _, ok := rc.get(req("small", `{}`)); ok {
+		t.Errorf("Expected a reply without a TTL not to be cached")
+	}
+
+	rsp := cacheable("max-age=60")
+	rc.put(req("small", `{"id":1}`), rsp)
+	if cached, ok := rc.get(req("small", `{"id":1}`)); !ok || cached != rsp {
+		t.Errorf("Expected a cached reply to an identical request")
+	}
+	if _, ok := rc.get(req("small", `{"id":2}`)); ok {
+		t.Errorf("Expected no cached reply for a different payload")
+	}
+	other := req("small", `{"id":1}`)
+	other.SetSessionID("other")
+	if _, ok := rc.get(other); ok {
+		t.Errorf("Expected no cached reply for a different session")
+	}
+
+	// the least recently used goes once we are over the limit
+	rc.put(req("small", `{"id":2}`), cacheable("max-age=60"))
+	rc.get(req("small", `{"id":1}`))
+	rc.put(req("small", `{"id":3}`), cacheable("max-age=60"))
+	if _, ok := rc.get(req("small", `{"id":2}`)); ok {
+		t.Errorf("Expected the least recently used reply to be dropped")
+	}
+	if _, ok := rc.get(req("small", `{"id":1}`)); !ok {
+		t.Errorf("Expected the most recently used reply to be kept")
+	}
+
+	// expired replies aren't served
+	rc.put(req("big", `{}`), rsp)
+	rc.endpoints["com.HailoOSS.service.foo.big"].lru.Front().Value.(*cacheEntry).expires = time.Now()
+	if _, ok := rc.get(req("big", `{}`)); ok {
+		t.Errorf("Expected an expired reply not to be served")
+	}
+
+	rc.put(req("big", `{}`), rsp)
+	rc.invalidate("com.HailoOSS.service.foo", "small")
+	if _, ok := rc.get(req("small", `{"id":1}`)); ok {
+		t.Errorf("Expected the endpoint's cache to be invalidated")
+	}
+	if _, ok := rc.get(req("big", `{}`)); !ok {
+		t.Errorf("Expected other endpoints to keep their cached replies")
+	}
+	rc.invalidate("com.HailoOSS.service.foo", "")
+	if _, ok := rc.get(req("big", `{}`)); ok {
+		t.Errorf("Expected the whole service's cache to be invalidated")
+	}
+}
+
+func TestReqServedFromCache(t *testing.T) {
+	defer cache.invalidate("com.HailoOSS.service.cached", "")
+
+	tr := raven.NewMemoryTransport(raven.NewMemoryBroker())
+	tr.Connect()
+
+	deliveries, err := tr.Consume("server-com.HailoOSS.service.cached")
+	if err != nil {
+		t.Fatalf("Unexpected error consuming: %v", err)
+	}
+	if err := tr.BindService("com.HailoOSS.service.cached", "server-com.HailoOSS.service.cached"); err != nil {
+		t.Fatalf("Unexpected error binding: %v", err)
+	}
+
+	var calls int32
+	go func() {
+		for d := range deliveries {
+			atomic.AddInt32(&calls, 1)
+			tr.SendResponse(&testCachedResponse{testResponse{
+				replyTo:   d.ReplyTo,
+				messageID: d.MessageId,
+				payload:   d.Body,
+			}}, "server-com.HailoOSS.service.cached")
+		}
+	}()
+
+	c := NewTransportClient(tr)
+	for i := 0; i < 3; i++ {
+		req, _ := NewJsonRequest("com.HailoOSS.service.cached", "read", []byte(`{"id":"foo"}`))
+		if _, err := c.CustomReq(req); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		// so it isn't timed as though the service answered
+		if req.answered != (i > 0) {
+			t.Errorf("Expected only repeat requests to be marked as answered by the client, got %v for %d", req.answered, i)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("Expected repeat requests to be served from the cache, got %d calls", n)
+	}
+
+	b, _ := json.Marshal(&CacheInvalidation{Service: "com.HailoOSS.service.cached"})
+	pub, _ := NewJsonPublication(CacheInvalidationTopic, b)
+	if err := c.AsyncTopic(pub); err != nil {
+		t.Fatalf("Unexpected error publishing: %v", err)
+	}
+
+	req, _ := NewJsonRequest("com.HailoOSS.service.cached", "read", []byte(`{"id":"foo"}`))
+	for i := 0; i < 100; i++ {
+		if _, ok := cache.get(req); !ok {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := c.CustomReq(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("Expected a call once the cache was invalidated, got %d calls", n)
+	}
+}
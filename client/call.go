@@ -0,0 +1,53 @@
+package client
+
+import (
+	"github.com/HailoOSS/protobuf/proto"
+
+	"github.com/HailoOSS/platform/errors"
+)
+
+// Call is a request made in the background by Go or GoContext. Once it is done, Response holds the reply, if there was
+// no error
+type Call struct {
+	Request  *Request
+	Response proto.Message
+
+	done chan struct{}
+	err  errors.Error
+}
+
+// goCall makes a call in the background with do, which should fill in rsp
+func goCall(req *Request, rsp proto.Message, do func() errors.Error) *Call {
+	call := &Call{
+		Request:  req,
+		Response: rsp,
+		done:     make(chan struct{}),
+	}
+	go func() {
+		call.err = do()
+		close(call.done)
+	}()
+
+	return call
+}
+
+// Done returns a channel which is closed once the call is done
+func (c *Call) Done() <-chan struct{} {
+	return c.done
+}
+
+// Wait blocks until the call is done, returning its error if it failed
+func (c *Call) Wait() errors.Error {
+	<-c.done
+	return c.err
+}
+
+// Err returns the error from the call if it failed, or nil if it succeeded or isn't done yet
+func (c *Call) Err() errors.Error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
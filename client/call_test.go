@@ -0,0 +1,71 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/HailoOSS/platform/raven"
+)
+
+type echoPayload struct {
+	Id int `json:"id"`
+}
+
+func (*echoPayload) Reset()         {}
+func (*echoPayload) String() string { return "" }
+func (*echoPayload) ProtoMessage()  {}
+
+func TestGo(t *testing.T) {
+	tr := raven.NewMemoryTransport(raven.NewMemoryBroker())
+	tr.Connect()
+
+	deliveries, err := tr.Consume("server-com.HailoOSS.service.echo")
+	if err != nil {
+		t.Fatalf("Unexpected error consuming: %v", err)
+	}
+	if err := tr.BindService("com.HailoOSS.service.echo", "server-com.HailoOSS.service.echo"); err != nil {
+		t.Fatalf("Unexpected error binding: %v", err)
+	}
+
+	// echo every request straight back
+	go func() {
+		for d := range deliveries {
+			tr.SendResponse(&testResponse{
+				replyTo:   d.ReplyTo,
+				messageID: d.MessageId,
+				payload:   d.Body,
+			}, "server-com.HailoOSS.service.echo")
+		}
+	}()
+
+	c := NewTransportClient(tr)
+	calls := make([]*Call, 3)
+	for i := range calls {
+		req, _ := NewJsonRequest("com.HailoOSS.service.echo", "echo", []byte(`{"id":`+string('1'+rune(i))+`}`))
+		calls[i] = c.Go(req, &echoPayload{}, WithRetries(0), WithAttemptTimeout(time.Second))
+	}
+
+	for i, call := range calls {
+		if err := call.Wait(); err != nil {
+			t.Fatalf("Unexpected error from call %d: %v", i, err)
+		}
+		select {
+		case <-call.Done():
+		default:
+			t.Errorf("Expected call %d to be done once waited on", i)
+		}
+		if id := call.Response.(*echoPayload).Id; id != i+1 {
+			t.Errorf("Expected call %d to get its own response, got id %d", i, id)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := NewJsonRequest("com.HailoOSS.service.echo", "echo", []byte(`{"id":4}`))
+	call := c.GoContext(ctx, req, &echoPayload{})
+	<-call.Done()
+	if err := call.Err(); err == nil || err.Code() != "com.HailoOSS.kernel.platform.cancelled" {
+		t.Errorf("Expected the call to be cancelled, got %v", err)
+	}
+}
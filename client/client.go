@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"sync"
@@ -11,7 +12,6 @@ import (
 	"github.com/nu7hatch/gouuid"
 	"github.com/streadway/amqp"
 
-	"github.com/HailoOSS/platform/circuitbreaker"
 	"github.com/HailoOSS/platform/errors"
 	pe "github.com/HailoOSS/platform/proto/error"
 	traceproto "github.com/HailoOSS/platform/proto/trace"
@@ -37,10 +37,27 @@ var (
 // A client stores the details of a service client
 type Client interface {
 	// Req sends a request, and marhsals a successful response or returns an error
-	Req(req *Request, rsp proto.Message, options ...Options) errors.Error
+	Req(req *Request, rsp proto.Message, options ...CallOption) errors.Error
 
 	// CustomReq is similar to Req, but without the automatic response unmarshaling, and instead returning a response
-	CustomReq(req *Request, options ...Options) (*Response, errors.Error)
+	CustomReq(req *Request, options ...CallOption) (*Response, errors.Error)
+
+	// ReqContext is like Req, but gives up as soon as ctx is done, and keeps each attempt within ctx's deadline
+	ReqContext(ctx context.Context, req *Request, rsp proto.Message, options ...CallOption) errors.Error
+
+	// CustomReqContext is like CustomReq, but gives up as soon as ctx is done, and keeps each attempt within ctx's
+	// deadline
+	CustomReqContext(ctx context.Context, req *Request, options ...CallOption) (*Response, errors.Error)
+
+	// Go is like Req, but makes the request in the background, returning a Call to wait on for the result
+	Go(req *Request, rsp proto.Message, options ...CallOption) *Call
+
+	// GoContext is like ReqContext, but makes the request in the background, returning a Call to wait on for the result
+	GoContext(ctx context.Context, req *Request, rsp proto.Message, options ...CallOption) *Call
+
+	// Stream sends a request to an endpoint that streams its replies, returning a ResponseStream to read them from
+	// once the first has arrived. Reading stops once ctx is done
+	Stream(ctx context.Context, req *Request, options ...CallOption) (*ResponseStream, errors.Error)
 
 	// Push sends a request where we do not wish to wait for a REP (but is still REQ/REP pattern)
 	Push(req *Request) error
@@ -61,9 +78,11 @@ type client struct {
 	timeout    *Timeout
 	hostname   string
 	az         string
+	transport  raven.Transport
+	coalesced  coalescer
 }
 
-// Options to send with a client request
+// Options to send with a client request, in the original map form. See CallOption for the typed equivalents
 type Options map[string]interface{}
 
 // newClient initialises a new Client
@@ -72,7 +91,7 @@ func newClient() Client {
 
 	uuid, _ := uuid.NewV4()
 	c.instanceID = "client-" + uuid.String()
-	c.responses = &inflight{m: make(map[string]chan *Response)}
+	c.responses = newInflight()
 	c.defaults = Options{"retries": 2}
 	c.timeout = NewTimeout(c)
 
@@ -82,16 +101,49 @@ func newClient() Client {
 	return c
 }
 
+// NewTransportClient initialises a new Client which talks over the supplied transport, rather than whichever transport
+// raven is currently using
+func NewTransportClient(t raven.Transport) Client {
+	c := newClient().(*client)
+	c.transport = t
+	return c
+}
+
 // Req is a wrapper around DefaultClient.Req
-func Req(req *Request, rsp proto.Message, options ...Options) errors.Error {
+func Req(req *Request, rsp proto.Message, options ...CallOption) errors.Error {
 	return DefaultClient.Req(req, rsp, options...)
 }
 
 // CustomReq is a wrapper around DefaultClient.CustomReq
-func CustomReq(req *Request, options ...Options) (*Response, errors.Error) {
+func CustomReq(req *Request, options ...CallOption) (*Response, errors.Error) {
 	return DefaultClient.CustomReq(req, options...)
 }
 
+// ReqContext is a wrapper around DefaultClient.ReqContext
+func ReqContext(ctx context.Context, req *Request, rsp proto.Message, options ...CallOption) errors.Error {
+	return DefaultClient.ReqContext(ctx, req, rsp, options...)
+}
+
+// CustomReqContext is a wrapper around DefaultClient.CustomReqContext
+func CustomReqContext(ctx context.Context, req *Request, options ...CallOption) (*Response, errors.Error) {
+	return DefaultClient.CustomReqContext(ctx, req, options...)
+}
+
+// Go is a wrapper around DefaultClient.Go
+func Go(req *Request, rsp proto.Message, options ...CallOption) *Call {
+	return DefaultClient.Go(req, rsp, options...)
+}
+
+// GoContext is a wrapper around DefaultClient.GoContext
+func GoContext(ctx context.Context, req *Request, rsp proto.Message, options ...CallOption) *Call {
+	return DefaultClient.GoContext(ctx, req, rsp, options...)
+}
+
+// Stream is a wrapper around DefaultClient.Stream
+func Stream(ctx context.Context, req *Request, options ...CallOption) (*ResponseStream, errors.Error) {
+	return DefaultClient.Stream(ctx, req, options...)
+}
+
 // Push is a wrapper around DefaultClient.Push
 func Push(req *Request) error {
 	return DefaultClient.Push(req)
@@ -107,6 +159,14 @@ func Pub(topic string, payload proto.Message) error {
 	return DefaultClient.Pub(topic, payload)
 }
 
+// getTransport returns the transport this client talks over
+func (c *client) getTransport() raven.Transport {
+	if c.transport != nil {
+		return c.transport
+	}
+	return raven.GetTransport()
+}
+
 func (c *client) listen(ch chan bool) {
 	c.Lock()
 	defer c.Unlock()
@@ -117,12 +177,15 @@ func (c *client) listen(ch chan bool) {
 		return
 	}
 
-	if deliveries, err := raven.Consume(c.instanceID); err != nil {
+	if deliveries, err := c.getTransport().Consume(c.instanceID); err != nil {
 		log.Criticalf("[Client] Failed to consume: %v", err)
 		c.listening = false
 		ch <- false
 	} else {
 		log.Debugf("[Client] Listening on %s", c.instanceID)
+		if err := c.getTransport().BindTopic(CacheInvalidationTopic, c.instanceID); err != nil {
+			log.Warnf("[Client] Failed to listen for cache invalidations: %v", err)
+		}
 		c.listening = true
 		ch <- true
 		c.Unlock()
@@ -136,7 +199,18 @@ func (c *client) listen(ch chan bool) {
 	}
 }
 
+// newReplyChannel makes the channel a reply to a request is delivered on. It has room for the one reply, so delivering
+// it never blocks, even if whoever was waiting for it has gone
+func newReplyChannel() chan *Response {
+	return make(chan *Response, 1)
+}
+
 func (c *client) getResponse(d amqp.Delivery) {
+	if d.Headers["topic"] == CacheInvalidationTopic {
+		cache.handleInvalidation(d)
+		return
+	}
+
 	rsp := newResponseFromDelivery(d)
 
 	if len(rsp.CorrelationID()) == 0 {
@@ -144,23 +218,38 @@ func (c *client) getResponse(d amqp.Delivery) {
 		return
 	}
 
-	if rc, ok := c.responses.get(rsp); ok {
-		rc <- rsp
-		close(rc)
+	if rc, stream, ok := c.responses.get(rsp); ok {
+		if !stream {
+			rc <- rsp
+			close(rc)
+			return
+		}
+		// the server only sends as many replies as we have room for, so if there's no room the stream is finished
+		select {
+		case rc <- rsp:
+		default:
+			log.Warnf("[Client] Dropping reply to %s, with no room for it", rsp.CorrelationID())
+		}
+	} else if u, ok := c.responses.lateReply(rsp); ok {
+		log.Debugf("[Client] Late reply from %s for %s", u.service, rsp.CorrelationID())
+		inst.Counter(1.0, fmt.Sprintf("client.latereply.%s", u.service), 1)
+		c.recordLateReply(u, rsp.InstanceID())
 	} else {
 		log.Errorf("[Client] Missing message return queue for %s", rsp.CorrelationID())
 	}
 }
 
-func (c *client) Req(req *Request, rsp proto.Message, options ...Options) errors.Error {
+func (c *client) Req(req *Request, rsp proto.Message, options ...CallOption) errors.Error {
+	return c.ReqContext(context.Background(), req, rsp, options...)
+}
+
+func (c *client) ReqContext(ctx context.Context, req *Request, rsp proto.Message, options ...CallOption) errors.Error {
 	// if no options supplied, lookup request options
 	if len(options) == 0 {
-		options = []Options{req.GetOptions()}
+		options = []CallOption{req.GetOptions()}
 	}
 
-	c.traceReq(req)
-	t := time.Now()
-	responseMsg, err := c.doReq(req, options...)
+	responseMsg, err := c.doReq(ctx, req, options...)
 	if err != nil {
 		errors.Track(err.Code(), req.From(), req.Service(), req.Endpoint())
 		return err
@@ -168,7 +257,6 @@ func (c *client) Req(req *Request, rsp proto.Message, options ...Options) errors
 	if responseMsg == nil {
 		return errors.InternalServerError("com.HailoOSS.kernel.platform.nilresponse", "Nil response")
 	}
-	c.traceRsp(req, responseMsg, err, time.Now().Sub(t))
 
 	if marshalError := responseMsg.Unmarshal(rsp); marshalError != nil {
 		return errors.InternalServerError("com.HailoOSS.kernel.platform.unmarshal", marshalError.Error())
@@ -177,115 +265,260 @@ func (c *client) Req(req *Request, rsp proto.Message, options ...Options) errors
 	return nil
 }
 
-func (c *client) CustomReq(req *Request, options ...Options) (*Response, errors.Error) {
-	c.traceReq(req)
-	t := time.Now()
-	rsp, err := c.doReq(req, options...)
-	c.traceRsp(req, rsp, err, time.Now().Sub(t))
-	return rsp, err
+func (c *client) CustomReq(req *Request, options ...CallOption) (*Response, errors.Error) {
+	return c.CustomReqContext(context.Background(), req, options...)
 }
 
-// doReq sends a request, with timeout options and retries, waits for response and returns it
-func (c *client) doReq(req *Request, options ...Options) (*Response, errors.Error) {
+func (c *client) CustomReqContext(ctx context.Context, req *Request, options ...CallOption) (*Response, errors.Error) {
+	return c.doReq(ctx, req, options...)
+}
 
-	if circuitbreaker.Open(req.service, req.endpoint) {
-		inst.Counter(1.0, fmt.Sprintf("client.error.%s.%s.circuitbroken", req.service, req.endpoint), 1)
-		log.Warnf("Broken Circuit for %s.%s", req.service, req.endpoint)
-		return nil, errors.CircuitBroken("com.HailoOSS.kernel.platform.circuitbreaker", "Circuit is open")
-	}
+func (c *client) Go(req *Request, rsp proto.Message, options ...CallOption) *Call {
+	return c.GoContext(context.Background(), req, rsp, options...)
+}
 
-	retries := c.defaults["retries"].(int)
-	var timeout time.Duration
-	timeoutSupplied := false
-	if len(options) == 1 {
-		if _, ok := options[0]["retries"]; ok {
-			retries = options[0]["retries"].(int)
-		}
-		if _, ok := options[0]["timeout"]; ok {
-			timeout = options[0]["timeout"].(time.Duration)
-			timeoutSupplied = true
+func (c *client) GoContext(ctx context.Context, req *Request, rsp proto.Message, options ...CallOption) *Call {
+	return goCall(req, rsp, func() errors.Error {
+		return c.ReqContext(ctx, req, rsp, options...)
+	})
+}
+
+// doReq sends a request through the interceptor chain, and returns the response
+func (c *client) doReq(ctx context.Context, req *Request, options ...CallOption) (*Response, errors.Error) {
+	o := c.callOptions(options)
+	invoke := chain(c.interceptors(o), func(ctx context.Context, req *Request) (*Response, errors.Error) {
+		return c.invoke(ctx, req, o)
+	})
+
+	return invoke(ctx, req)
+}
+
+// invoke sends a request, with timeout options and retries, waits for response and returns it. We give up early,
+// without any more retries, if ctx is done. Idempotent requests are answered from the cache if we can, and every
+// attempt we do send is subject to the endpoint's rate limit
+func (c *client) invoke(ctx context.Context, req *Request, o *callOptions) (*Response, errors.Error) {
+	req.answered = false
+	if o.idempotent {
+		if rsp, ok := cache.get(req); ok {
+			req.answered = true
+			return rsp, nil
 		}
 	}
 
-	// setup the response channel
-	rc := make(chan *Response, retries)
-	c.responses.add(req, rc)
-	defer c.responses.removeByRequest(req)
+	if err := checkRequestSize(req); err != nil {
+		log.Warnf("[Client] Not sending %s: %v", req.MessageID(), err)
+		return nil, err
+	}
+
+	var (
+		rsp *Response
+		err errors.Error
+	)
+	if o.idempotent && (o.coalesce || coalescingEnabled(req.service, req.endpoint)) {
+		var joined bool
+		rsp, joined, err = c.coalesce(ctx, req, func() (*Response, errors.Error) {
+			return c.call(ctx, req, o)
+		})
+		req.answered = joined
+	} else {
+		rsp, err = c.call(ctx, req, o)
+	}
+
+	if err == nil && o.idempotent {
+		cache.put(req, rsp)
+	}
+	return rsp, err
+}
+
+// call makes a request with the given options, retrying and hedging as they say
+func (c *client) call(ctx context.Context, req *Request, o *callOptions) (*Response, errors.Error) {
+	retries := o.retries
+	if !o.idempotent {
+		retries = 0
+	}
+	if o.priority >= 0 {
+		req.priority = uint8(o.priority)
+	}
+
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+
+	// a deadline on the request itself, eg: inherited from the request we are handling, works like one on ctx
+	if !req.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, req.deadline)
+		defer cancel()
+	}
 
 	instPrefix := fmt.Sprintf("client.%s.%s", req.service, req.endpoint)
 	tAllRetries := time.Now()
 
-	for i := 1; i <= retries+1; i++ {
-		t := time.Now()
+	// setup the response channel, once we are under the cap on requests we wait on
+	rc := newReplyChannel()
+	if !c.responses.addWhenRoom(ctx, req, rc) {
+		return nil, c.contextError(ctx, req, instPrefix, tAllRetries)
+	}
+	defer c.responses.removeByRequest(req)
+	defer func() { req.attemptDeadline, req.instance = time.Time{}, "" }()
+
+	policy := o.retryPolicy
+	if policy == nil {
+		policy = retryPolicy(req.service, req.endpoint)
+	}
+	budget := retryBudgetFor(req.service)
+	budget.deposit()
 
-		c.RLock()
-		con := c.listening
-		c.RUnlock()
-		if !con {
-			log.Debug("[Client] not yet listening, establishing now...")
-			ch := make(chan bool)
-			go c.listen(ch)
-			if online := <-ch; !online {
-				log.Error("[Client] Listener failed")
-				inst.Timing(1.0, fmt.Sprintf("%s.error", instPrefix), time.Since(t))
-				inst.Counter(1.0, "client.error.com.HailoOSS.kernel.platform.client.listenfail", 1)
-				return nil, errors.InternalServerError("com.HailoOSS.kernel.platform.client.listenfail", "Listener failed")
+	hedgeDelay := o.hedge
+	if hedgeDelay <= 0 {
+		hedgeDelay = c.hedgeDelay(req.service, req.endpoint)
+	}
+
+	var (
+		timeout time.Duration
+		delay   time.Duration // before the next attempt
+		lastErr errors.Error  // the last error reply, if that's why we are retrying
+	)
+attempts:
+	for i := 1; i <= retries+1; i++ {
+		if ctx.Err() != nil {
+			return nil, c.contextError(ctx, req, instPrefix, tAllRetries)
+		}
+		if i > 1 && o.backoff != nil {
+			delay = o.backoff(i)
+		}
+		if i > 1 && delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil, c.contextError(ctx, req, instPrefix, tAllRetries)
 			}
+		}
+		// every attempt counts against the rate limit, not just the first
+		if err := rateLimiterFor(req.service, req.endpoint).take(ctx, req); err != nil {
+			return nil, err
+		}
+		t := time.Now()
 
-			log.Info("[Client] Listener online")
+		if err := c.ensureListening(); err != nil {
+			return nil, err
 		}
 
 		// figure out what timeout to use
-		if !timeoutSupplied {
+		timeout = o.attemptTimeout
+		if timeout <= 0 {
 			timeout = c.timeout.Get(req.service, req.endpoint, i)
 		}
+		req.attemptDeadline = time.Now().Add(timeout)
+		clipped := false // by ctx's deadline, in which case timing out says nothing about the endpoint
+		if deadline, ok := ctx.Deadline(); ok && deadline.Before(req.attemptDeadline) {
+			req.attemptDeadline = deadline
+			timeout, clipped = time.Until(deadline), true
+		}
 		log.Tracef("[Client] Sync request attempt %d for %s using timeout %v", i, req.MessageID(), timeout)
 
+		// while instances are ejected we may send the first attempt straight to a healthy one; retries go to any
+		req.instance = ""
+		if i == 1 {
+			req.instance = outliersFor(req.service).healthyInstance(time.Now())
+		}
+
 		// only bother sending the request if we are listening, otherwise allow to timeout
-		if err := raven.SendRequest(req, c.instanceID); err != nil {
-			log.Errorf("[Client] Failed to send request: %v", err)
+		if err := c.send(req); err != nil {
+			return nil, err
 		}
+		c.responses.route(req)
 
-		select {
-		case payload := <-rc:
-			if payload.IsError() {
-				inst.Timing(1.0, fmt.Sprintf("%s.error", instPrefix), time.Since(t))
-
-				errorProto := &pe.PlatformError{}
-				if err := payload.Unmarshal(errorProto); err != nil {
-					inst.Counter(1.0, "client.error.com.HailoOSS.kernel.platform.badresponse", 1)
-					return nil, errors.BadResponse("com.HailoOSS.kernel.platform.badresponse", err.Error())
+		// if we are hedging, we send another copy if there's no reply in time, and take whichever reply comes first
+		var hedge <-chan time.Time
+		if hedgeDelay > 0 && hedgeDelay < timeout && o.idempotent {
+			hedge = time.After(hedgeDelay)
+		}
+		attemptTimeout := time.After(timeout)
+
+	wait:
+		for {
+			select {
+			case <-hedge:
+				hedge = nil
+				if !budget.withdraw() {
+					log.Debugf("[Client] Not hedging request %s, retry budget for %s spent", req.MessageID(), req.Service())
+					continue
+				}
+				c.hedge(req, hedgeDelay, instPrefix)
+				continue
+			case payload := <-rc:
+				if payload.IsError() {
+					errorProto := &pe.PlatformError{}
+					if err := payload.Unmarshal(errorProto); err != nil {
+						return nil, errors.BadResponse("com.HailoOSS.kernel.platform.badresponse", err.Error())
+					}
+
+					err := errors.FromProtobuf(errorProto)
+					circuitResult(req, err)
+					c.recordOutlier(req, payload.InstanceID(), time.Since(t), err)
+					c.timeout.observe(req.service, req.endpoint, time.Since(t))
+					if retry, d := policy.Retry(i, err); retry && i <= retries && budget.withdraw() {
+						log.Debugf("[Client] Retrying %s after error %s from %s.%s", req.MessageID(), err.Code(),
+							req.Service(), req.Endpoint())
+						lastErr, delay = err, d
+
+						// the reply used up our response channel, so we need another for the next attempt
+						rc = newReplyChannel()
+						c.responses.add(req, rc)
+						break wait
+					}
+					return nil, err
 				}
 
-				err := errors.FromProtobuf(errorProto)
-				inst.Counter(1.0, fmt.Sprintf("client.error.%s", err.Code()), 1)
-				if errorProto.GetType() == pe.PlatformError_INTERNAL_SERVER_ERROR {
-					circuitbreaker.Result(req.service, req.endpoint, err)
-				} else {
-					// consider everything not an internal server error a success
-					circuitbreaker.Result(req.service, req.endpoint, nil)
+				circuitResult(req, nil)
+				c.recordOutlier(req, payload.InstanceID(), time.Since(t), nil)
+				c.timeout.observe(req.service, req.endpoint, time.Since(t))
+				return payload, nil
+			case <-ctx.Done():
+				return nil, c.contextError(ctx, req, instPrefix, tAllRetries)
+			case <-attemptTimeout:
+				// timeout
+				log.Errorf("[Client] Timeout talking to %s.%s after %v for %s", req.Service(), req.Endpoint(), timeout, req.MessageID())
+				inst.Timing(1.0, fmt.Sprintf("%s.error.attemptTimeout", instPrefix), time.Since(t))
+				c.traceAttemptTimeout(req, i, timeout)
+
+				timeoutErr := errors.Timeout("com.HailoOSS.kernel.platform.timeout",
+					fmt.Sprintf("Request timed out talking to %s.%s from %s (most recent timeout %v)", req.Service(), req.Endpoint(), req.From(), timeout),
+					req.Service(),
+					req.Endpoint())
+				if req.instance != "" {
+					c.recordOutlier(req, req.instance, time.Since(t), timeoutErr)
+				}
+				// if the caller's deadline cut the attempt short, that may well be down to how long it took before asking
+				if !clipped {
+					circuitResult(req, timeoutErr)
+					c.timeout.observeTimeout(req.service, req.endpoint, timeout)
 				}
-				return nil, err
-			}
 
-			inst.Timing(1.0, fmt.Sprintf("%s.success", instPrefix), time.Since(t))
-			circuitbreaker.Result(req.service, req.endpoint, nil)
-			return payload, nil
-		case <-time.After(timeout):
-			// timeout
-			log.Errorf("[Client] Timeout talking to %s.%s after %v for %s", req.Service(), req.Endpoint(), timeout, req.MessageID())
-			inst.Timing(1.0, fmt.Sprintf("%s.error", instPrefix), time.Since(t))
-			c.traceAttemptTimeout(req, i, timeout)
-
-			circuitbreaker.Result(req.service, req.endpoint, errors.Timeout("com.HailoOSS.kernel.platform.timeout",
-				fmt.Sprintf("Request timed out talking to %s.%s from %s (most recent timeout %v)", req.Service(), req.Endpoint(), req.From(), timeout),
-				req.Service(),
-				req.Endpoint()))
+				retry, d := policy.Retry(i, timeoutErr)
+				if !retry || i > retries {
+					lastErr = nil
+					break attempts
+				}
+				if !budget.withdraw() {
+					log.Warnf("[Client] Not retrying %s, retry budget for %s spent", req.MessageID(), req.Service())
+					lastErr = nil
+					break attempts
+				}
+				lastErr, delay = nil, d
+				break wait
+			}
 		}
 	}
 
+	if lastErr != nil {
+		return nil, lastErr
+	}
+
 	inst.Timing(1.0, fmt.Sprintf("%s.error.timedOut", instPrefix), time.Since(tAllRetries))
-	inst.Counter(1.0, "client.error.com.HailoOSS.kernel.platform.timeout", 1)
 
 	return nil, errors.Timeout(
 		"com.HailoOSS.kernel.platform.timeout",
@@ -295,6 +528,70 @@ func (c *client) doReq(req *Request, options ...Options) (*Response, errors.Erro
 	)
 }
 
+// ensureListening starts listening for replies, if we aren't already
+func (c *client) ensureListening() errors.Error {
+	c.RLock()
+	con := c.listening
+	c.RUnlock()
+	if !con {
+		log.Debug("[Client] not yet listening, establishing now...")
+		ch := make(chan bool)
+		go c.listen(ch)
+		if online := <-ch; !online {
+			log.Error("[Client] Listener failed")
+			return errors.InternalServerError("com.HailoOSS.kernel.platform.client.listenfail", "Listener failed")
+		}
+
+		log.Info("[Client] Listener online")
+	}
+
+	return nil
+}
+
+// send publishes a request, returning an error only if there is no point waiting for a reply
+func (c *client) send(req *Request) errors.Error {
+	err := c.getTransport().SendRequest(req, c.instanceID)
+	if err == raven.ErrNoRoute && req.instance != "" {
+		// the instance we sent it straight to has gone away, so let any other have it
+		log.Debugf("[Client] No route to instance %s for %s, sending to %s", req.instance, req.MessageID(),
+			req.Service())
+		req.instance = ""
+		err = c.getTransport().SendRequest(req, c.instanceID)
+	}
+	if err == raven.ErrNoRoute {
+		// nothing is bound to receive it, so there is no point waiting or retrying
+		log.Warnf("[Client] No route to %s.%s for %s", req.Service(), req.Endpoint(), req.MessageID())
+		return errors.NotFound("com.HailoOSS.kernel.platform.noroute",
+			fmt.Sprintf("No route to service %s from %s", req.Service(), req.From()),
+			req.Service(),
+			req.Endpoint())
+	}
+	if err != nil {
+		log.Errorf("[Client] Failed to send request: %v", err)
+	}
+
+	return nil
+}
+
+// contextError explains why we gave up on a request early because its context is done
+func (c *client) contextError(ctx context.Context, req *Request, instPrefix string, t time.Time) errors.Error {
+	if ctx.Err() == context.Canceled {
+		log.Debugf("[Client] Request %s to %s.%s cancelled", req.MessageID(), req.Service(), req.Endpoint())
+		inst.Timing(1.0, fmt.Sprintf("%s.error.cancelled", instPrefix), time.Since(t))
+		return errors.Timeout("com.HailoOSS.kernel.platform.cancelled",
+			fmt.Sprintf("Request cancelled talking to %s.%s from %s", req.Service(), req.Endpoint(), req.From()),
+			req.Service(),
+			req.Endpoint())
+	}
+
+	log.Errorf("[Client] Deadline exceeded talking to %s.%s for %s", req.Service(), req.Endpoint(), req.MessageID())
+	inst.Timing(1.0, fmt.Sprintf("%s.error.timedOut", instPrefix), time.Since(t))
+	return errors.Timeout("com.HailoOSS.kernel.platform.timeout",
+		fmt.Sprintf("Deadline exceeded talking to %s.%s from %s", req.Service(), req.Endpoint(), req.From()),
+		req.Service(),
+		req.Endpoint())
+}
+
 // traceReq decides if we want to trigger a trace event (when sending a request) and if so deals with it
 func (c *client) traceReq(req *Request) {
 	if req.shouldTrace() {
@@ -367,12 +664,15 @@ func (c *client) traceAttemptTimeout(req *Request, attemptNum int, timeout time.
 
 // Push sends a request where we do not wish to wait for a REP (but is still REQ/REP pattern)
 func (c *client) Push(req *Request) error {
-	return raven.SendRequest(req, c.instanceID)
+	if err := checkRequestSize(req); err != nil {
+		return err
+	}
+	return c.getTransport().SendRequest(req, c.instanceID)
 }
 
 // AsyncTopic sends a pub/sub message (a Publication)
 func (c *client) AsyncTopic(pub *Publication) error {
-	return raven.SendPublication(pub, c.instanceID)
+	return c.getTransport().SendPublication(pub, c.instanceID)
 }
 
 // Pub created and sends a Publication (via AsyncTopic) in one handy step
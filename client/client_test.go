@@ -0,0 +1,173 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/HailoOSS/platform/errors"
+	"github.com/HailoOSS/platform/raven"
+	"github.com/HailoOSS/service/config"
+)
+
+// testResponse is the minimal raven.Response used to reply from our fake service
+type testResponse struct {
+	replyTo, messageID string
+	payload            []byte
+}
+
+func (r *testResponse) ContentType() string { return "application/json" }
+func (r *testResponse) MessageType() string { return "reply" }
+func (r *testResponse) Payload() []byte     { return r.payload }
+func (r *testResponse) ReplyTo() string     { return r.replyTo }
+func (r *testResponse) MessageID() string   { return r.messageID }
+
+func TestReqOverMemoryTransport(t *testing.T) {
+	service := raven.NewMemoryTransport(raven.NewMemoryBroker())
+	service.Connect()
+
+	deliveries, err := service.Consume("server-com.HailoOSS.service.echo")
+	if err != nil {
+		t.Fatalf("Unexpected error consuming: %v", err)
+	}
+	if err := service.BindService("com.HailoOSS.service.echo", "server-com.HailoOSS.service.echo"); err != nil {
+		t.Fatalf("Unexpected error binding: %v", err)
+	}
+
+	// echo every request straight back
+	go func() {
+		for d := range deliveries {
+			service.SendResponse(&testResponse{
+				replyTo:   d.ReplyTo,
+				messageID: d.MessageId,
+				payload:   d.Body,
+			}, "server-com.HailoOSS.service.echo")
+		}
+	}()
+
+	c := NewTransportClient(service)
+	req, _ := NewJsonRequest("com.HailoOSS.service.echo", "echo", []byte(`{"hello":"world"}`))
+	rsp, cerr := c.CustomReq(req, Options{"retries": 0, "timeout": time.Second})
+	if cerr != nil {
+		t.Fatalf("Unexpected error making request: %v", cerr)
+	}
+	if string(rsp.Body()) != `{"hello":"world"}` {
+		t.Errorf("Unexpected response body: %s", rsp.Body())
+	}
+	if rsp.CorrelationID() != req.MessageID() {
+		t.Errorf("Response correlation ID %s does not match request %s", rsp.CorrelationID(), req.MessageID())
+	}
+
+	// both ends should keep receiving once the connection comes back
+	if err := service.Reconnect(fmt.Errorf("connection reset")); err != nil {
+		t.Fatalf("Unexpected error reconnecting: %v", err)
+	}
+	req, _ = NewJsonRequest("com.HailoOSS.service.echo", "echo", []byte(`{"hello":"again"}`))
+	rsp, cerr = c.CustomReq(req, Options{"retries": 0, "timeout": time.Second})
+	if cerr != nil {
+		t.Fatalf("Unexpected error making request after reconnecting: %v", cerr)
+	}
+	if string(rsp.Body()) != `{"hello":"again"}` {
+		t.Errorf("Unexpected response body after reconnecting: %s", rsp.Body())
+	}
+}
+
+func TestReqNoRouteFailsFast(t *testing.T) {
+	config.Load(bytes.NewBufferString(`{"hailo":{"platform":{"raven":{"confirms":true}}}}`))
+	defer config.Load(bytes.NewBufferString(`{}`))
+
+	tr := raven.NewMemoryTransport(raven.NewMemoryBroker())
+	tr.Connect()
+
+	c := NewTransportClient(tr)
+	req, _ := NewJsonRequest("com.HailoOSS.service.missing", "foo", []byte(`{}`))
+	start := time.Now()
+	_, err := c.CustomReq(req, Options{"retries": 2, "timeout": time.Second})
+	if err == nil {
+		t.Fatal("Expected an error requesting a service with nothing bound")
+	}
+	if err.Type() != errors.ErrorNotFound || err.Code() != "com.HailoOSS.kernel.platform.noroute" {
+		t.Errorf("Expected a noroute NOT_FOUND error, got %s %s", err.Type(), err.Code())
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("Expected to fail fast, took %v", time.Since(start))
+	}
+}
+
+func TestReqContextCancelAndDeadline(t *testing.T) {
+	tr := raven.NewMemoryTransport(raven.NewMemoryBroker())
+	tr.Connect()
+
+	// a service that never replies
+	if _, err := tr.Consume("server-com.HailoOSS.service.slow"); err != nil {
+		t.Fatalf("Unexpected error consuming: %v", err)
+	}
+	if err := tr.BindService("com.HailoOSS.service.slow", "server-com.HailoOSS.service.slow"); err != nil {
+		t.Fatalf("Unexpected error binding: %v", err)
+	}
+
+	c := NewTransportClient(tr).(*client)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	req, _ := NewJsonRequest("com.HailoOSS.service.slow", "foo", []byte(`{}`))
+	start := time.Now()
+	_, err := c.CustomReqContext(ctx, req, Options{"retries": 2, "timeout": time.Second})
+	if err == nil || err.Code() != "com.HailoOSS.kernel.platform.cancelled" {
+		t.Fatalf("Expected a cancelled error, got %v", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("Expected to give up when cancelled, took %v", time.Since(start))
+	}
+	if _, ok := c.responses.m[req.MessageID()]; ok {
+		t.Errorf("Expected the inflight entry to be removed")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ = NewJsonRequest("com.HailoOSS.service.slow", "foo", []byte(`{}`))
+	start = time.Now()
+	_, err = c.CustomReqContext(ctx, req, Options{"retries": 2, "timeout": time.Second})
+	if err == nil || err.Type() != errors.ErrorTimeout || err.Code() != "com.HailoOSS.kernel.platform.timeout" {
+		t.Fatalf("Expected a timeout error, got %v", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("Expected the deadline to cap the attempt timeout, took %v", time.Since(start))
+	}
+}
+
+func TestReqSendsDeadline(t *testing.T) {
+	tr := raven.NewMemoryTransport(raven.NewMemoryBroker())
+	tr.Connect()
+
+	deliveries, err := tr.Consume("server-com.HailoOSS.service.slow")
+	if err != nil {
+		t.Fatalf("Unexpected error consuming: %v", err)
+	}
+	if err := tr.BindService("com.HailoOSS.service.slow", "server-com.HailoOSS.service.slow"); err != nil {
+		t.Fatalf("Unexpected error binding: %v", err)
+	}
+
+	c := NewTransportClient(tr)
+	req, _ := NewJsonRequest("com.HailoOSS.service.slow", "foo", []byte(`{}`))
+	deadline := time.Now().Add(50 * time.Millisecond)
+	req.SetDeadline(deadline)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.CustomReq(req, Options{"retries": 0, "timeout": time.Second})
+	}()
+	defer func() { <-done }()
+
+	d := <-deliveries
+	ns, err := strconv.ParseInt(d.Headers["deadline"].(string), 10, 64)
+	if err != nil {
+		t.Fatalf("Expected a deadline header, got %v", d.Headers["deadline"])
+	}
+	if sent := time.Unix(0, ns); sent.After(deadline) {
+		t.Errorf("Expected the sent deadline %v to be no later than %v", sent, deadline)
+	}
+}
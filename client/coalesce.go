@@ -0,0 +1,92 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/HailoOSS/platform/errors"
+	"github.com/HailoOSS/service/config"
+	inst "github.com/HailoOSS/service/instrumentation"
+)
+
+// CoalescingOptions opt an endpoint in to request coalescing, under
+// hailo.platform.client.coalescing.endpoints.<service>.<endpoint>
+type CoalescingOptions struct {
+	Enabled bool `json:"enabled,omitempty"`
+}
+
+// WithCoalescing collapses concurrent identical requests, with the same service, endpoint, payload and session, into
+// a single call whose response is shared by all of them. Only idempotent requests are coalesced
+func WithCoalescing() CallOption {
+	return callOptionFunc(func(o *callOptions) {
+		o.coalesce = true
+	})
+}
+
+// coalescingEnabled says whether an endpoint has been opted in to coalescing in config
+func coalescingEnabled(service, endpoint string) bool {
+	opts := CoalescingOptions{}
+	config.AtPath("hailo", "platform", "client", "coalescing", "endpoints", service, endpoint).AsStruct(&opts)
+	return opts.Enabled
+}
+
+// coalescedCall is a call in flight, which identical requests wait on rather than making their own
+type coalescedCall struct {
+	done chan struct{}
+	rsp  *Response
+	err  errors.Error
+}
+
+// coalescer tracks the coalesced calls in flight. The zero value is ready to use
+type coalescer struct {
+	sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// coalesceKey identifies identical requests
+func coalesceKey(req *Request) string {
+	return strings.Join([]string{req.service, req.endpoint, req.sessionID, req.contentType, string(req.payload)}, "\x00")
+}
+
+// coalesce makes the call, unless an identical one is already in flight, in which case we wait for its response
+// instead. Whoever makes the call decides how long it can take, so a waiter may get a timeout from a call it joined
+// late, but stops waiting as soon as its own ctx is done. joined says whether we waited on another call
+func (c *client) coalesce(ctx context.Context, req *Request, call func() (*Response, errors.Error)) (*Response, bool, errors.Error) {
+	cs := &c.coalesced
+	key := coalesceKey(req)
+	instPrefix := fmt.Sprintf("client.%s.%s", req.service, req.endpoint)
+
+	cs.Lock()
+	if cs.calls == nil {
+		cs.calls = make(map[string]*coalescedCall)
+	}
+	if inflight, ok := cs.calls[key]; ok {
+		cs.Unlock()
+		log.Debugf("[Client] Coalescing request %s with an identical one in flight", req.MessageID())
+		inst.Counter(1.0, fmt.Sprintf("%s.coalesced", instPrefix), 1)
+		t := time.Now()
+		select {
+		case <-inflight.done:
+			return inflight.rsp, true, inflight.err
+		case <-ctx.Done():
+			return nil, true, c.contextError(ctx, req, instPrefix, t)
+		}
+	}
+	cc := &coalescedCall{done: make(chan struct{})}
+	cs.calls[key] = cc
+	cs.Unlock()
+
+	cc.rsp, cc.err = call()
+
+	cs.Lock()
+	delete(cs.calls, key)
+	cs.Unlock()
+	close(cc.done)
+
+	return cc.rsp, false, cc.err
+}
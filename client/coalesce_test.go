@@ -0,0 +1,87 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/HailoOSS/platform/errors"
+)
+
+func TestCoalesce(t *testing.T) {
+	c := newClient().(*client)
+
+	var calls int32
+	release := make(chan struct{})
+	call := func() (*Response, errors.Error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return newResponseFromDelivery(amqp.Delivery{Body: []byte(`{}`)}), nil
+	}
+
+	rsps := make(chan *Response, 5)
+	var joined int32
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		req, _ := NewJsonRequest("com.HailoOSS.service.config", "read", []byte(`{"id":"foo"}`))
+		req.SetSessionID("session")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rsp, j, err := c.coalesce(context.Background(), req, call)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if j {
+				atomic.AddInt32(&joined, 1)
+			}
+			rsps <- rsp
+		}()
+	}
+
+	// a different session gets its own call
+	other, _ := NewJsonRequest("com.HailoOSS.service.config", "read", []byte(`{"id":"foo"}`))
+	other.SetSessionID("other")
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.coalesce(context.Background(), other, call)
+	}()
+
+	// a waiter whose ctx is done stops waiting
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := NewJsonRequest("com.HailoOSS.service.config", "read", []byte(`{"id":"foo"}`))
+	req.SetSessionID("session")
+	if _, _, err := c.coalesce(ctx, req, call); err == nil || err.Code() != "com.HailoOSS.kernel.platform.cancelled" {
+		t.Errorf("Expected a cancelled waiter to give up, got %v", err)
+	}
+
+	close(release)
+	wg.Wait()
+	close(rsps)
+
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("Expected 2 calls, one per session, got %d", n)
+	}
+	if n := atomic.LoadInt32(&joined); n != 4 {
+		t.Errorf("Expected 4 requests to wait on the first, got %d", n)
+	}
+	var first *Response
+	for rsp := range rsps {
+		if first == nil {
+			first = rsp
+		}
+		if rsp == nil || rsp != first {
+			t.Errorf("Expected every waiter to get the same response")
+		}
+	}
+	if len(c.coalesced.calls) != 0 {
+		t.Errorf("Expected no calls left in flight, got %d", len(c.coalesced.calls))
+	}
+}
@@ -0,0 +1,16 @@
+package client
+
+import (
+	"github.com/HailoOSS/service/config"
+)
+
+// onConfigChange calls f in the background every time config changes, eg: to reload options read from it
+func onConfigChange(f func()) {
+	ch := config.SubscribeChanges()
+	go func() {
+		for {
+			<-ch
+			f()
+		}
+	}()
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/HailoOSS/service/config"
+	inst "github.com/HailoOSS/service/instrumentation"
+)
+
+// HedgingOptions opt an endpoint in to hedged requests, under
+// hailo.platform.client.hedging.endpoints.<service>.<endpoint>. Only do this for endpoints that are safe to call more
+// than once, eg: reads
+type HedgingOptions struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// DelayMs is how long we wait for a reply before sending another copy of the request. By default we use the
+	// endpoint's Upper95 SLA
+	DelayMs int64 `json:"delayMs,omitempty"`
+}
+
+// hedgeDelay returns how long to wait before hedging a request to an endpoint, or zero if we shouldn't
+func (c *client) hedgeDelay(service, endpoint string) time.Duration {
+	opts := HedgingOptions{}
+	config.AtPath("hailo", "platform", "client", "hedging", "endpoints", service, endpoint).AsStruct(&opts)
+	if !opts.Enabled {
+		return 0
+	}
+	if opts.DelayMs > 0 {
+		return time.Duration(opts.DelayMs) * time.Millisecond
+	}
+
+	// without an SLA we don't know what's slow, so don't hedge
+	if sla, ok := c.timeout.fetchSla(service, endpoint); ok {
+		return sla
+	}
+	return 0
+}
+
+// hedgeCopy makes a copy of a request to send as a hedge, with its own message ID so that we can tell which copy the
+// reply is for. The copy goes to any instance, in case the one the original went to is the problem
+func hedgeCopy(req *Request) (*Request, error) {
+	messageID, err := newMessageID()
+	if err != nil {
+		return nil, err
+	}
+
+	cp := *req
+	cp.messageID = messageID
+	cp.instance = ""
+	return &cp, nil
+}
+
+// hedge sends another copy of a request that hasn't had a reply yet. Whichever reply comes back first is used, and we
+// stop waiting for the other. The copy counts against the rate limit, and we don't hedge rather than wait for it
+func (c *client) hedge(req *Request, delay time.Duration, instPrefix string) {
+	if !rateLimiterFor(req.service, req.endpoint).tryTake() {
+		log.Debugf("[Client] Not hedging request %s, over the rate limit for %s.%s", req.MessageID(), req.Service(),
+			req.Endpoint())
+		return
+	}
+
+	cp, err := hedgeCopy(req)
+	if err != nil {
+		log.Warnf("[Client] Failed to hedge request %s: %v", req.MessageID(), err)
+		return
+	}
+
+	log.Debugf("[Client] Hedging request %s as %s after %v", req.MessageID(), cp.MessageID(), delay)
+	inst.Counter(1.0, fmt.Sprintf("%s.hedged", instPrefix), 1)
+	c.responses.addCopy(req, cp)
+	if err := c.send(cp); err != nil {
+		log.Warnf("[Client] Failed to send hedged request %s: %v", cp.MessageID(), err)
+	}
+}
@@ -1,19 +1,179 @@
 package client
 
 import (
+	"context"
+	"fmt"
 	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/HailoOSS/service/config"
+	inst "github.com/HailoOSS/service/instrumentation"
 )
 
+// InflightOptions bound the requests a client waits on, under hailo.platform.client.inflight
+type InflightOptions struct {
+	// MaxRequests caps how many requests we wait on at once, with 0 meaning no cap. Once we hit it, new requests wait
+	// for room, or until their context is done
+	MaxRequests int `json:"maxRequests,omitempty"`
+	// MaxAgeMs is how long we wait on a request before the sweeper decides it was abandoned and forgets it
+	MaxAgeMs int64 `json:"maxAgeMs,omitempty"`
+	// SweepIntervalMs is how often the sweeper runs, and reports how many requests we are waiting on
+	SweepIntervalMs int64 `json:"sweepIntervalMs,omitempty"`
+	// LateReplyWindowMs is how long we remember requests we gave up on, so we can count replies that turn up late
+	LateReplyWindowMs int64 `json:"lateReplyWindowMs,omitempty"`
+}
+
+// InflightStats describe the requests a client is waiting on
+type InflightStats struct {
+	Requests int
+	// Oldest is how long we have been waiting on the oldest request, other than streams
+	Oldest    time.Duration
+	Abandoned uint64
+	// LateReplies counts the replies, by service, that turned up after we gave up on the request
+	LateReplies map[string]uint64
+}
+
+var defaultInflightOptions = InflightOptions{
+	MaxRequests:       50000,
+	MaxAgeMs:          10 * 60 * 1000, // 10 mins, well over the longest timeout
+	SweepIntervalMs:   10 * 1000,
+	LateReplyWindowMs: 60 * 1000,
+}
+
+// maxUnanswered caps how many requests we remember giving up on, whatever the late reply window
+const maxUnanswered = 10000
+
+// pending is a request we are waiting on
+type pending struct {
+	ch      chan *Response
+	service string
+	added   time.Time
+	// instance is the one we sent the request straight to, if we did
+	instance string
+	// stream requests get any number of replies, so we keep waiting on them until they are removed
+	stream bool
+}
+
+// unanswered is a request we gave up on, in case its reply turns up late
+type unanswered struct {
+	service string
+	at      time.Time
+	sent    time.Time
+	// direct is set if we sent the request straight to an instance, so knew which to blame when we gave up on it
+	direct bool
+	// lost is set if another copy of the request was answered first, so this one was slow rather than given up on
+	lost bool
+}
+
 // Inflight contains a list of responses which we are currently awaiting responses
 type inflight struct {
 	sync.RWMutex
-	m map[string]chan *Response
+	opts InflightOptions
+	m    map[string]*pending
+	// copies maps the message ID of each extra copy of a request we have sent, eg: a hedge, to the original
+	copies map[string]string
+	// room is closed when a request is forgotten, to wake anyone waiting for room under the cap
+	room       chan struct{}
+	unanswered map[string]unanswered
+	abandoned  uint64
+	late       map[string]uint64
+}
+
+func newInflight() *inflight {
+	f := &inflight{
+		m:          make(map[string]*pending),
+		copies:     make(map[string]string),
+		unanswered: make(map[string]unanswered),
+		late:       make(map[string]uint64),
+	}
+
+	onConfigChange(f.loadFromConfig)
+	f.loadFromConfig()
+	go f.sweeper()
+
+	return f
+}
+
+func (self *inflight) loadFromConfig() {
+	opts := defaultInflightOptions
+	config.AtPath("hailo", "platform", "client", "inflight").AsStruct(&opts)
+
+	self.Lock()
+	defer self.Unlock()
+	if opts != self.opts {
+		log.Infof("[Client] Loaded inflight configuration from config service %+v", opts)
+	}
+	self.opts = opts
+	// a higher cap may have made room
+	self.wake()
 }
 
 func (self *inflight) add(req *Request, ch chan *Response) {
 	self.Lock()
 	defer self.Unlock()
-	self.m[req.messageID] = ch
+	self.m[req.messageID] = &pending{ch: ch, service: req.service, added: time.Now()}
+}
+
+// addWhenRoom adds a request once we are under the cap, returning false if ctx is done first
+func (self *inflight) addWhenRoom(ctx context.Context, req *Request, ch chan *Response) bool {
+	var waitingSince time.Time
+	for {
+		self.Lock()
+		if self.opts.MaxRequests <= 0 || self.size() < self.opts.MaxRequests {
+			self.m[req.messageID] = &pending{ch: ch, service: req.service, added: time.Now()}
+			self.Unlock()
+			if !waitingSince.IsZero() {
+				inst.Timing(1.0, "client.inflight.wait", time.Since(waitingSince))
+			}
+			return true
+		}
+		if waitingSince.IsZero() {
+			waitingSince = time.Now()
+			inst.Counter(1.0, "client.inflight.full", 1)
+			log.Warnf("[Client] Waiting on %d requests, %s waiting for room", self.opts.MaxRequests, req.MessageID())
+		}
+		if self.room == nil {
+			self.room = make(chan struct{})
+		}
+		room := self.room
+		self.Unlock()
+
+		select {
+		case <-room:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// route notes which instance, if any, we have just sent a request straight to
+func (self *inflight) route(req *Request) {
+	self.Lock()
+	defer self.Unlock()
+	if p, ok := self.m[req.messageID]; ok {
+		p.instance = req.instance
+	}
+}
+
+// markStream keeps us waiting on a request after its first reply, until it is removed
+func (self *inflight) markStream(req *Request) {
+	self.Lock()
+	defer self.Unlock()
+	if p, ok := self.m[req.messageID]; ok {
+		p.stream = true
+	}
+}
+
+// addCopy means a reply to the copy goes to whoever is waiting for the original request
+func (self *inflight) addCopy(req, cp *Request) {
+	self.Lock()
+	defer self.Unlock()
+	if p, ok := self.m[req.messageID]; ok {
+		self.m[cp.messageID] = p
+		self.copies[cp.messageID] = req.messageID
+	}
 }
 
 func (self *inflight) removeByRequest(req *Request) {
@@ -24,23 +184,183 @@ func (self *inflight) removeByResponse(rsp *Response) {
 	self.remove(rsp.CorrelationID())
 }
 
+// remove stops waiting on a request, eg: because we gave up on it, remembering it in case the reply turns up late.
+// The channel of a stream is left open, as replies may still be being delivered to it
 func (self *inflight) remove(id string) {
 	self.Lock()
 	defer self.Unlock()
 
-	if ch, ok := self.m[id]; ok {
-		delete(self.m, id)
-		close(ch)
+	if p, ok := self.m[id]; ok {
+		ids := self.forget(id)
+		if p.stream {
+			return
+		}
+		for i, id := range ids {
+			self.remember(id, p, i == 0, false)
+		}
+		close(p.ch)
 	}
 }
 
-// more of a getAndRemove
-func (self *inflight) get(rsp *Response) (ch chan *Response, ok bool) {
+// more of a getAndRemove. Once we have a reply for any copy of a request we stop waiting for the others, so their
+// replies count as late. Streams are the exception, which we keep waiting on
+func (self *inflight) get(rsp *Response) (ch chan *Response, stream bool, ok bool) {
 	self.Lock()
 	defer self.Unlock()
-	ch, ok = self.m[rsp.CorrelationID()]
+	p, ok := self.m[rsp.CorrelationID()]
 	if ok {
-		delete(self.m, rsp.CorrelationID())
+		if !p.stream {
+			for i, id := range self.forget(rsp.CorrelationID()) {
+				if id != rsp.CorrelationID() {
+					self.remember(id, p, i == 0, true)
+				}
+			}
+		}
+		ch, stream = p.ch, p.stream
 	}
 	return
 }
+
+// lateReply is called for a reply we aren't waiting on, and returns the request it's for if we gave up on it, or
+// another copy was answered first, recently
+func (self *inflight) lateReply(rsp *Response) (unanswered, bool) {
+	self.Lock()
+	defer self.Unlock()
+
+	u, ok := self.unanswered[rsp.CorrelationID()]
+	if !ok {
+		return unanswered{}, false
+	}
+	delete(self.unanswered, rsp.CorrelationID())
+	self.late[u.service]++
+	return u, true
+}
+
+// forget removes a request and all copies of it, returning their IDs - must be called with the lock held
+func (self *inflight) forget(id string) []string {
+	if orig, ok := self.copies[id]; ok {
+		id = orig
+	}
+	ids := []string{id}
+	delete(self.m, id)
+	for cp, orig := range self.copies {
+		if orig == id {
+			delete(self.m, cp)
+			delete(self.copies, cp)
+			ids = append(ids, cp)
+		}
+	}
+	self.wake()
+	return ids
+}
+
+// remember a request we gave up on, or a copy of one that lost to another, whose original is the first of the IDs
+// forget returns - must be called with the lock held
+func (self *inflight) remember(id string, p *pending, original, lost bool) {
+	if self.opts.LateReplyWindowMs <= 0 || len(self.unanswered) >= maxUnanswered {
+		return
+	}
+	self.unanswered[id] = unanswered{
+		service: p.service,
+		at:      time.Now(),
+		sent:    p.added,
+		direct:  original && p.instance != "",
+		lost:    lost,
+	}
+}
+
+// wake anyone waiting for room - must be called with the lock held
+func (self *inflight) wake() {
+	if self.room != nil {
+		close(self.room)
+		self.room = nil
+	}
+}
+
+// size is how many requests we are waiting on, not counting copies - must be called with the lock held
+func (self *inflight) size() int {
+	return len(self.m) - len(self.copies)
+}
+
+// sweeper periodically forgets abandoned requests, and reports how many we are waiting on
+func (self *inflight) sweeper() {
+	for {
+		self.RLock()
+		interval := time.Duration(self.opts.SweepIntervalMs) * time.Millisecond
+		self.RUnlock()
+		if interval <= 0 {
+			interval = time.Duration(defaultInflightOptions.SweepIntervalMs) * time.Millisecond
+		}
+
+		time.Sleep(interval)
+		self.sweep(time.Now())
+	}
+}
+
+// sweep forgets requests we have been waiting on for too long, and those we gave up on too long ago to still count
+// their replies as late. We don't close the channels of abandoned requests, as someone may still be waiting on them.
+// Streams can legitimately go on for as long as they like, so aren't swept
+func (self *inflight) sweep(now time.Time) {
+	self.Lock()
+	defer self.Unlock()
+
+	maxAge := time.Duration(self.opts.MaxAgeMs) * time.Millisecond
+	var oldest time.Duration
+	for id, p := range self.m {
+		if _, ok := self.copies[id]; ok || p.stream {
+			continue
+		}
+		age := now.Sub(p.added)
+		if maxAge > 0 && age > maxAge {
+			log.Warnf("[Client] Forgetting request %s to %s, abandoned after %v", id, p.service, age)
+			inst.Counter(1.0, fmt.Sprintf("client.inflight.abandoned.%s", p.service), 1)
+			self.abandoned++
+			for i, id := range self.forget(id) {
+				self.remember(id, p, i == 0, false)
+			}
+			continue
+		}
+		if age > oldest {
+			oldest = age
+		}
+	}
+
+	window := time.Duration(self.opts.LateReplyWindowMs) * time.Millisecond
+	for id, u := range self.unanswered {
+		if now.Sub(u.at) > window {
+			delete(self.unanswered, id)
+		}
+	}
+
+	inst.Gauge(1.0, "client.inflight.size", self.size())
+	inst.Timing(1.0, "client.inflight.oldest", oldest)
+}
+
+func (self *inflight) stats() InflightStats {
+	self.RLock()
+	defer self.RUnlock()
+
+	s := InflightStats{
+		Requests:    self.size(),
+		Abandoned:   self.abandoned,
+		LateReplies: make(map[string]uint64, len(self.late)),
+	}
+	now := time.Now()
+	for id, p := range self.m {
+		if _, ok := self.copies[id]; !ok && !p.stream && now.Sub(p.added) > s.Oldest {
+			s.Oldest = now.Sub(p.added)
+		}
+	}
+	for service, n := range self.late {
+		s.LateReplies[service] = n
+	}
+	return s
+}
+
+// Inflight returns the state of the requests the default client is waiting on
+func Inflight() InflightStats {
+	if c, ok := DefaultClient.(*client); ok {
+		return c.responses.stats()
+	}
+	return InflightStats{}
+}
@@ -0,0 +1,164 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestInflightCopies(t *testing.T) {
+	f := newInflight()
+	req := &Request{messageID: "original"}
+	cp := &Request{messageID: "hedge"}
+
+	ch := make(chan *Response, 1)
+	f.add(req, ch)
+	f.addCopy(req, cp)
+
+	got, _, ok := f.get(newResponseFromDelivery(amqp.Delivery{CorrelationId: "hedge"}))
+	if !ok || got != ch {
+		t.Fatalf("Expected a reply to the copy to go to the original's channel")
+	}
+	if _, _, ok := f.get(newResponseFromDelivery(amqp.Delivery{CorrelationId: "original"})); ok {
+		t.Errorf("Expected the original to be forgotten once the copy had a reply")
+	}
+	if len(f.m) != 0 || len(f.copies) != 0 {
+		t.Errorf("Expected nothing left inflight, got %v %v", f.m, f.copies)
+	}
+
+	ch = make(chan *Response, 1)
+	f.add(req, ch)
+	f.addCopy(req, cp)
+	f.removeByRequest(req)
+	if len(f.m) != 0 || len(f.copies) != 0 {
+		t.Errorf("Expected removing the original to remove its copies, got %v %v", f.m, f.copies)
+	}
+	if _, open := <-ch; open {
+		t.Errorf("Expected the channel to be closed")
+	}
+}
+
+func TestInflightLosingCopyRepliesLate(t *testing.T) {
+	f := newInflight()
+	req := &Request{messageID: "hedged", service: "com.HailoOSS.service.hedged"}
+	f.add(req, newReplyChannel())
+	f.addCopy(req, &Request{messageID: "hedged-copy"})
+
+	if _, _, ok := f.get(newResponseFromDelivery(amqp.Delivery{CorrelationId: "hedged-copy"})); !ok {
+		t.Fatalf("Expected to be waiting on the copy")
+	}
+	if _, ok := f.lateReply(newResponseFromDelivery(amqp.Delivery{CorrelationId: "hedged-copy"})); ok {
+		t.Errorf("Expected the winning reply not to be remembered as unanswered")
+	}
+	if u, ok := f.lateReply(newResponseFromDelivery(amqp.Delivery{CorrelationId: "hedged"})); !ok ||
+		u.service != "com.HailoOSS.service.hedged" || !u.lost {
+		t.Errorf("Expected the losing reply to count as late, got %+v", u)
+	}
+}
+
+func TestGetResponseWithNobodyWaiting(t *testing.T) {
+	c := newClient().(*client)
+	req := &Request{messageID: "gone", service: "com.HailoOSS.service.gone"}
+	c.responses.add(req, newReplyChannel())
+
+	// whoever sent the request has stopped waiting, eg: their context was cancelled, but hasn't removed it yet
+	done := make(chan struct{})
+	go func() {
+		c.getResponse(amqp.Delivery{CorrelationId: "gone"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected delivering a reply not to block with nobody waiting for it")
+	}
+}
+
+func TestInflightCap(t *testing.T) {
+	f := newInflight()
+	f.Lock()
+	f.opts.MaxRequests = 1
+	f.Unlock()
+
+	first, second := &Request{messageID: "first"}, &Request{messageID: "second"}
+	if !f.addWhenRoom(context.Background(), first, make(chan *Response, 1)) {
+		t.Fatalf("Expected room for the first request")
+	}
+	f.addCopy(first, &Request{messageID: "hedge"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if f.addWhenRoom(ctx, second, make(chan *Response, 1)) {
+		t.Fatalf("Expected no room for the second request while the first is inflight")
+	}
+
+	added := make(chan bool)
+	go func() {
+		added <- f.addWhenRoom(context.Background(), second, make(chan *Response, 1))
+	}()
+	f.removeByRequest(first)
+	select {
+	case ok := <-added:
+		if !ok {
+			t.Errorf("Expected the second request to be added once there was room")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the second request to stop waiting once there was room")
+	}
+}
+
+func TestInflightLateReplies(t *testing.T) {
+	f := newInflight()
+	req := &Request{messageID: "slow", service: "com.HailoOSS.service.slow"}
+	f.add(req, make(chan *Response, 1))
+	f.addCopy(req, &Request{messageID: "slow-hedge"})
+	f.removeByRequest(req)
+
+	for _, id := range []string{"slow", "slow-hedge"} {
+		u, ok := f.lateReply(newResponseFromDelivery(amqp.Delivery{CorrelationId: id}))
+		if !ok || u.service != "com.HailoOSS.service.slow" || u.lost {
+			t.Errorf("Expected a late reply to %s to be from the slow service, got %+v", id, u)
+		}
+	}
+	if _, ok := f.lateReply(newResponseFromDelivery(amqp.Delivery{CorrelationId: "unknown"})); ok {
+		t.Errorf("Expected a reply to a request we never sent not to count as late")
+	}
+	if s := f.stats(); s.LateReplies["com.HailoOSS.service.slow"] != 2 {
+		t.Errorf("Expected 2 late replies from the slow service, got %v", s.LateReplies)
+	}
+}
+
+func TestInflightSweep(t *testing.T) {
+	f := newInflight()
+	f.Lock()
+	f.opts.MaxAgeMs, f.opts.LateReplyWindowMs = 1000, 1000
+	f.Unlock()
+
+	ch := make(chan *Response, 1)
+	f.add(&Request{messageID: "abandoned", service: "com.HailoOSS.service.leaky"}, ch)
+	f.add(&Request{messageID: "recent", service: "com.HailoOSS.service.leaky"}, make(chan *Response, 1))
+	f.Lock()
+	f.m["abandoned"].added = time.Now().Add(-2 * time.Second)
+	f.Unlock()
+
+	f.sweep(time.Now())
+	if s := f.stats(); s.Requests != 1 || s.Abandoned != 1 {
+		t.Errorf("Expected the abandoned request to be swept, got %+v", s)
+	}
+	select {
+	case <-ch:
+		t.Errorf("Expected the channel of an abandoned request to be left open")
+	default:
+	}
+
+	// it's remembered for a while, in case the reply turns up
+	if _, ok := f.unanswered["abandoned"]; !ok {
+		t.Errorf("Expected the abandoned request to be remembered")
+	}
+	f.sweep(time.Now().Add(2 * time.Second))
+	if _, ok := f.unanswered["abandoned"]; ok {
+		t.Errorf("Expected the abandoned request to be forgotten after the late reply window")
+	}
+}
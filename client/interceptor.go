@@ -0,0 +1,112 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/HailoOSS/platform/circuitbreaker"
+	"github.com/HailoOSS/platform/errors"
+	inst "github.com/HailoOSS/service/instrumentation"
+)
+
+// Invoker makes a request, eg: by calling the next interceptor in the chain, or actually sending it at the end
+type Invoker func(ctx context.Context, req *Request) (*Response, errors.Error)
+
+// Interceptor wraps every request a client makes, in the same way server Middleware wraps handlers. It can change the
+// request, eg: to add an auth token, before calling next to carry on, or not call next at all, eg: to inject a fault
+type Interceptor func(ctx context.Context, req *Request, next Invoker) (*Response, errors.Error)
+
+var (
+	interceptors   []Interceptor // registered with RegisterInterceptor
+	interceptorsMu sync.RWMutex
+)
+
+// RegisterInterceptor adds interceptors to every request made by every client. They run after the default tracing,
+// instrumentation and circuit breaking, in the order they are registered
+func RegisterInterceptor(is ...Interceptor) {
+	interceptorsMu.Lock()
+	defer interceptorsMu.Unlock()
+	interceptors = append(interceptors, is...)
+}
+
+// WithInterceptors adds interceptors to a single request, which run after any registered with RegisterInterceptor
+func WithInterceptors(is ...Interceptor) CallOption {
+	return callOptionFunc(func(o *callOptions) {
+		o.interceptors = append(o.interceptors, is...)
+	})
+}
+
+// chain wraps an invoker in interceptors, with the first one outermost
+func chain(is []Interceptor, invoker Invoker) Invoker {
+	for i := len(is) - 1; i >= 0; i-- {
+		interceptor, next := is[i], invoker
+		invoker = func(ctx context.Context, req *Request) (*Response, errors.Error) {
+			return interceptor(ctx, req, next)
+		}
+	}
+	return invoker
+}
+
+// interceptors returns the chain of interceptors for a request: the defaults, those registered and those for the call
+func (c *client) interceptors(o *callOptions) []Interceptor {
+	interceptorsMu.RLock()
+	defer interceptorsMu.RUnlock()
+
+	is := make([]Interceptor, 0, 3+len(interceptors)+len(o.interceptors))
+	is = append(is, c.tracingInterceptor, instrumentedInterceptor, circuitBreakerInterceptor)
+	is = append(is, interceptors...)
+	return append(is, o.interceptors...)
+}
+
+// tracingInterceptor sends trace events for the request and its response
+func (c *client) tracingInterceptor(ctx context.Context, req *Request, next Invoker) (*Response, errors.Error) {
+	c.traceReq(req)
+	t := time.Now()
+	rsp, err := next(ctx, req)
+	c.traceRsp(req, rsp, err, time.Since(t))
+	return rsp, err
+}
+
+// instrumentedInterceptor times every request, and counts errors by code. Requests the client answered itself, from
+// the cache or by waiting on an identical request, aren't timed, as they say nothing about the service
+func instrumentedInterceptor(ctx context.Context, req *Request, next Invoker) (*Response, errors.Error) {
+	t := time.Now()
+	rsp, err := next(ctx, req)
+	if req.answered {
+		return rsp, err
+	}
+	if err != nil {
+		inst.Timing(1.0, fmt.Sprintf("client.%s.%s.error", req.service, req.endpoint), time.Since(t))
+		inst.Counter(1.0, fmt.Sprintf("client.error.%s", err.Code()), 1)
+	} else {
+		inst.Timing(1.0, fmt.Sprintf("client.%s.%s.success", req.service, req.endpoint), time.Since(t))
+	}
+	return rsp, err
+}
+
+// circuitBreakerInterceptor fails fast while the circuit for the endpoint is open. How each attempt at the request
+// went is reported to the circuit as it happens, by circuitResult, so a request that times out and is retried counts
+// once for every attempt, and requests the client answered itself don't count at all
+func circuitBreakerInterceptor(ctx context.Context, req *Request, next Invoker) (*Response, errors.Error) {
+	if circuitbreaker.Open(req.service, req.endpoint) {
+		inst.Counter(1.0, fmt.Sprintf("client.error.%s.%s.circuitbroken", req.service, req.endpoint), 1)
+		log.Warnf("Broken Circuit for %s.%s", req.service, req.endpoint)
+		return nil, errors.CircuitBroken("com.HailoOSS.kernel.platform.circuitbreaker", "Circuit is open")
+	}
+	return next(ctx, req)
+}
+
+// circuitResult tells the circuit for the endpoint how an attempt at a request went, given the error reply or
+// timeout it ended with, if any. Only internal server errors and timeouts count against the circuit
+func circuitResult(req *Request, err errors.Error) {
+	if err != nil && (err.Type() == errors.ErrorInternalServer || err.Code() == "com.HailoOSS.kernel.platform.timeout") {
+		circuitbreaker.Result(req.service, req.endpoint, err)
+		return
+	}
+	// consider everything not an internal server error a success
+	circuitbreaker.Result(req.service, req.endpoint, nil)
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/HailoOSS/platform/circuitbreaker"
+	"github.com/HailoOSS/platform/errors"
+	"github.com/HailoOSS/platform/raven"
+	"github.com/HailoOSS/service/config"
+)
+
+func TestInterceptorChain(t *testing.T) {
+	defer func() { interceptors = nil }()
+
+	var order []string
+	record := func(name string) Interceptor {
+		return func(ctx context.Context, req *Request, next Invoker) (*Response, errors.Error) {
+			order = append(order, name)
+			req.SetSessionID(req.SessionID() + name)
+			return next(ctx, req)
+		}
+	}
+	RegisterInterceptor(record("a"), record("b"))
+
+	// a fault injected at the end of the chain means the request is never sent
+	fault := func(ctx context.Context, req *Request, next Invoker) (*Response, errors.Error) {
+		order = append(order, "fault")
+		return nil, errors.NotFound("com.HailoOSS.service.foo.fault", "Injected fault")
+	}
+
+	c := newClient().(*client)
+	req, _ := NewJsonRequest("com.HailoOSS.service.foo", "bar", []byte(`{}`))
+	_, err := c.CustomReq(req, WithInterceptors(record("c"), fault))
+	if err == nil || err.Code() != "com.HailoOSS.service.foo.fault" {
+		t.Fatalf("Expected the injected fault, got %v", err)
+	}
+	if len(order) != 4 || order[0] != "a" || order[1] != "b" || order[2] != "c" || order[3] != "fault" {
+		t.Errorf("Expected registered interceptors, then those for the call, got %v", order)
+	}
+	if req.SessionID() != "abc" {
+		t.Errorf("Expected interceptors to be able to change the request, got session %q", req.SessionID())
+	}
+}
+
+func TestChain(t *testing.T) {
+	invoker := func(ctx context.Context, req *Request) (*Response, errors.Error) {
+		return newResponseFromDelivery(amqp.Delivery{MessageId: req.Endpoint()}), nil
+	}
+	rename := func(ctx context.Context, req *Request, next Invoker) (*Response, errors.Error) {
+		req.endpoint = "renamed"
+		return next(ctx, req)
+	}
+
+	req, _ := NewJsonRequest("com.HailoOSS.service.foo", "bar", []byte(`{}`))
+	if rsp, _ := chain(nil, invoker)(context.Background(), req); rsp.MessageID() != "bar" {
+		t.Errorf("Expected an empty chain to just invoke, got %s", rsp.MessageID())
+	}
+	if rsp, _ := chain([]Interceptor{rename}, invoker)(context.Background(), req); rsp.MessageID() != "renamed" {
+		t.Errorf("Expected the interceptor to run before invoking, got %s", rsp.MessageID())
+	}
+}
+
+func TestCircuitBreakerCountsAttempts(t *testing.T) {
+	config.Load(bytes.NewBufferString(`{"hailo":{"platform":{"circuitbreaker":{"minSamples":5}}}}`))
+	defer config.Load(bytes.NewBufferString(`{}`))
+
+	tr := raven.NewMemoryTransport(raven.NewMemoryBroker())
+	tr.Connect()
+	for _, service := range []string{"com.HailoOSS.service.patient", "com.HailoOSS.service.slow"} {
+		deliveries, err := tr.Consume("server-" + service)
+		if err != nil {
+			t.Fatalf("Unexpected error consuming: %v", err)
+		}
+		if err := tr.BindService(service, "server-"+service); err != nil {
+			t.Fatalf("Unexpected error binding: %v", err)
+		}
+		// never answer
+		go func() {
+			for range deliveries {
+			}
+		}()
+	}
+	c := NewTransportClient(tr)
+
+	// the caller's deadline cutting attempts short says nothing about the service
+	for i := 0; i < 10; i++ {
+		req, _ := NewJsonRequest("com.HailoOSS.service.patient", "bar", []byte(`{}`))
+		c.CustomReq(req, WithRetries(0), WithTimeout(5*time.Millisecond), WithAttemptTimeout(time.Second))
+	}
+	if circuitbreaker.Open("com.HailoOSS.service.patient", "bar") {
+		t.Error("Expected the circuit to stay closed when the caller ran out of time")
+	}
+
+	// every attempt that times out counts, not just the call
+	req, _ := NewJsonRequest("com.HailoOSS.service.slow", "bar", []byte(`{}`))
+	if _, err := c.CustomReq(req, WithRetries(4), WithAttemptTimeout(5*time.Millisecond)); !errors.IsTimeout(err) {
+		t.Fatalf("Expected a timeout, got %v", err)
+	}
+	if !circuitbreaker.Open("com.HailoOSS.service.slow", "bar") {
+		t.Error("Expected the circuit to open when every attempt times out")
+	}
+}
@@ -0,0 +1,40 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/HailoOSS/platform/errors"
+	"github.com/HailoOSS/service/config"
+	inst "github.com/HailoOSS/service/instrumentation"
+)
+
+const (
+	// defaultMaxRequestSize is the biggest request payload we send, in bytes, unless configured otherwise. The broker
+	// drops our connection if we send something bigger than it allows, so this should stay under its limit
+	defaultMaxRequestSize = 16 * 1024 * 1024
+	// nearLimitPercent is how full a payload can get before we count it as close to the limit
+	nearLimitPercent = 80
+)
+
+// maxRequestSize is the biggest request payload we send, set via hailo.platform.client.maxRequestSize
+func maxRequestSize() int {
+	return config.AtPath("hailo", "platform", "client", "maxRequestSize").AsInt(defaultMaxRequestSize)
+}
+
+// checkRequestSize makes sure a request isn't too big to send, before we publish it
+func checkRequestSize(req *Request) errors.Error {
+	size, limit := len(req.Payload()), maxRequestSize()
+	if size > limit {
+		inst.Counter(1.0, "client.error.com.HailoOSS.kernel.platform.requesttoolarge", 1)
+		return errors.BadRequest("com.HailoOSS.kernel.platform.requesttoolarge",
+			fmt.Sprintf("Request to %s.%s is %d bytes, over the limit of %d", req.Service(), req.Endpoint(), size,
+				limit),
+			req.Service(),
+			req.Endpoint())
+	}
+	if size*100 >= limit*nearLimitPercent {
+		inst.Counter(1.0, fmt.Sprintf("client.%s.%s.nearsizelimit", req.Service(), req.Endpoint()), 1)
+	}
+
+	return nil
+}
@@ -0,0 +1,31 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/HailoOSS/platform/errors"
+	"github.com/HailoOSS/service/config"
+)
+
+func TestCheckRequestSize(t *testing.T) {
+	config.Load(bytes.NewBufferString(`{"hailo":{"platform":{"client":{"maxRequestSize":10}}}}`))
+	defer config.Load(bytes.NewBufferString(`{}`))
+
+	req, _ := NewJsonRequest("com.HailoOSS.service.foo", "bar", []byte(`{}`))
+	if err := checkRequestSize(req); err != nil {
+		t.Errorf("Unexpected error for a small request: %v", err)
+	}
+
+	req, _ = NewJsonRequest("com.HailoOSS.service.foo", "bar", []byte(`{"foo":"bar"}`))
+	err := checkRequestSize(req)
+	if err == nil {
+		t.Fatalf("Expected an error for an oversized request")
+	}
+	if err.Code() != "com.HailoOSS.kernel.platform.requesttoolarge" || err.Type() != errors.ErrorBadRequest {
+		t.Errorf("Wrong error for an oversized request: %s %s", err.Type(), err.Code())
+	}
+	if err := DefaultClient.Push(req); err == nil {
+		t.Errorf("Expected Push to refuse an oversized request")
+	}
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
 	"sync"
 
@@ -62,7 +63,7 @@ func (m *MockClient) getMatchingRequestExpectation(req *Request) *proto.Message
 	return nil
 }
 
-func (m *MockClient) Req(req *Request, rsp proto.Message, options ...Options) hailo_errors.Error {
+func (m *MockClient) Req(req *Request, rsp proto.Message, options ...CallOption) hailo_errors.Error {
 	if matchedRsp := m.getMatchingRequestExpectation(req); matchedRsp != nil {
 		// Marshall to JSON and back again, to get it into rsp (which is passed by value). This is fine; these are
 		// marshalled and unmarshalled to JSON during normal operation anyway.
@@ -83,7 +84,7 @@ func (m *MockClient) Req(req *Request, rsp proto.Message, options ...Options) ha
 	}
 }
 
-func (m *MockClient) CustomReq(req *Request, options ...Options) (*Response, hailo_errors.Error) {
+func (m *MockClient) CustomReq(req *Request, options ...CallOption) (*Response, hailo_errors.Error) {
 	if matchedRsp := m.getMatchingRequestExpectation(req); matchedRsp != nil {
 		marshalledJson, err := json.Marshal(*matchedRsp)
 		if err != nil {
@@ -104,6 +105,34 @@ func (m *MockClient) CustomReq(req *Request, options ...Options) (*Response, hai
 	}
 }
 
+func (m *MockClient) ReqContext(ctx context.Context, req *Request, rsp proto.Message,
+	options ...CallOption) hailo_errors.Error {
+	return m.Req(req, rsp, options...)
+}
+
+func (m *MockClient) CustomReqContext(ctx context.Context, req *Request, options ...CallOption) (*Response,
+	hailo_errors.Error) {
+	return m.CustomReq(req, options...)
+}
+
+func (m *MockClient) Go(req *Request, rsp proto.Message, options ...CallOption) *Call {
+	return goCall(req, rsp, func() hailo_errors.Error {
+		return m.Req(req, rsp, options...)
+	})
+}
+
+func (m *MockClient) GoContext(ctx context.Context, req *Request, rsp proto.Message, options ...CallOption) *Call {
+	return m.Go(req, rsp, options...)
+}
+
+func (m *MockClient) Stream(ctx context.Context, req *Request, options ...CallOption) (*ResponseStream,
+	hailo_errors.Error) {
+	returnArgs := m.Mock.Called(ctx, req)
+	stream, _ := returnArgs.Get(0).(*ResponseStream)
+	err, _ := returnArgs.Get(1).(hailo_errors.Error)
+	return stream, err
+}
+
 func (m *MockClient) Push(req *Request) error {
 	returnArgs := m.Mock.Called(req)
 	return returnArgs.Error(0)
@@ -0,0 +1,148 @@
+package client
+
+import (
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// CallOption configures how a request is made. Options can be combined, with later ones taking precedence. The
+// original map form, Options, is also a CallOption so existing callers keep working
+type CallOption interface {
+	apply(*callOptions)
+}
+
+// Backoff says how long to wait before an attempt, where attempt 2 is the first retry
+type Backoff func(attempt int) time.Duration
+
+// callOptions are the settings for a single call, built up from the client defaults and any CallOptions
+type callOptions struct {
+	// retries is how many times we retry after the first attempt
+	retries int
+	// timeout bounds the whole call, across all attempts
+	timeout time.Duration
+	// attemptTimeout bounds each attempt; if zero we use the timeout learned for the endpoint
+	attemptTimeout time.Duration
+	backoff        Backoff
+	retryPolicy    RetryPolicy
+	// hedge is how long we wait for a reply before sending another copy of the request, if set
+	hedge time.Duration
+	// priority is the broker priority of the request, 0-9, or -1 to leave it as it is
+	priority   int
+	idempotent bool
+	// coalesce shares one call between concurrent identical requests
+	coalesce     bool
+	interceptors []Interceptor
+	// streamWindow is how many replies to a stream request we have room for before the server waits for us
+	streamWindow int
+}
+
+type callOptionFunc func(*callOptions)
+
+func (f callOptionFunc) apply(o *callOptions) {
+	f(o)
+}
+
+// WithRetries sets how many times we retry after the first attempt
+func WithRetries(n int) CallOption {
+	return callOptionFunc(func(o *callOptions) {
+		o.retries = n
+	})
+}
+
+// WithTimeout bounds the whole call, including any retries
+func WithTimeout(d time.Duration) CallOption {
+	return callOptionFunc(func(o *callOptions) {
+		o.timeout = d
+	})
+}
+
+// WithAttemptTimeout bounds each attempt, rather than using the timeout learned for the endpoint
+func WithAttemptTimeout(d time.Duration) CallOption {
+	return callOptionFunc(func(o *callOptions) {
+		o.attemptTimeout = d
+	})
+}
+
+// WithBackoff waits between attempts, rather than for as long as the retry policy says
+func WithBackoff(b Backoff) CallOption {
+	return callOptionFunc(func(o *callOptions) {
+		o.backoff = b
+	})
+}
+
+// ConstantBackoff waits the same time before every retry
+func ConstantBackoff(d time.Duration) Backoff {
+	return func(attempt int) time.Duration {
+		return d
+	}
+}
+
+// WithHedging sends another copy of the request if there's no reply after delay, taking whichever reply comes first.
+// Only idempotent requests are hedged
+func WithHedging(delay time.Duration) CallOption {
+	return callOptionFunc(func(o *callOptions) {
+		o.hedge = delay
+	})
+}
+
+// WithPriority sets the broker priority of the request, from 0 (the default) to 9
+func WithPriority(p uint8) CallOption {
+	return callOptionFunc(func(o *callOptions) {
+		if p > 9 {
+			p = 9
+		}
+		o.priority = int(p)
+	})
+}
+
+// WithIdempotent says whether the request is safe to send more than once. Requests are assumed to be idempotent; those
+// that aren't are never retried or hedged, since the service may already have acted on them
+func WithIdempotent(idempotent bool) CallOption {
+	return callOptionFunc(func(o *callOptions) {
+		o.idempotent = idempotent
+	})
+}
+
+// WithStreamWindow sets how many replies to a stream request we buffer, and so how far the server can get ahead of us
+func WithStreamWindow(n int) CallOption {
+	return callOptionFunc(func(o *callOptions) {
+		o.streamWindow = n
+	})
+}
+
+// apply lets the map form be used as a CallOption. "retries" (an int) and "timeout" (a time.Duration, per attempt) are
+// understood; anything else, or a value of the wrong type, is logged and ignored
+func (opts Options) apply(o *callOptions) {
+	for k, v := range opts {
+		switch k {
+		case "retries":
+			if n, ok := v.(int); ok {
+				o.retries = n
+				continue
+			}
+		case "timeout":
+			if d, ok := v.(time.Duration); ok {
+				o.attemptTimeout = d
+				continue
+			}
+		}
+		log.Warnf("[Client] Ignoring unknown or mistyped option %s=%v (%T)", k, v, v)
+	}
+}
+
+// callOptions builds up the settings for a call from the client defaults and the options given
+func (c *client) callOptions(options []CallOption) *callOptions {
+	o := &callOptions{
+		priority:   -1,
+		idempotent: true,
+	}
+	c.defaults.apply(o)
+	for _, opt := range options {
+		if opt != nil {
+			opt.apply(o)
+		}
+	}
+
+	return o
+}
@@ -0,0 +1,118 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/HailoOSS/platform/raven"
+	"github.com/HailoOSS/service/config"
+)
+
+func TestCallOptionsCompose(t *testing.T) {
+	c := newClient().(*client)
+
+	o := c.callOptions(nil)
+	if o.retries != 2 || !o.idempotent || o.priority != -1 {
+		t.Errorf("Unexpected defaults: %+v", o)
+	}
+
+	o = c.callOptions([]CallOption{
+		Options{"retries": 5, "timeout": time.Second},
+		WithRetries(1),
+		WithPriority(12),
+		WithIdempotent(false),
+	})
+	if o.retries != 1 {
+		t.Errorf("Expected later options to win, got %d retries", o.retries)
+	}
+	if o.attemptTimeout != time.Second {
+		t.Errorf("Expected map timeout to set the attempt timeout, got %v", o.attemptTimeout)
+	}
+	if o.priority != 9 {
+		t.Errorf("Expected priority to be capped at 9, got %d", o.priority)
+	}
+	if o.idempotent {
+		t.Errorf("Expected request to be marked as not idempotent")
+	}
+}
+
+func TestMapOptionsWrongType(t *testing.T) {
+	c := newClient().(*client)
+
+	o := c.callOptions([]CallOption{Options{"retries": "lots", "timeout": 5}})
+	if o.retries != 2 || o.attemptTimeout != 0 {
+		t.Errorf("Expected mistyped options to be ignored, got %+v", o)
+	}
+}
+
+func TestReqHedging(t *testing.T) {
+	tr := raven.NewMemoryTransport(raven.NewMemoryBroker())
+	tr.Connect()
+
+	deliveries, err := tr.Consume("server-com.HailoOSS.service.flaky")
+	if err != nil {
+		t.Fatalf("Unexpected error consuming: %v", err)
+	}
+	if err := tr.BindService("com.HailoOSS.service.flaky", "server-com.HailoOSS.service.flaky"); err != nil {
+		t.Fatalf("Unexpected error binding: %v", err)
+	}
+
+	// lose every other delivery, so the first copy of each request goes unanswered
+	go func() {
+		n := 0
+		for d := range deliveries {
+			if n++; n%2 == 1 {
+				continue
+			}
+			tr.SendResponse(&testResponse{
+				replyTo:   d.ReplyTo,
+				messageID: d.MessageId,
+				payload:   d.Body,
+			}, "server-com.HailoOSS.service.flaky")
+		}
+	}()
+
+	c := NewTransportClient(tr)
+	req, _ := NewJsonRequest("com.HailoOSS.service.flaky", "foo", []byte(`{}`))
+	start := time.Now()
+	_, cerr := c.CustomReq(req, WithRetries(0), WithAttemptTimeout(time.Second), WithHedging(20*time.Millisecond))
+	if cerr != nil {
+		t.Fatalf("Expected the hedged request to succeed, got %v", cerr)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("Expected the hedged copy to be answered quickly, took %v", time.Since(start))
+	}
+
+	req, _ = NewJsonRequest("com.HailoOSS.service.flaky", "foo", []byte(`{}`))
+	_, cerr = c.CustomReq(req, WithRetries(0), WithAttemptTimeout(100*time.Millisecond), WithHedging(20*time.Millisecond),
+		WithIdempotent(false))
+	if cerr == nil {
+		t.Errorf("Expected a request that isn't idempotent not to be hedged")
+	}
+}
+
+func TestHedgeDelay(t *testing.T) {
+	defer config.Load(bytes.NewBufferString(`{}`))
+	c := newClient().(*client)
+
+	if d := c.hedgeDelay("com.HailoOSS.service.foo", "read"); d != 0 {
+		t.Errorf("Expected endpoints not to be hedged by default, got %v", d)
+	}
+
+	config.Load(bytes.NewBufferString(`{"hailo":{"platform":{"client":{"hedging":{"endpoints":{` +
+		`"com.HailoOSS.service.foo":{"read":{"enabled":true},"list":{"enabled":true,"delayMs":15}}}}}}}}`))
+	if d := c.hedgeDelay("com.HailoOSS.service.foo", "read"); d != 0 {
+		t.Errorf("Expected not to hedge without an SLA, got %v", d)
+	}
+	if d := c.hedgeDelay("com.HailoOSS.service.foo", "list"); d != 15*time.Millisecond {
+		t.Errorf("Expected the configured hedge delay, got %v", d)
+	}
+
+	c.timeout.Lock()
+	c.timeout.endpoints["com.HailoOSS.service.foo"] = map[string]time.Duration{"read": 40 * time.Millisecond}
+	c.timeout.Unlock()
+	if d := c.hedgeDelay("com.HailoOSS.service.foo", "read"); d != 40*time.Millisecond {
+		t.Errorf("Expected to hedge after the Upper95 SLA, got %v", d)
+	}
+}
@@ -0,0 +1,391 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/HailoOSS/platform/errors"
+	"github.com/HailoOSS/service/config"
+	inst "github.com/HailoOSS/service/instrumentation"
+)
+
+// OutlierTopic is the topic we publish an OutlierReport on whenever an instance is ejected or restored
+const OutlierTopic = "com.HailoOSS.kernel.client.outlier"
+
+// OutlierOptions configure outlier detection, under hailo.platform.client.outlierDetection, overridden for a service
+// under hailo.platform.client.outlierDetection.services.<service>
+type OutlierOptions struct {
+	Disabled bool `json:"disabled,omitempty"`
+	// IntervalMs is how often we look for outliers, based on the replies since we last looked
+	IntervalMs int64 `json:"intervalMs,omitempty"`
+	// MinRequests is how many replies we need from an instance in an interval before we judge it
+	MinRequests uint64 `json:"minRequests,omitempty"`
+	// MaxErrorRate is the fraction of internal server errors and timeouts beyond which an instance is ejected
+	MaxErrorRate float64 `json:"maxErrorRate,omitempty"`
+	// LatencyMultiplier ejects an instance whose mean latency is this many times the median of the others
+	LatencyMultiplier float64 `json:"latencyMultiplier,omitempty"`
+	// EjectionMs is how long an instance stays ejected
+	EjectionMs int64 `json:"ejectionMs,omitempty"`
+	// MaxEjectionPercent caps how many of a service's instances can be ejected at once
+	MaxEjectionPercent int `json:"maxEjectionPercent,omitempty"`
+	// DirectRouting sends requests straight to healthy instances while any are ejected, rather than to whichever
+	// instance picks them up
+	DirectRouting bool `json:"directRouting,omitempty"`
+}
+
+// OutlierReport describes how an instance of a service has been doing, over the last interval
+type OutlierReport struct {
+	Service      string        `json:"service"`
+	Instance     string        `json:"instance"`
+	Requests     uint64        `json:"requests"`
+	Errors       uint64        `json:"errors"`
+	MeanLatency  time.Duration `json:"meanLatency"`
+	Ejected      bool          `json:"ejected"`
+	EjectedUntil time.Time     `json:"ejectedUntil,omitempty"`
+	Reason       string        `json:"reason,omitempty"`
+}
+
+var (
+	defaultOutlierOptions = OutlierOptions{
+		IntervalMs:         10000,
+		MinRequests:        10,
+		MaxErrorRate:       0.5,
+		LatencyMultiplier:  3,
+		EjectionMs:         30000,
+		MaxEjectionPercent: 50,
+	}
+
+	outliers   = make(map[string]*serviceOutliers) // Maps service to serviceOutliers
+	outliersMu sync.RWMutex
+)
+
+func init() {
+	onConfigChange(loadOutlierOptions)
+}
+
+// instanceStats are what we know about an instance of a service
+type instanceStats struct {
+	requests, errors uint64
+	latency          time.Duration // total, over the current interval
+	lastSeen         time.Time
+	ejectedUntil     time.Time
+	reason           string
+	last             OutlierReport // the last interval
+}
+
+func (s *instanceStats) errorRate() float64 {
+	if s.requests == 0 {
+		return 0
+	}
+	return float64(s.errors) / float64(s.requests)
+}
+
+func (s *instanceStats) meanLatency() time.Duration {
+	if s.requests == 0 {
+		return 0
+	}
+	return s.latency / time.Duration(s.requests)
+}
+
+// serviceOutliers tracks the instances of a service, ejecting those doing much worse than the rest
+type serviceOutliers struct {
+	sync.Mutex
+	service       string
+	opts          OutlierOptions
+	instances     map[string]*instanceStats
+	lastEvaluated time.Time
+}
+
+func newServiceOutliers(service string) *serviceOutliers {
+	so := &serviceOutliers{
+		service:       service,
+		instances:     make(map[string]*instanceStats),
+		lastEvaluated: time.Now(),
+	}
+	so.configure()
+	return so
+}
+
+// configure loads the options for the service from config - must be called with the lock held, or before it is shared
+func (so *serviceOutliers) configure() {
+	opts := defaultOutlierOptions
+	config.AtPath("hailo", "platform", "client", "outlierDetection").AsStruct(&opts)
+	config.AtPath("hailo", "platform", "client", "outlierDetection", "services", so.service).AsStruct(&opts)
+	so.opts = opts
+}
+
+func (so *serviceOutliers) interval() time.Duration {
+	return time.Duration(so.opts.IntervalMs) * time.Millisecond
+}
+
+// record notes how a request to an instance went, returning reports for any instances ejected or restored as a result
+func (so *serviceOutliers) record(instance string, d time.Duration, failed bool, now time.Time) []OutlierReport {
+	so.Lock()
+	defer so.Unlock()
+
+	if so.opts.Disabled || instance == "" {
+		return nil
+	}
+
+	s, ok := so.instances[instance]
+	if !ok {
+		s = &instanceStats{}
+		so.instances[instance] = s
+	}
+	s.requests++
+	s.latency += d
+	s.lastSeen = now
+	if failed {
+		s.errors++
+	}
+
+	if now.Sub(so.lastEvaluated) < so.interval() {
+		return nil
+	}
+	return so.evaluate(now)
+}
+
+// evaluate looks for outliers over the last interval, ejecting them and restoring any instances that have served
+// their time - must be called with the lock held
+func (so *serviceOutliers) evaluate(now time.Time) []OutlierReport {
+	so.lastEvaluated = now
+	var changed []OutlierReport
+
+	// restore instances that have been ejected for long enough, and forget those we've not heard from in a while
+	ejected := 0
+	for id, s := range so.instances {
+		if !s.ejectedUntil.IsZero() && now.After(s.ejectedUntil) {
+			s.ejectedUntil, s.reason = time.Time{}, ""
+			changed = append(changed, so.report(id, s, now))
+			log.Infof("[Client] Restoring instance %s of %s", id, so.service)
+		}
+		if s.ejectedUntil.IsZero() && now.Sub(s.lastSeen) > 3*so.interval() {
+			delete(so.instances, id)
+			continue
+		}
+		if !s.ejectedUntil.IsZero() {
+			ejected++
+		}
+	}
+
+	// judge each instance we've heard enough from against the others
+	var candidates []string
+	for id, s := range so.instances {
+		if s.requests < so.opts.MinRequests || !s.ejectedUntil.IsZero() {
+			continue
+		}
+		if s.errorRate() > so.opts.MaxErrorRate {
+			s.reason = fmt.Sprintf("error rate %.2f over %.2f", s.errorRate(), so.opts.MaxErrorRate)
+			candidates = append(candidates, id)
+			continue
+		}
+		if median := so.medianLatency(id); median > 0 && so.opts.LatencyMultiplier > 0 &&
+			float64(s.meanLatency()) > so.opts.LatencyMultiplier*float64(median) {
+			s.reason = fmt.Sprintf("mean latency %v over %.1f times the median %v", s.meanLatency(),
+				so.opts.LatencyMultiplier, median)
+			candidates = append(candidates, id)
+		}
+	}
+
+	// eject the worst first, without ejecting so many that the rest are overwhelmed
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := so.instances[candidates[i]], so.instances[candidates[j]]
+		if a.errorRate() != b.errorRate() {
+			return a.errorRate() > b.errorRate()
+		}
+		return a.meanLatency() > b.meanLatency()
+	})
+	maxEjected := len(so.instances) * so.opts.MaxEjectionPercent / 100
+	for _, id := range candidates {
+		s := so.instances[id]
+		if ejected >= maxEjected {
+			log.Warnf("[Client] Not ejecting instance %s of %s (%s), too many already ejected", id, so.service, s.reason)
+			s.reason = ""
+			continue
+		}
+		ejected++
+		s.ejectedUntil = now.Add(time.Duration(so.opts.EjectionMs) * time.Millisecond)
+		changed = append(changed, so.report(id, s, now))
+		log.Warnf("[Client] Ejecting instance %s of %s until %v: %s", id, so.service, s.ejectedUntil, s.reason)
+		inst.Counter(1.0, fmt.Sprintf("client.outliers.%s.ejections", so.service), 1)
+	}
+	inst.Gauge(1.0, fmt.Sprintf("client.outliers.%s.ejected", so.service), ejected)
+
+	// start the next interval afresh
+	for id, s := range so.instances {
+		s.last = so.report(id, s, now)
+		s.requests, s.errors, s.latency = 0, 0, 0
+	}
+
+	return changed
+}
+
+// medianLatency returns the median of the mean latencies of the instances other than this one, that we've heard
+// enough from - must be called with the lock held
+func (so *serviceOutliers) medianLatency(instance string) time.Duration {
+	var latencies []time.Duration
+	for id, s := range so.instances {
+		if id != instance && s.requests >= so.opts.MinRequests {
+			latencies = append(latencies, s.meanLatency())
+		}
+	}
+	if len(latencies) == 0 {
+		return 0
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies[len(latencies)/2]
+}
+
+// report describes an instance - must be called with the lock held
+func (so *serviceOutliers) report(instance string, s *instanceStats, now time.Time) OutlierReport {
+	return OutlierReport{
+		Service:      so.service,
+		Instance:     instance,
+		Requests:     s.requests,
+		Errors:       s.errors,
+		MeanLatency:  s.meanLatency(),
+		Ejected:      now.Before(s.ejectedUntil),
+		EjectedUntil: s.ejectedUntil,
+		Reason:       s.reason,
+	}
+}
+
+// healthyInstance picks an instance to send a request straight to while others are ejected, or returns an empty
+// string if the request should go to whichever instance picks it up
+func (so *serviceOutliers) healthyInstance(now time.Time) string {
+	so.Lock()
+	defer so.Unlock()
+
+	if so.opts.Disabled || !so.opts.DirectRouting {
+		return ""
+	}
+
+	var healthy []string
+	anyEjected := false
+	for id, s := range so.instances {
+		if now.Before(s.ejectedUntil) {
+			anyEjected = true
+			continue
+		}
+		// only instances we've heard from lately, so we don't send requests to one that's gone away
+		if now.Sub(s.lastSeen) <= so.interval() {
+			healthy = append(healthy, id)
+		}
+	}
+	if !anyEjected || len(healthy) == 0 {
+		return ""
+	}
+
+	return healthy[rand.Intn(len(healthy))]
+}
+
+// outliersFor returns the outlier detection for a service
+func outliersFor(service string) *serviceOutliers {
+	outliersMu.RLock()
+	so, ok := outliers[service]
+	outliersMu.RUnlock()
+	if ok {
+		return so
+	}
+
+	outliersMu.Lock()
+	defer outliersMu.Unlock()
+	// Double check no one else has created it
+	if so, ok = outliers[service]; !ok {
+		so = newServiceOutliers(service)
+		outliers[service] = so
+	}
+
+	return so
+}
+
+func loadOutlierOptions() {
+	outliersMu.RLock()
+	defer outliersMu.RUnlock()
+
+	for _, so := range outliers {
+		so.Lock()
+		so.configure()
+		so.Unlock()
+	}
+}
+
+// recordOutlier notes how a request to an instance went, publishing a report for any instances ejected or restored
+func (c *client) recordOutlier(req *Request, instance string, d time.Duration, err errors.Error) {
+	failed := err != nil && (err.Type() == errors.ErrorInternalServer || err.Type() == errors.ErrorTimeout)
+	reports := outliersFor(req.service).record(instance, d, failed, time.Now())
+	if len(reports) > 0 {
+		go c.publishOutliers(reports)
+	}
+}
+
+// recordLateReply notes how slow the instance that sent a late reply was. Unless we sent the request straight to it,
+// this is the first we know of which instance had it, so it's how instances that time out are caught without direct
+// routing. A reply that lost to another copy of the request was just slow, while one we gave up on counts as a timeout.
+// We still know nothing of an instance that never replies at all, unless we send requests straight to it
+func (c *client) recordLateReply(u unanswered, instance string) {
+	if u.direct {
+		// we blamed it when we gave up
+		return
+	}
+
+	reports := outliersFor(u.service).record(instance, time.Since(u.sent), !u.lost, time.Now())
+	if len(reports) > 0 {
+		go c.publishOutliers(reports)
+	}
+}
+
+func (c *client) publishOutliers(reports []OutlierReport) {
+	for _, r := range reports {
+		b, err := json.Marshal(r)
+		if err != nil {
+			log.Warnf("[Client] Failed to marshal outlier report: %v", err)
+			continue
+		}
+		pub, err := NewJsonPublication(OutlierTopic, b)
+		if err != nil {
+			log.Warnf("[Client] Failed to build outlier report: %v", err)
+			continue
+		}
+		if err := c.AsyncTopic(pub); err != nil {
+			log.Warnf("[Client] Failed to publish outlier report: %v", err)
+		}
+	}
+}
+
+// OutlierReports returns how each instance we have had replies from recently has been doing, ordered by service and
+// instance
+func OutlierReports() []OutlierReport {
+	outliersMu.RLock()
+	defer outliersMu.RUnlock()
+
+	now := time.Now()
+	var reports []OutlierReport
+	for _, so := range outliers {
+		so.Lock()
+		for id, s := range so.instances {
+			r := s.last
+			if r.Service == "" {
+				// nothing to show from a full interval yet
+				r = so.report(id, s, now)
+			}
+			r.Ejected, r.EjectedUntil, r.Reason = now.Before(s.ejectedUntil), s.ejectedUntil, s.reason
+			reports = append(reports, r)
+		}
+		so.Unlock()
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].Service != reports[j].Service {
+			return reports[i].Service < reports[j].Service
+		}
+		return reports[i].Instance < reports[j].Instance
+	})
+
+	return reports
+}
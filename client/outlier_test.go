@@ -0,0 +1,166 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/HailoOSS/platform/raven"
+	"github.com/HailoOSS/service/config"
+)
+
+func TestOutlierEjection(t *testing.T) {
+	config.Load(bytes.NewBufferString(`{"hailo":{"platform":{"client":{"outlierDetection":{"services":` +
+		`{"com.HailoOSS.service.foo":{"directRouting":true,"intervalMs":1000,"ejectionMs":5000}}}}}}}`))
+	defer config.Load(bytes.NewBufferString(`{}`))
+
+	so := newServiceOutliers("com.HailoOSS.service.foo")
+	now := time.Now()
+
+	for i := 0; i < 10; i++ {
+		so.record("server-a", 10*time.Millisecond, false, now)
+		so.record("server-b", 12*time.Millisecond, false, now)
+		so.record("server-c", 11*time.Millisecond, i%3 != 0, now)
+		so.record("server-d", 100*time.Millisecond, false, now)
+	}
+	if instance := so.healthyInstance(now); instance != "" {
+		t.Errorf("Expected no direct routing while every instance is healthy, got %s", instance)
+	}
+
+	reports := so.record("server-a", 10*time.Millisecond, false, now.Add(time.Second))
+	if len(reports) != 2 {
+		t.Fatalf("Expected 2 instances to be ejected, got %+v", reports)
+	}
+	if reports[0].Instance != "server-c" || !reports[0].Ejected || reports[0].Errors != 6 {
+		t.Errorf("Expected the failing instance to be ejected first, got %+v", reports[0])
+	}
+	if reports[1].Instance != "server-d" || !reports[1].Ejected {
+		t.Errorf("Expected the slow instance to be ejected, got %+v", reports[1])
+	}
+
+	for i := 0; i < 20; i++ {
+		switch instance := so.healthyInstance(now.Add(time.Second)); instance {
+		case "server-a", "server-b":
+		default:
+			t.Fatalf("Expected requests to be routed to a healthy instance, got %q", instance)
+		}
+	}
+
+	// once they've served their time, ejected instances are restored
+	so.record("server-a", 10*time.Millisecond, false, now.Add(3*time.Second))
+	so.record("server-c", 10*time.Millisecond, false, now.Add(3*time.Second))
+	so.record("server-d", 10*time.Millisecond, false, now.Add(3*time.Second))
+	reports = so.record("server-b", 10*time.Millisecond, false, now.Add(7*time.Second))
+	if len(reports) != 2 || reports[0].Ejected || reports[1].Ejected {
+		t.Errorf("Expected both ejected instances to be restored, got %+v", reports)
+	}
+}
+
+func TestOutlierEjectionCapped(t *testing.T) {
+	so := newServiceOutliers("com.HailoOSS.service.bar")
+	now := time.Now()
+
+	for i := 0; i < 10; i++ {
+		so.record("server-a", time.Millisecond, true, now)
+		so.record("server-b", time.Millisecond, true, now)
+	}
+	reports := so.record("server-a", time.Millisecond, true, now.Add(10*time.Second))
+	if len(reports) != 1 {
+		t.Errorf("Expected no more than half the instances to be ejected, got %+v", reports)
+	}
+}
+
+func TestSendRequestDirect(t *testing.T) {
+	tr := raven.NewMemoryTransport(raven.NewMemoryBroker())
+	tr.Connect()
+
+	var deliveries [2]<-chan amqp.Delivery
+	for i, queue := range []string{"server-com.HailoOSS.service.baz-a", "server-com.HailoOSS.service.baz-b"} {
+		ch, err := tr.Consume(queue)
+		if err != nil {
+			t.Fatalf("Unexpected error consuming: %v", err)
+		}
+		if err := tr.BindService("com.HailoOSS.service.baz", queue); err != nil {
+			t.Fatalf("Unexpected error binding: %v", err)
+		}
+		deliveries[i] = ch
+	}
+
+	c := NewTransportClient(tr).(*client)
+	req, _ := NewJsonRequest("com.HailoOSS.service.baz", "foo", []byte(`{}`))
+	req.instance = "server-com.HailoOSS.service.baz-b"
+	if err := c.send(req); err != nil {
+		t.Fatalf("Unexpected error sending: %v", err)
+	}
+
+	select {
+	case <-deliveries[1]:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the request to go straight to the instance")
+	}
+	select {
+	case <-deliveries[0]:
+		t.Errorf("Expected no other instance to get the request")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestSendRequestDirectFallsBack(t *testing.T) {
+	config.Load(bytes.NewBufferString(`{"hailo":{"platform":{"raven":{"confirms":true}}}}`))
+	defer config.Load(bytes.NewBufferString(`{}`))
+
+	tr := raven.NewMemoryTransport(raven.NewMemoryBroker())
+	tr.Connect()
+	deliveries, err := tr.Consume("server-com.HailoOSS.service.baz-a")
+	if err != nil {
+		t.Fatalf("Unexpected error consuming: %v", err)
+	}
+	if err := tr.BindService("com.HailoOSS.service.baz", "server-com.HailoOSS.service.baz-a"); err != nil {
+		t.Fatalf("Unexpected error binding: %v", err)
+	}
+
+	// the instance we picked has gone away since we last heard from it
+	c := NewTransportClient(tr).(*client)
+	req, _ := NewJsonRequest("com.HailoOSS.service.baz", "foo", []byte(`{}`))
+	req.instance = "server-com.HailoOSS.service.baz-gone"
+	if err := c.send(req); err != nil {
+		t.Fatalf("Expected the request to go to another instance, got %v", err)
+	}
+	select {
+	case <-deliveries:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the request to go to the instance still there")
+	}
+	if req.instance != "" {
+		t.Errorf("Expected the request to no longer be sent straight to an instance, got %s", req.instance)
+	}
+}
+
+func TestLateRepliesBlameTheirInstance(t *testing.T) {
+	c := newClient().(*client)
+	service := "com.HailoOSS.service.late"
+
+	// we gave up on one request, and sent another straight to an instance, blaming it when we gave up
+	given := &Request{messageID: "given-up", service: service}
+	c.responses.add(given, newReplyChannel())
+	c.responses.removeByRequest(given)
+	direct := &Request{messageID: "direct", service: service, instance: "server-direct"}
+	c.responses.add(direct, newReplyChannel())
+	c.responses.route(direct)
+	c.responses.removeByRequest(direct)
+
+	c.getResponse(amqp.Delivery{CorrelationId: "given-up", ReplyTo: "server-slow"})
+	c.getResponse(amqp.Delivery{CorrelationId: "direct", ReplyTo: "server-direct"})
+
+	so := outliersFor(service)
+	so.Lock()
+	defer so.Unlock()
+	if s, ok := so.instances["server-slow"]; !ok || s.requests != 1 || s.errors != 1 {
+		t.Errorf("Expected the late reply to count as a timeout against its instance, got %+v", s)
+	}
+	if _, ok := so.instances["server-direct"]; ok {
+		t.Errorf("Expected an instance we sent straight to not to be blamed again for its late reply")
+	}
+}
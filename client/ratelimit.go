@@ -0,0 +1,308 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/HailoOSS/platform/errors"
+	"github.com/HailoOSS/service/config"
+	inst "github.com/HailoOSS/service/instrumentation"
+)
+
+// RateLimitOptions limit how fast we call a service, under hailo.platform.client.ratelimit, overridden for a service
+// under hailo.platform.client.ratelimit.services.<service>. The limit is shared by all the service's endpoints, which
+// can each have a limit of their own as well under hailo.platform.client.ratelimit.endpoints.<service>.<endpoint>, and
+// a request has to be within both. Every attempt at a request counts against the limits, retries and hedges included,
+// and those over them fail with a RATE_LIMITED error (errors.IsRateLimited)
+type RateLimitOptions struct {
+	// Rate is how many requests a second we send, with 0 meaning no limit
+	Rate float64 `json:"rate,omitempty"`
+	// Burst is how many requests we can send at once after a quiet spell
+	Burst int `json:"burst,omitempty"`
+	// Block makes requests over the limit wait until they can be sent, or their context is done, rather than being
+	// rejected straight away
+	Block bool `json:"block,omitempty"`
+}
+
+// RateLimitStats describe the rate limit on calls to an endpoint, or to a whole service if Endpoint is empty
+type RateLimitStats struct {
+	Service  string
+	Endpoint string
+	Rate     float64
+	Allowed  uint64
+	Waited   uint64
+	Rejected uint64
+}
+
+var (
+	// By default there is no limit
+	defaultRateLimitOptions = RateLimitOptions{
+		Burst: 1,
+	}
+
+	rateLimiters        = make(map[string]*rateLimiter) // Maps service.endpoint to rateLimiter
+	serviceRateLimiters = make(map[string]*rateLimiter) // Maps service to the rateLimiter its endpoints share
+	rateLimitersMu      sync.RWMutex
+)
+
+func init() {
+	onConfigChange(loadRateLimiters)
+}
+
+// rateLimiter is a token bucket, for an endpoint or shared by all the endpoints of a service. Tokens are added at the
+// configured rate, up to the burst, and each request takes one. A blocked request takes its token up front, so the
+// bucket can go negative, which keeps waiting requests in order
+type rateLimiter struct {
+	sync.Mutex
+	service, endpoint string
+	// shared is the service's limiter, which requests to an endpoint also take a token from
+	shared   *rateLimiter
+	opts     RateLimitOptions
+	tokens   float64
+	last     time.Time
+	allowed  uint64
+	waited   uint64
+	rejected uint64
+}
+
+func newRateLimiter(service, endpoint string, shared *rateLimiter) *rateLimiter {
+	l := &rateLimiter{service: service, endpoint: endpoint, shared: shared, last: time.Now()}
+	l.configure()
+	l.tokens = l.burst()
+	return l
+}
+
+// configure loads the options for the limiter from config - must be called with the lock held, or before the limiter
+// is shared
+func (l *rateLimiter) configure() {
+	opts := defaultRateLimitOptions
+	if l.endpoint == "" {
+		config.AtPath("hailo", "platform", "client", "ratelimit").AsStruct(&opts)
+		config.AtPath("hailo", "platform", "client", "ratelimit", "services", l.service).AsStruct(&opts)
+	} else {
+		config.AtPath("hailo", "platform", "client", "ratelimit", "endpoints", l.service, l.endpoint).AsStruct(&opts)
+	}
+	l.opts = opts
+	if l.tokens > l.burst() {
+		l.tokens = l.burst()
+	}
+}
+
+func (l *rateLimiter) burst() float64 {
+	if l.opts.Burst < 1 {
+		return 1
+	}
+	return float64(l.opts.Burst)
+}
+
+// refill adds the tokens earned since we last looked - must be called with the lock held
+func (l *rateLimiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.opts.Rate
+	if l.tokens > l.burst() {
+		l.tokens = l.burst()
+	}
+	l.last = now
+}
+
+// take gets a token for a request from the endpoint's limiter and the service's, waiting for them if we block and
+// there is time to before ctx is done. Requests over either limit are rejected with a RATE_LIMITED error, which is
+// never retried
+func (l *rateLimiter) take(ctx context.Context, req *Request) errors.Error {
+	waited, err := l.takeOne(ctx, req)
+	if err != nil || l.shared == nil {
+		return err
+	}
+	if _, err := l.shared.takeOne(ctx, req); err != nil {
+		l.giveBack(waited)
+		return err
+	}
+	return nil
+}
+
+// takeOne gets a token from this limiter alone, returning whether we had to wait for it
+func (l *rateLimiter) takeOne(ctx context.Context, req *Request) (bool, errors.Error) {
+	l.Lock()
+	if l.opts.Rate <= 0 {
+		l.allowed++
+		l.Unlock()
+		return false, nil
+	}
+
+	now := time.Now()
+	l.refill(now)
+	if l.tokens >= 1 {
+		l.tokens--
+		l.allowed++
+		l.Unlock()
+		return false, nil
+	}
+
+	wait := time.Duration((1 - l.tokens) / l.opts.Rate * float64(time.Second))
+	deadline, hasDeadline := ctx.Deadline()
+	if !l.opts.Block || (hasDeadline && now.Add(wait).After(deadline)) {
+		l.rejected++
+		l.Unlock()
+		inst.Counter(1.0, fmt.Sprintf("client.ratelimit.%s.rejected", l.name()), 1)
+		return false, errors.RateLimited("com.HailoOSS.kernel.platform.ratelimited",
+			fmt.Sprintf("Request to %s.%s is over the limit of %v a second for %s", req.Service(), req.Endpoint(),
+				l.opts.Rate, l.name()),
+			req.Service(),
+			req.Endpoint())
+	}
+	l.tokens--
+	l.waited++
+	l.Unlock()
+
+	inst.Timing(1.0, fmt.Sprintf("client.ratelimit.%s.wait", l.name()), wait)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true, nil
+	case <-ctx.Done():
+		// give back the token we never used
+		l.Lock()
+		l.tokens++
+		l.Unlock()
+		log.Debugf("[Client] Request %s to %s.%s cancelled waiting for the rate limit", req.MessageID(), req.Service(),
+			req.Endpoint())
+		return true, errors.Timeout("com.HailoOSS.kernel.platform.cancelled",
+			fmt.Sprintf("Request cancelled talking to %s.%s from %s", req.Service(), req.Endpoint(), req.From()),
+			req.Service(),
+			req.Endpoint())
+	}
+}
+
+// tryTake gets a token from the endpoint's limiter and the service's if there are any to be had right now, without
+// waiting or counting a rejection if not
+func (l *rateLimiter) tryTake() bool {
+	if !l.tryTakeOne() {
+		return false
+	}
+	if l.shared != nil && !l.shared.tryTakeOne() {
+		l.giveBack(false)
+		return false
+	}
+	return true
+}
+
+func (l *rateLimiter) tryTakeOne() bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.opts.Rate > 0 {
+		l.refill(time.Now())
+		if l.tokens < 1 {
+			return false
+		}
+		l.tokens--
+	}
+	l.allowed++
+	return true
+}
+
+// giveBack returns a token we took, when the request was stopped by the service's limit after all
+func (l *rateLimiter) giveBack(waited bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.opts.Rate > 0 {
+		l.tokens++
+	}
+	if waited {
+		l.waited--
+	} else {
+		l.allowed--
+	}
+}
+
+// name is what the limit is on, in metrics and errors
+func (l *rateLimiter) name() string {
+	if l.endpoint == "" {
+		return l.service
+	}
+	return fmt.Sprintf("%s.%s", l.service, l.endpoint)
+}
+
+func (l *rateLimiter) stats() RateLimitStats {
+	l.Lock()
+	defer l.Unlock()
+
+	return RateLimitStats{
+		Service:  l.service,
+		Endpoint: l.endpoint,
+		Rate:     l.opts.Rate,
+		Allowed:  l.allowed,
+		Waited:   l.waited,
+		Rejected: l.rejected,
+	}
+}
+
+// rateLimiterFor returns the rate limiter for calls to an endpoint, which shares its service's
+func rateLimiterFor(service, endpoint string) *rateLimiter {
+	key := fmt.Sprintf("%s.%s", service, endpoint)
+
+	rateLimitersMu.RLock()
+	l, ok := rateLimiters[key]
+	rateLimitersMu.RUnlock()
+	if ok {
+		return l
+	}
+
+	rateLimitersMu.Lock()
+	defer rateLimitersMu.Unlock()
+	// Double check no one else has created it
+	if l, ok = rateLimiters[key]; !ok {
+		shared, ok := serviceRateLimiters[service]
+		if !ok {
+			shared = newRateLimiter(service, "", nil)
+			serviceRateLimiters[service] = shared
+		}
+		l = newRateLimiter(service, endpoint, shared)
+		rateLimiters[key] = l
+	}
+
+	return l
+}
+
+func loadRateLimiters() {
+	rateLimitersMu.RLock()
+	defer rateLimitersMu.RUnlock()
+
+	for _, limiters := range []map[string]*rateLimiter{serviceRateLimiters, rateLimiters} {
+		for _, l := range limiters {
+			l.Lock()
+			l.refill(time.Now())
+			l.configure()
+			l.Unlock()
+		}
+	}
+	log.Debugf("[Client] Reloaded rate limits for %d services and %d endpoints", len(serviceRateLimiters),
+		len(rateLimiters))
+}
+
+// RateLimits returns the state of the rate limit on each service and endpoint we have called, ordered by service and
+// endpoint, with each service's shared limit first
+func RateLimits() []RateLimitStats {
+	rateLimitersMu.RLock()
+	stats := make([]RateLimitStats, 0, len(serviceRateLimiters)+len(rateLimiters))
+	for _, limiters := range []map[string]*rateLimiter{serviceRateLimiters, rateLimiters} {
+		for _, l := range limiters {
+			stats = append(stats, l.stats())
+		}
+	}
+	rateLimitersMu.RUnlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Service != stats[j].Service {
+			return stats[i].Service < stats[j].Service
+		}
+		return stats[i].Endpoint < stats[j].Endpoint
+	})
+	return stats
+}
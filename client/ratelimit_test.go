@@ -0,0 +1,190 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/HailoOSS/platform/errors"
+	"github.com/HailoOSS/platform/raven"
+	"github.com/HailoOSS/service/config"
+)
+
+func TestRateLimiter(t *testing.T) {
+	config.Load(bytes.NewBufferString(`{"hailo":{"platform":{"client":{"ratelimit":{"endpoints":` +
+		`{"com.HailoOSS.service.limited":{"reject":{"rate":10,"burst":2},"block":{"rate":100,"block":true}}}}}}}}`))
+	defer config.Load(bytes.NewBufferString(`{}`))
+
+	req, _ := NewJsonRequest("com.HailoOSS.service.limited", "reject", []byte(`{}`))
+	l := newRateLimiter("com.HailoOSS.service.limited", "reject", nil)
+	if l.take(context.Background(), req) != nil || l.take(context.Background(), req) != nil {
+		t.Fatalf("Expected to be able to send a burst of requests")
+	}
+	if err := l.take(context.Background(), req); err == nil || err.Code() != "com.HailoOSS.kernel.platform.ratelimited" ||
+		err.Type() != errors.ErrorRateLimited {
+		t.Errorf("Expected a request over the limit to be rejected, got %v", err)
+	}
+
+	req, _ = NewJsonRequest("com.HailoOSS.service.limited", "block", []byte(`{}`))
+	l = newRateLimiter("com.HailoOSS.service.limited", "block", nil)
+	if err := l.take(context.Background(), req); err != nil {
+		t.Fatalf("Unexpected error taking the first token: %v", err)
+	}
+
+	// we don't wait when we'd run out of time anyway
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if err := l.take(ctx, req); err == nil || err.Code() != "com.HailoOSS.kernel.platform.ratelimited" {
+		t.Errorf("Expected a request that can't wait long enough to be rejected, got %v", err)
+	}
+
+	start := time.Now()
+	if err := l.take(context.Background(), req); err != nil {
+		t.Fatalf("Expected a request over the limit to wait, got %v", err)
+	}
+	if waited := time.Since(start); waited < 5*time.Millisecond {
+		t.Errorf("Expected a request over the limit to wait for a token, waited %v", waited)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := l.take(ctx, req); err == nil || err.Code() != "com.HailoOSS.kernel.platform.cancelled" {
+		t.Errorf("Expected a cancelled request to stop waiting, got %v", err)
+	}
+
+	if s := l.stats(); s.Allowed != 1 || s.Waited != 2 || s.Rejected != 1 {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+}
+
+func TestRateLimitReload(t *testing.T) {
+	config.Load(bytes.NewBufferString(`{"hailo":{"platform":{"client":{"ratelimit":{"services":` +
+		`{"com.HailoOSS.service.reload":{"rate":1}}}}}}}`))
+	defer config.Load(bytes.NewBufferString(`{}`))
+	defer func() {
+		rateLimitersMu.Lock()
+		delete(rateLimiters, "com.HailoOSS.service.reload.foo")
+		delete(serviceRateLimiters, "com.HailoOSS.service.reload")
+		rateLimitersMu.Unlock()
+	}()
+
+	req, _ := NewJsonRequest("com.HailoOSS.service.reload", "foo", []byte(`{}`))
+	l := rateLimiterFor("com.HailoOSS.service.reload", "foo")
+	l.take(context.Background(), req)
+	if err := l.take(context.Background(), req); err == nil {
+		t.Fatalf("Expected a request over the limit to be rejected")
+	}
+
+	config.Load(bytes.NewBufferString(`{}`))
+	loadRateLimiters()
+	if err := l.take(context.Background(), req); err != nil {
+		t.Errorf("Expected no limit once it was removed from config, got %v", err)
+	}
+
+	// the limit was on the service, which the endpoint shares
+	found := 0
+	for _, s := range RateLimits() {
+		if s.Service != "com.HailoOSS.service.reload" {
+			continue
+		}
+		found++
+		switch {
+		case s.Endpoint == "" && (s.Rate != 0 || s.Allowed != 2 || s.Rejected != 1):
+			t.Errorf("Unexpected rate limit stats for the service %+v", s)
+		case s.Endpoint == "foo" && (s.Allowed != 2 || s.Rejected != 0):
+			t.Errorf("Unexpected rate limit stats for the endpoint %+v", s)
+		}
+	}
+	if found != 2 {
+		t.Errorf("Expected stats for the service and the endpoint we called, got %d", found)
+	}
+}
+
+func TestRateLimitSharedByService(t *testing.T) {
+	config.Load(bytes.NewBufferString(`{"hailo":{"platform":{"client":{"ratelimit":{` +
+		`"services":{"com.HailoOSS.service.shared":{"rate":0.001,"burst":2}},` +
+		`"endpoints":{"com.HailoOSS.service.shared":{"bar":{"rate":0.001,"burst":1}}}}}}}}`))
+	defer config.Load(bytes.NewBufferString(`{}`))
+	defer func() {
+		rateLimitersMu.Lock()
+		delete(rateLimiters, "com.HailoOSS.service.shared.foo")
+		delete(rateLimiters, "com.HailoOSS.service.shared.bar")
+		delete(serviceRateLimiters, "com.HailoOSS.service.shared")
+		rateLimitersMu.Unlock()
+	}()
+
+	take := func(endpoint string) errors.Error {
+		req, _ := NewJsonRequest("com.HailoOSS.service.shared", endpoint, []byte(`{}`))
+		return rateLimiterFor("com.HailoOSS.service.shared", endpoint).take(context.Background(), req)
+	}
+
+	// the endpoint's own limit applies as well as the service's
+	if err := take("bar"); err != nil {
+		t.Fatalf("Unexpected error taking a token for bar: %v", err)
+	}
+	if err := take("bar"); err == nil || !errors.IsRateLimited(err) {
+		t.Errorf("Expected bar to be over its own limit, got %v", err)
+	}
+
+	// calling another endpoint doesn't get the service a limit of its own
+	if err := take("foo"); err != nil {
+		t.Fatalf("Unexpected error taking a token for foo: %v", err)
+	}
+	if err := take("foo"); err == nil || !errors.IsRateLimited(err) {
+		t.Errorf("Expected foo to be over the limit it shares with bar, got %v", err)
+	}
+	if s := serviceRateLimiters["com.HailoOSS.service.shared"].stats(); s.Allowed != 2 || s.Rejected != 1 {
+		t.Errorf("Unexpected rate limit stats for the service %+v", s)
+	}
+}
+
+func TestRateLimitAppliesToRetries(t *testing.T) {
+	config.Load(bytes.NewBufferString(`{"hailo":{"platform":{"client":{` +
+		`"ratelimit":{"endpoints":{"com.HailoOSS.service.throttled":{"foo":{"rate":0.001,"burst":1}}}},` +
+		`"retry":{"endpoints":{"com.HailoOSS.service.throttled":{"foo":{"codes":["com.HailoOSS.service.throttled.busy"],` +
+		`"initialIntervalMs":1}}}}}}}}`))
+	defer config.Load(bytes.NewBufferString(`{}`))
+	defer func() {
+		rateLimitersMu.Lock()
+		delete(rateLimiters, "com.HailoOSS.service.throttled.foo")
+		delete(serviceRateLimiters, "com.HailoOSS.service.throttled")
+		rateLimitersMu.Unlock()
+	}()
+
+	tr := raven.NewMemoryTransport(raven.NewMemoryBroker())
+	tr.Connect()
+	deliveries, err := tr.Consume("server-com.HailoOSS.service.throttled")
+	if err != nil {
+		t.Fatalf("Unexpected error consuming: %v", err)
+	}
+	if err := tr.BindService("com.HailoOSS.service.throttled", "server-com.HailoOSS.service.throttled"); err != nil {
+		t.Fatalf("Unexpected error binding: %v", err)
+	}
+
+	// fail every attempt with an error worth retrying
+	received := make(chan string, 10)
+	go func() {
+		for d := range deliveries {
+			received <- d.MessageId
+			payload, _ := json.Marshal(errors.ToProtobuf(
+				errors.InternalServerError("com.HailoOSS.service.throttled.busy", "busy")))
+			tr.SendResponse(&testErrorResponse{testResponse{replyTo: d.ReplyTo, messageID: d.MessageId,
+				payload: payload}}, "server-com.HailoOSS.service.throttled")
+		}
+	}()
+
+	c := NewTransportClient(tr)
+	req, _ := NewJsonRequest("com.HailoOSS.service.throttled", "foo", []byte(`{}`))
+	_, cerr := c.CustomReq(req, WithRetries(2), WithAttemptTimeout(time.Second))
+	if cerr == nil || cerr.Type() != errors.ErrorRateLimited {
+		t.Fatalf("Expected the retry to be rate limited, got %v", cerr)
+	}
+	if n := len(received); n != 1 {
+		t.Errorf("Expected only the first attempt to be sent, the service got %d", n)
+	}
+	if s := rateLimiterFor("com.HailoOSS.service.throttled", "foo").stats(); s.Allowed != 1 || s.Rejected != 1 {
+		t.Errorf("Expected the retry to count against the limit, got %+v", s)
+	}
+}
@@ -0,0 +1,310 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/HailoOSS/protobuf/proto"
+	"github.com/streadway/amqp"
+
+	"github.com/HailoOSS/platform/errors"
+	pe "github.com/HailoOSS/platform/proto/error"
+)
+
+// Recording is a request and the response or error it got, as saved in a golden file
+type Recording struct {
+	Service     string            `json:"service"`
+	Endpoint    string            `json:"endpoint"`
+	Payload     []byte            `json:"payload"`
+	ContentType string            `json:"contentType,omitempty"`
+	Response    []byte            `json:"response,omitempty"`
+	Error       *pe.PlatformError `json:"error,omitempty"`
+}
+
+// Recorder records real requests and their responses, to save to a golden file and serve back later with a Replayer
+type Recorder struct {
+	sync.Mutex
+	recordings []*Recording
+}
+
+// NewRecorder mints a blank recorder
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+func (r *Recorder) add(req *Request, contentType string, body []byte, err errors.Error) {
+	rec := &Recording{
+		Service:  req.Service(),
+		Endpoint: req.Endpoint(),
+		Payload:  req.Payload(),
+	}
+	if err != nil {
+		rec.Error = errors.ToProtobuf(err)
+	} else {
+		rec.ContentType, rec.Response = contentType, body
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.recordings = append(r.recordings, rec)
+}
+
+// Record records a request and the response it was unmarshaled into, or the error it got
+func (r *Recorder) Record(req *Request, rsp proto.Message, err errors.Error) {
+	if err != nil {
+		r.add(req, "", nil, err)
+		return
+	}
+
+	body, merr := marshal(req.ContentType(), rsp)
+	if merr != nil {
+		r.add(req, "", nil, errors.InternalServerError("com.HailoOSS.kernel.platform.marshal", merr.Error()))
+		return
+	}
+	r.add(req, req.ContentType(), body, nil)
+}
+
+// RecordResponse records a request and the raw response or error it got. With neither there is nothing to replay, so
+// nothing is recorded
+func (r *Recorder) RecordResponse(req *Request, rsp *Response, err errors.Error) {
+	if err != nil {
+		r.add(req, "", nil, err)
+		return
+	}
+	if rsp == nil {
+		return
+	}
+	r.add(req, rsp.ContentType(), rsp.Body(), nil)
+}
+
+// Recordings returns everything recorded so far
+func (r *Recorder) Recordings() []*Recording {
+	r.Lock()
+	defer r.Unlock()
+
+	recordings := make([]*Recording, len(r.recordings))
+	copy(recordings, r.recordings)
+	return recordings
+}
+
+// Save writes everything recorded so far to a golden file
+func (r *Recorder) Save(path string) error {
+	b, err := json.MarshalIndent(r.Recordings(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// Client wraps a client, recording every request made through it, other than streams
+func (r *Recorder) Client(c Client) Client {
+	return &recordingClient{Client: c, rec: r}
+}
+
+type recordingClient struct {
+	Client
+	rec *Recorder
+}
+
+func (c *recordingClient) Req(req *Request, rsp proto.Message, options ...CallOption) errors.Error {
+	return c.ReqContext(context.Background(), req, rsp, options...)
+}
+
+func (c *recordingClient) ReqContext(ctx context.Context, req *Request, rsp proto.Message,
+	options ...CallOption) errors.Error {
+	err := c.Client.ReqContext(ctx, req, rsp, options...)
+	c.rec.Record(req, rsp, err)
+	return err
+}
+
+func (c *recordingClient) CustomReq(req *Request, options ...CallOption) (*Response, errors.Error) {
+	return c.CustomReqContext(context.Background(), req, options...)
+}
+
+func (c *recordingClient) CustomReqContext(ctx context.Context, req *Request, options ...CallOption) (*Response,
+	errors.Error) {
+	rsp, err := c.Client.CustomReqContext(ctx, req, options...)
+	c.rec.RecordResponse(req, rsp, err)
+	return rsp, err
+}
+
+func (c *recordingClient) Go(req *Request, rsp proto.Message, options ...CallOption) *Call {
+	return c.GoContext(context.Background(), req, rsp, options...)
+}
+
+func (c *recordingClient) GoContext(ctx context.Context, req *Request, rsp proto.Message, options ...CallOption) *Call {
+	return goCall(req, rsp, func() errors.Error {
+		return c.ReqContext(ctx, req, rsp, options...)
+	})
+}
+
+// Stream passes streams straight through without recording them, as a recording is of a single response
+func (c *recordingClient) Stream(ctx context.Context, req *Request, options ...CallOption) (*ResponseStream,
+	errors.Error) {
+	return c.Client.Stream(ctx, req, options...)
+}
+
+// Replayer serves back the responses to requests recorded by a Recorder. Recordings of identical requests are served
+// in the order they were recorded, with the last one repeated once they have all been used
+type Replayer struct {
+	sync.Mutex
+	recordings []*Recording
+	served     []bool
+}
+
+// NewReplayer serves back the recordings given
+func NewReplayer(recordings []*Recording) *Replayer {
+	return &Replayer{
+		recordings: recordings,
+		served:     make([]bool, len(recordings)),
+	}
+}
+
+// LoadReplayer serves back the recordings in a golden file
+func LoadReplayer(path string) (*Replayer, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var recordings []*Recording
+	if err := json.Unmarshal(b, &recordings); err != nil {
+		return nil, fmt.Errorf("[Client] Bad golden file %s: %v", path, err)
+	}
+	return NewReplayer(recordings), nil
+}
+
+// find returns the recording to serve for a request
+func (r *Replayer) find(req *Request) (*Recording, errors.Error) {
+	r.Lock()
+	defer r.Unlock()
+
+	var last *Recording
+	for i, rec := range r.recordings {
+		if rec.Service != req.Service() || rec.Endpoint != req.Endpoint() || !bytes.Equal(rec.Payload, req.Payload()) {
+			continue
+		}
+		if !r.served[i] {
+			r.served[i] = true
+			return rec, nil
+		}
+		last = rec
+	}
+	if last != nil {
+		return last, nil
+	}
+
+	return nil, errors.NotFound("com.HailoOSS.kernel.client.replay.notfound",
+		fmt.Sprintf("No recording of a request to %s.%s with payload %q", req.Service(), req.Endpoint(), req.Payload()),
+		req.Service(),
+		req.Endpoint())
+}
+
+// Replay unmarshals the recorded response to a request into rsp, or returns the recorded error
+func (r *Replayer) Replay(req *Request, rsp proto.Message) errors.Error {
+	rec, err := r.find(req)
+	if err != nil {
+		return err
+	}
+	if rec.Error != nil {
+		return errors.FromProtobuf(rec.Error)
+	}
+	if merr := unmarshal(rec.ContentType, rec.Response, rsp); merr != nil {
+		return errors.InternalServerError("com.HailoOSS.kernel.platform.unmarshal", merr.Error())
+	}
+	return nil
+}
+
+// ReplayResponse returns the raw recorded response to a request, or the recorded error
+func (r *Replayer) ReplayResponse(req *Request) (*Response, errors.Error) {
+	rec, err := r.find(req)
+	if err != nil {
+		return nil, err
+	}
+	if rec.Error != nil {
+		return nil, errors.FromProtobuf(rec.Error)
+	}
+	return newResponseFromDelivery(amqp.Delivery{
+		Headers:     amqp.Table{"messageType": "reply"},
+		ContentType: rec.ContentType,
+		Body:        rec.Response,
+	}), nil
+}
+
+// Client returns a client that serves back recorded responses rather than making any requests. Anything sent with
+// Push, AsyncTopic or Pub goes nowhere
+func (r *Replayer) Client() Client {
+	return &replayClient{r}
+}
+
+type replayClient struct {
+	r *Replayer
+}
+
+func (c *replayClient) Req(req *Request, rsp proto.Message, options ...CallOption) errors.Error {
+	return c.r.Replay(req, rsp)
+}
+
+func (c *replayClient) CustomReq(req *Request, options ...CallOption) (*Response, errors.Error) {
+	return c.r.ReplayResponse(req)
+}
+
+func (c *replayClient) ReqContext(ctx context.Context, req *Request, rsp proto.Message,
+	options ...CallOption) errors.Error {
+	return c.r.Replay(req, rsp)
+}
+
+func (c *replayClient) CustomReqContext(ctx context.Context, req *Request, options ...CallOption) (*Response,
+	errors.Error) {
+	return c.r.ReplayResponse(req)
+}
+
+func (c *replayClient) Go(req *Request, rsp proto.Message, options ...CallOption) *Call {
+	return goCall(req, rsp, func() errors.Error {
+		return c.r.Replay(req, rsp)
+	})
+}
+
+func (c *replayClient) GoContext(ctx context.Context, req *Request, rsp proto.Message, options ...CallOption) *Call {
+	return c.Go(req, rsp, options...)
+}
+
+// Stream can't be replayed, as the recording client passes streams straight through without recording them
+func (c *replayClient) Stream(ctx context.Context, req *Request, options ...CallOption) (*ResponseStream,
+	errors.Error) {
+	return nil, errors.NotFound("com.HailoOSS.kernel.client.replay.notfound",
+		fmt.Sprintf("Streams to %s.%s aren't recorded", req.Service(), req.Endpoint()),
+		req.Service(),
+		req.Endpoint())
+}
+
+func (c *replayClient) Push(req *Request) error {
+	return nil
+}
+
+func (c *replayClient) AsyncTopic(pub *Publication) error {
+	return nil
+}
+
+func (c *replayClient) Pub(topic string, payload proto.Message) error {
+	return nil
+}
+
+// marshal encodes a message in the content type given
+func marshal(contentType string, m proto.Message) ([]byte, error) {
+	if contentType == "application/json" {
+		return json.Marshal(m)
+	}
+	return proto.Marshal(m)
+}
+
+// unmarshal decodes a message in the content type given
+func unmarshal(contentType string, b []byte, into proto.Message) error {
+	if contentType == "application/json" {
+		return json.Unmarshal(b, into)
+	}
+	return proto.Unmarshal(b, into)
+}
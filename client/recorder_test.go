@@ -0,0 +1,104 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/HailoOSS/platform/errors"
+	"github.com/HailoOSS/platform/raven"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	tr := raven.NewMemoryTransport(raven.NewMemoryBroker())
+	tr.Connect()
+
+	deliveries, err := tr.Consume("server-com.HailoOSS.service.echo")
+	if err != nil {
+		t.Fatalf("Unexpected error consuming: %v", err)
+	}
+	if err := tr.BindService("com.HailoOSS.service.echo", "server-com.HailoOSS.service.echo"); err != nil {
+		t.Fatalf("Unexpected error binding: %v", err)
+	}
+
+	// echo every request straight back
+	go func() {
+		for d := range deliveries {
+			tr.SendResponse(&testResponse{
+				replyTo:   d.ReplyTo,
+				messageID: d.MessageId,
+				payload:   d.Body,
+			}, "server-com.HailoOSS.service.echo")
+		}
+	}()
+
+	rec := NewRecorder()
+	c := rec.Client(NewTransportClient(tr))
+	for _, id := range []string{"1", "2"} {
+		req, _ := NewJsonRequest("com.HailoOSS.service.echo", "echo", []byte(`{"id":`+id+`}`))
+		if err := c.Req(req, &echoPayload{}, WithRetries(0), WithAttemptTimeout(time.Second)); err != nil {
+			t.Fatalf("Unexpected error recording request: %v", err)
+		}
+	}
+	req, _ := NewJsonRequest("com.HailoOSS.service.echo", "custom", []byte(`{"id":3}`))
+	if _, err := c.CustomReq(req, WithRetries(0), WithAttemptTimeout(time.Second)); err != nil {
+		t.Fatalf("Unexpected error recording custom request: %v", err)
+	}
+	req, _ = NewJsonRequest("com.HailoOSS.service.echo", "fail", []byte(`{"id":4}`))
+	rec.Record(req, nil, errors.BadRequest("com.HailoOSS.service.echo.fail", "Bad id"))
+	// with neither a response nor an error there's nothing to replay
+	req, _ = NewJsonRequest("com.HailoOSS.service.echo", "empty", []byte(`{"id":5}`))
+	rec.RecordResponse(req, nil, nil)
+	if n := len(rec.Recordings()); n != 4 {
+		t.Errorf("Expected 4 recordings, got %d", n)
+	}
+
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatalf("Unexpected error making temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	golden := filepath.Join(dir, "golden.json")
+	if err := rec.Save(golden); err != nil {
+		t.Fatalf("Unexpected error saving: %v", err)
+	}
+
+	r, err := LoadReplayer(golden)
+	if err != nil {
+		t.Fatalf("Unexpected error loading: %v", err)
+	}
+	rc := r.Client()
+
+	for _, id := range []int{2, 1, 1} {
+		req, _ := NewJsonRequest("com.HailoOSS.service.echo", "echo", []byte(`{"id":`+string('0'+rune(id))+`}`))
+		rsp := &echoPayload{}
+		if err := rc.Req(req, rsp); err != nil {
+			t.Fatalf("Unexpected error replaying id %d: %v", id, err)
+		}
+		if rsp.Id != id {
+			t.Errorf("Expected id %d to be replayed, got %d", id, rsp.Id)
+		}
+	}
+
+	req, _ = NewJsonRequest("com.HailoOSS.service.echo", "custom", []byte(`{"id":3}`))
+	rsp, rerr := rc.CustomReq(req)
+	if rerr != nil {
+		t.Fatalf("Unexpected error replaying custom request: %v", rerr)
+	}
+	if string(rsp.Body()) != `{"id":3}` || rsp.ContentType() != "application/json" {
+		t.Errorf("Expected the raw response to be replayed, got %s %q", rsp.ContentType(), rsp.Body())
+	}
+
+	req, _ = NewJsonRequest("com.HailoOSS.service.echo", "fail", []byte(`{"id":4}`))
+	if err := rc.Req(req, &echoPayload{}); err == nil || err.Code() != "com.HailoOSS.service.echo.fail" ||
+		err.Type() != errors.ErrorBadRequest {
+		t.Errorf("Expected the recorded error to be replayed, got %v", err)
+	}
+
+	req, _ = NewJsonRequest("com.HailoOSS.service.echo", "echo", []byte(`{"id":5}`))
+	if err := rc.Req(req, &echoPayload{}); err == nil || err.Code() != "com.HailoOSS.kernel.client.replay.notfound" {
+		t.Errorf("Expected a request that wasn't recorded not to be found, got %v", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"math/rand"
+	"time"
 
 	"github.com/HailoOSS/protobuf/proto"
 	"github.com/nu7hatch/gouuid"
@@ -27,6 +28,15 @@ type Request struct {
 	remoteAddr         string
 	options            Options
 	authorised         bool
+	uncompressed       bool
+	deadline           time.Time
+	attemptDeadline    time.Time
+	priority           uint8
+	instance           string
+	streamWindow       int
+	// answered is set when the client answered the request itself, from the cache or by waiting on an identical
+	// request, so it says nothing about the service
+	answered bool
 }
 
 // ContentType returns the content type of the request
@@ -96,6 +106,32 @@ func (r *Request) Authorised() bool {
 	return r.authorised
 }
 
+// Deadline returns when the request must be answered by. Once sent, this is when the current attempt times out, which
+// is never later than any deadline given to SetDeadline
+func (r *Request) Deadline() time.Time {
+	if !r.attemptDeadline.IsZero() {
+		return r.attemptDeadline
+	}
+	return r.deadline
+}
+
+// Priority returns the broker priority of the request, from 0 to 9
+func (r *Request) Priority() uint8 {
+	return r.priority
+}
+
+// Instance returns the instance the request is being sent straight to, if any, rather than to any instance of the
+// service
+func (r *Request) Instance() string {
+	return r.instance
+}
+
+// StreamWindow returns how many replies the server may send before waiting for more credit, if the request is for a
+// stream of them
+func (r *Request) StreamWindow() int {
+	return r.streamWindow
+}
+
 // SetFrom sets details about which service is making this request
 // @todo eventually this should include an async cryptographic signature such that the receiver can verify this to establish trust
 func (r *Request) SetFrom(service string) {
@@ -132,6 +168,20 @@ func (r *Request) SetParentMessageID(id string) {
 	r.parentMessageID = id
 }
 
+// SetDeadline sets when the request must be answered by, eg: the deadline of the request we are handling, so that we
+// never wait (or make the service we are calling work) for longer than our caller will
+func (r *Request) SetDeadline(t time.Time) {
+	r.deadline = t
+}
+
+// SetPriority sets the broker priority of the request, from 0 (the default) to 9
+func (r *Request) SetPriority(p uint8) {
+	if p > 9 {
+		p = 9
+	}
+	r.priority = p
+}
+
 // SetAuthorised sets whether the request has already been authorised
 func (r *Request) SetAuthorised(val bool) {
 	r.authorised = val
@@ -161,6 +211,16 @@ func (r *Request) shouldTrace() bool {
 	return false
 }
 
+// SetCompressionDisabled stops this request being compressed, even when it is over the configured threshold
+func (r *Request) SetCompressionDisabled(val bool) {
+	r.uncompressed = val
+}
+
+// CompressionDisabled returns whether this request has opted out of compression
+func (r *Request) CompressionDisabled() bool {
+	return r.uncompressed
+}
+
 func (r *Request) SetOptions(options Options) {
 	r.options = options
 }
@@ -200,9 +260,9 @@ func buildRequest(contentType string, payload []byte, service, endpoint string)
 		return nil, fmt.Errorf("Missing endpoint in request")
 	}
 
-	messageID, err := uuid.NewV4()
+	messageID, err := newMessageID()
 	if err != nil {
-		return nil, fmt.Errorf("Failed to generate message ID: %v", err)
+		return nil, err
 	}
 
 	return &Request{
@@ -210,10 +270,19 @@ func buildRequest(contentType string, payload []byte, service, endpoint string)
 		payload:     payload,
 		service:     service,
 		endpoint:    endpoint,
-		messageID:   messageID.String(),
+		messageID:   messageID,
 	}, nil
 }
 
+func newMessageID() (string, error) {
+	messageID, err := uuid.NewV4()
+	if err != nil {
+		return "", fmt.Errorf("Failed to generate message ID: %v", err)
+	}
+
+	return messageID.String(), nil
+}
+
 // NewRequest builds a new request object, checking for bad data
 func NewRequest(service, endpoint string, payload proto.Message) (*Request, error) {
 	payloadData, err := proto.Marshal(payload)
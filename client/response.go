@@ -3,9 +3,13 @@ package client
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
 
 	"github.com/HailoOSS/protobuf/proto"
+	log "github.com/cihub/seelog"
 	"github.com/streadway/amqp"
+
+	"github.com/HailoOSS/platform/raven"
 )
 
 // Response wraps an AMQP delivery
@@ -38,6 +42,11 @@ func (self *Response) CorrelationID() string {
 	return self.delivery.CorrelationId
 }
 
+// InstanceID returns the ID of the service instance that sent the response
+func (self *Response) InstanceID() string {
+	return self.delivery.ReplyTo
+}
+
 // IsError returns whether this message is an error?
 func (self *Response) IsError() bool {
 	if val, ok := self.delivery.Headers["messageType"]; ok {
@@ -47,9 +56,27 @@ func (self *Response) IsError() bool {
 	return false
 }
 
-// Body of the message
+// Sequence returns where a reply comes in its stream, counting from 1, or 0 if it isn't part of one
+func (self *Response) Sequence() uint64 {
+	seq, _ := self.delivery.Headers["sequence"].(string)
+	n, _ := strconv.ParseUint(seq, 10, 64)
+	return n
+}
+
+// EndOfStream returns whether this marks the end of its stream
+func (self *Response) EndOfStream() bool {
+	return self.delivery.Headers["endOfStream"] == "1"
+}
+
+// Body of the message, decompressed if it was sent compressed
 func (self *Response) Body() []byte {
-	return self.delivery.Body
+	body, err := raven.Decompress(self.delivery.ContentEncoding, self.delivery.Body)
+	if err != nil {
+		log.Warnf("[Client] Returning raw body of response %s: %v", self.MessageID(), err)
+		return self.delivery.Body
+	}
+
+	return body
 }
 
 // Header of the message
@@ -67,11 +94,15 @@ func (self *Response) Unmarshal(into proto.Message) (err error) {
 		err = fmt.Errorf("[Client] Cannot unmarshal response into nil proto")
 		return
 	}
+	body, err := raven.Decompress(self.delivery.ContentEncoding, self.delivery.Body)
+	if err != nil {
+		return
+	}
 	switch self.delivery.ContentType {
 	case "application/json":
-		err = json.Unmarshal(self.Body(), into)
+		err = json.Unmarshal(body, into)
 	case "application/octetstream":
-		err = proto.Unmarshal(self.Body(), into)
+		err = proto.Unmarshal(body, into)
 	default:
 		err = fmt.Errorf("Unknown content type: %s", self.delivery.ContentType)
 	}
@@ -1,6 +1,8 @@
 package client
 
 import (
+	"bytes"
+	"compress/gzip"
 	"testing"
 
 	"github.com/streadway/amqp"
@@ -16,6 +18,22 @@ func TestNewResponseMints(t *testing.T) {
 	}
 }
 
+func TestResponseBodyDecompressed(t *testing.T) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(`{"foo":"bar"}`))
+	w.Close()
+
+	rsp := newResponseFromDelivery(amqp.Delivery{
+		ContentType:     "application/json",
+		ContentEncoding: "gzip",
+		Body:            buf.Bytes(),
+	})
+	if body := string(rsp.Body()); body != `{"foo":"bar"}` {
+		t.Errorf("Expected decompressed body, got %q", body)
+	}
+}
+
 func BenchmarkNewRespones(b *testing.B) {
 	delivery := &amqp.Delivery{
 		CorrelationId: "123456",
@@ -0,0 +1,147 @@
+package client
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/HailoOSS/platform/errors"
+	"github.com/HailoOSS/service/config"
+)
+
+// RetryPolicy decides whether a failed attempt is worth retrying
+type RetryPolicy interface {
+	// Retry is called when attempt (starting at 1) fails with err, and says whether to try again and how long to wait
+	// before doing so
+	Retry(attempt int, err errors.Error) (bool, time.Duration)
+}
+
+// RetryOptions configure the default retry policy, under hailo.platform.client.retry, overridden for an endpoint
+// under hailo.platform.client.retry.endpoints.<service>.<endpoint>
+type RetryOptions struct {
+	// Types are the error types worth retrying, eg: TIMEOUT
+	Types []string `json:"types,omitempty"`
+	// Codes are error codes worth retrying, whatever their type
+	Codes []string `json:"codes,omitempty"`
+	// NoRetryCodes are error codes never worth retrying, whatever their type
+	NoRetryCodes []string `json:"noRetryCodes,omitempty"`
+
+	// Backoff config
+	Multiplier          float64 `json:"multiplier,omitempty"`
+	RandomizationFactor float64 `json:"randomizationFactor,omitempty"`
+	InitialIntervalMs   int64   `json:"initialIntervalMs,omitempty"`
+	MaxIntervalMs       int64   `json:"maxIntervalMs,omitempty"`
+}
+
+var (
+	// The default retry config, which retries timeouts only
+	defaultRetryOptions = RetryOptions{
+		Types:               []string{errors.ErrorTimeout},
+		Multiplier:          2,
+		RandomizationFactor: 0.5,
+		InitialIntervalMs:   10,
+		MaxIntervalMs:       1000,
+	}
+
+	retryPolicies   = make(map[string]RetryPolicy) // Maps service/endpoint to RetryPolicy
+	retryPoliciesMu sync.RWMutex
+)
+
+func init() {
+	// Forget our policies when config changes, so they are rebuilt from the new config
+	onConfigChange(func() {
+		retryPoliciesMu.Lock()
+		retryPolicies = make(map[string]RetryPolicy)
+		retryPoliciesMu.Unlock()
+	})
+}
+
+// WithRetryPolicy decides which failures are retried, and how long to wait first, rather than using the policy
+// configured for the endpoint
+func WithRetryPolicy(p RetryPolicy) CallOption {
+	return callOptionFunc(func(o *callOptions) {
+		o.retryPolicy = p
+	})
+}
+
+// exponentialRetryPolicy retries errors by type and code, backing off exponentially with jitter
+type exponentialRetryPolicy struct {
+	types, codes, noRetryCodes map[string]bool
+	multiplier, jitter         float64
+	initial, max               time.Duration
+}
+
+// NewRetryPolicy builds a policy that retries the configured error types and codes, backing off exponentially with
+// jitter between attempts
+func NewRetryPolicy(opts RetryOptions) RetryPolicy {
+	return &exponentialRetryPolicy{
+		types:        stringSet(opts.Types),
+		codes:        stringSet(opts.Codes),
+		noRetryCodes: stringSet(opts.NoRetryCodes),
+		multiplier:   opts.Multiplier,
+		jitter:       opts.RandomizationFactor,
+		initial:      time.Duration(opts.InitialIntervalMs) * time.Millisecond,
+		max:          time.Duration(opts.MaxIntervalMs) * time.Millisecond,
+	}
+}
+
+func (p *exponentialRetryPolicy) Retry(attempt int, err errors.Error) (bool, time.Duration) {
+	if err == nil || err.Type() == errors.ErrorRateLimited || p.noRetryCodes[err.Code()] {
+		return false, 0
+	}
+	if !p.types[err.Type()] && !p.codes[err.Code()] {
+		return false, 0
+	}
+
+	return true, p.backoff(attempt)
+}
+
+// backoff is how long to wait after a failed attempt, growing with each attempt up to the max, then randomised by the
+// jitter factor so that retries from many clients don't all arrive at once
+func (p *exponentialRetryPolicy) backoff(attempt int) time.Duration {
+	interval := float64(p.initial) * math.Pow(p.multiplier, float64(attempt-1))
+	if p.max > 0 && interval > float64(p.max) {
+		interval = float64(p.max)
+	}
+	if p.jitter > 0 {
+		interval += interval * p.jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(interval)
+}
+
+// retryPolicy returns the configured policy for an endpoint
+func retryPolicy(service, endpoint string) RetryPolicy {
+	key := fmt.Sprintf("%s.%s", service, endpoint)
+
+	retryPoliciesMu.RLock()
+	p, ok := retryPolicies[key]
+	retryPoliciesMu.RUnlock()
+	if ok {
+		return p
+	}
+
+	opts := defaultRetryOptions
+	config.AtPath("hailo", "platform", "client", "retry").AsStruct(&opts)
+	config.AtPath("hailo", "platform", "client", "retry", "endpoints", service, endpoint).AsStruct(&opts)
+	log.Debugf("[Client] Retry config for %s: %#v", key, opts)
+	p = NewRetryPolicy(opts)
+
+	retryPoliciesMu.Lock()
+	retryPolicies[key] = p
+	retryPoliciesMu.Unlock()
+
+	return p
+}
+
+func stringSet(ss []string) map[string]bool {
+	set := make(map[string]bool, len(ss))
+	for _, s := range ss {
+		set[s] = true
+	}
+	return set
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/HailoOSS/platform/errors"
+	"github.com/HailoOSS/platform/raven"
+	"github.com/HailoOSS/service/config"
+)
+
+// testErrorResponse is an error reply from our fake service
+type testErrorResponse struct {
+	testResponse
+}
+
+func (r *testErrorResponse) MessageType() string { return "error" }
+
+func TestRetryPolicyClassifies(t *testing.T) {
+	p := NewRetryPolicy(RetryOptions{
+		Types:             []string{errors.ErrorTimeout},
+		Codes:             []string{"com.HailoOSS.service.foo.busy"},
+		NoRetryCodes:      []string{"com.HailoOSS.service.foo.slow"},
+		Multiplier:        2,
+		InitialIntervalMs: 10,
+		MaxIntervalMs:     25,
+	})
+
+	testCases := []struct {
+		err   errors.Error
+		retry bool
+	}{
+		{errors.Timeout("com.HailoOSS.kernel.platform.timeout", "timeout"), true},
+		{errors.Timeout("com.HailoOSS.service.foo.slow", "timeout"), false},
+		{errors.InternalServerError("com.HailoOSS.service.foo.busy", "busy"), true},
+		{errors.InternalServerError("com.HailoOSS.service.foo.broken", "broken"), false},
+		{errors.BadRequest("com.HailoOSS.service.foo.bad", "bad"), false},
+		{errors.RateLimited("com.HailoOSS.service.foo.busy", "over the limit"), false},
+	}
+	for _, tc := range testCases {
+		if retry, _ := p.Retry(1, tc.err); retry != tc.retry {
+			t.Errorf("Expected retry=%v for %s %s", tc.retry, tc.err.Type(), tc.err.Code())
+		}
+	}
+
+	timeout := errors.Timeout("com.HailoOSS.kernel.platform.timeout", "timeout")
+	for attempt, expected := range map[int]time.Duration{1: 10 * time.Millisecond, 2: 20 * time.Millisecond,
+		3: 25 * time.Millisecond} {
+		if _, d := p.Retry(attempt, timeout); d != expected {
+			t.Errorf("Expected backoff of %v after attempt %d, got %v", expected, attempt, d)
+		}
+	}
+}
+
+func TestRetryPolicyJitter(t *testing.T) {
+	p := NewRetryPolicy(RetryOptions{
+		Types:               []string{errors.ErrorTimeout},
+		Multiplier:          2,
+		RandomizationFactor: 0.5,
+		InitialIntervalMs:   100,
+	})
+
+	timeout := errors.Timeout("com.HailoOSS.kernel.platform.timeout", "timeout")
+	for i := 0; i < 100; i++ {
+		if _, d := p.Retry(1, timeout); d < 50*time.Millisecond || d > 150*time.Millisecond {
+			t.Fatalf("Expected backoff within 50%% of 100ms, got %v", d)
+		}
+	}
+}
+
+func TestReqRetriesConfiguredErrors(t *testing.T) {
+	config.Load(bytes.NewBufferString(`{"hailo":{"platform":{"client":{"retry":{"endpoints":{` +
+		`"com.HailoOSS.service.busy":{"foo":{"codes":["com.HailoOSS.service.busy.later"],"initialIntervalMs":1}}}}}}}}`))
+	defer config.Load(bytes.NewBufferString(`{}`))
+
+	tr := raven.NewMemoryTransport(raven.NewMemoryBroker())
+	tr.Connect()
+
+	deliveries, err := tr.Consume("server-com.HailoOSS.service.busy")
+	if err != nil {
+		t.Fatalf("Unexpected error consuming: %v", err)
+	}
+	if err := tr.BindService("com.HailoOSS.service.busy", "server-com.HailoOSS.service.busy"); err != nil {
+		t.Fatalf("Unexpected error binding: %v", err)
+	}
+
+	// fail the first attempt at every request, with an error worth retrying
+	go func() {
+		seen := make(map[string]bool)
+		for d := range deliveries {
+			var rsp raven.Response = &testResponse{replyTo: d.ReplyTo, messageID: d.MessageId, payload: d.Body}
+			if !seen[d.MessageId] {
+				seen[d.MessageId] = true
+				payload, _ := json.Marshal(errors.ToProtobuf(
+					errors.InternalServerError("com.HailoOSS.service.busy.later", "busy")))
+				rsp = &testErrorResponse{testResponse{replyTo: d.ReplyTo, messageID: d.MessageId, payload: payload}}
+			}
+			tr.SendResponse(rsp, "server-com.HailoOSS.service.busy")
+		}
+	}()
+
+	c := NewTransportClient(tr)
+	req, _ := NewJsonRequest("com.HailoOSS.service.busy", "foo", []byte(`{}`))
+	if _, cerr := c.CustomReq(req, WithRetries(1), WithAttemptTimeout(time.Second)); cerr != nil {
+		t.Fatalf("Expected the retry to succeed, got %v", cerr)
+	}
+
+	req, _ = NewJsonRequest("com.HailoOSS.service.busy", "foo", []byte(`{}`))
+	_, cerr := c.CustomReq(req, WithRetries(0), WithAttemptTimeout(time.Second))
+	if cerr == nil || cerr.Code() != "com.HailoOSS.service.busy.later" {
+		t.Errorf("Expected the error reply without any retries, got %v", cerr)
+	}
+}
@@ -0,0 +1,301 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/HailoOSS/platform/errors"
+	pe "github.com/HailoOSS/platform/proto/error"
+	"github.com/HailoOSS/platform/raven"
+)
+
+const (
+	// defaultStreamWindow is how many replies we have room for, unless set with WithStreamWindow
+	defaultStreamWindow = 16
+	// streamControlEndpoint is where we send the server credit for, or cancel, a stream
+	streamControlEndpoint = "streamcontrol"
+)
+
+// ResponseStream reads the replies to a request from an endpoint that streams them, in the order they were sent. We
+// give the server credit for as many replies as we have room for, and more as they are read, so it never gets too
+// far ahead of us
+//
+//	stream, err := client.Stream(ctx, req)
+//	if err != nil {
+//		return err
+//	}
+//	defer stream.Close()
+//	for stream.Next() {
+//		stream.Response().Unmarshal(rsp)
+//	}
+//	return stream.Err()
+type ResponseStream struct {
+	c      *client
+	req    *Request
+	ctx    context.Context
+	cancel context.CancelFunc
+	ch     chan *Response
+	window int
+	// idle is how long we wait for each reply before giving up on the stream
+	idle time.Duration
+
+	next     uint64               // the sequence of the reply we want next
+	early    map[uint64]*Response // replies that arrived before their turn
+	current  *Response
+	last     bool // the current reply is the last one
+	unread   int  // replies read since we last gave the server credit for them
+	instance string
+	started  bool // the request has been sent
+	unseen   bool // the current reply was read when the stream started, and not yet by the caller
+	ended    bool // the server has finished sending the stream
+	done     bool
+	err      errors.Error
+
+	closeOnce sync.Once
+}
+
+// Stream sends a request to an endpoint that streams its replies, returning a ResponseStream to read them from once
+// the first has arrived. The request goes through the interceptors like any other, which see the first reply as its
+// response. Reading stops once ctx is done. Stream requests are never retried, as we may already have read some of
+// the replies
+func (c *client) Stream(ctx context.Context, req *Request, options ...CallOption) (*ResponseStream, errors.Error) {
+	o := c.callOptions(options)
+	s := &ResponseStream{
+		c:      c,
+		req:    req,
+		window: o.streamWindow,
+		idle:   o.attemptTimeout,
+		next:   1,
+		early:  make(map[uint64]*Response),
+	}
+	if s.window <= 0 {
+		s.window = defaultStreamWindow
+	}
+	if s.idle <= 0 {
+		s.idle = c.timeout.Get(req.service, req.endpoint, 1)
+	}
+	if o.timeout > 0 {
+		s.ctx, s.cancel = context.WithTimeout(ctx, o.timeout)
+	} else {
+		s.ctx, s.cancel = context.WithCancel(ctx)
+	}
+
+	invoke := chain(c.interceptors(o), func(ctx context.Context, req *Request) (*Response, errors.Error) {
+		s.req = req
+		return s.start()
+	})
+	if _, err := invoke(s.ctx, req); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// start sends the request and waits for the first reply, which Next then returns again for the caller to read
+func (s *ResponseStream) start() (*Response, errors.Error) {
+	c, req := s.c, s.req
+	req.answered = false
+	if err := checkRequestSize(req); err != nil {
+		return nil, err
+	}
+	if err := rateLimiterFor(req.service, req.endpoint).take(s.ctx, req); err != nil {
+		return nil, err
+	}
+	if err := c.ensureListening(); err != nil {
+		return nil, err
+	}
+
+	// besides the replies we have given credit for, the server may send one to end the stream
+	s.ch = make(chan *Response, s.window+1)
+	req.streamWindow = s.window
+	if !c.responses.addWhenRoom(s.ctx, req, s.ch) {
+		return nil, c.contextError(s.ctx, req, fmt.Sprintf("client.%s.%s", req.service, req.endpoint), time.Now())
+	}
+	c.responses.markStream(req)
+
+	if err := c.send(req); err != nil {
+		return nil, err
+	}
+	s.started = true
+
+	if !s.Next() {
+		return nil, s.err
+	}
+	s.unseen = true
+	return s.current, nil
+}
+
+// Next waits for the next reply, returning false once there are no more, because the stream has ended, failed, or
+// been closed. Err then says which
+func (s *ResponseStream) Next() bool {
+	if s.unseen {
+		s.unseen = false
+		return true
+	}
+	if s.done {
+		return false
+	}
+	if s.last {
+		s.finish(nil)
+		return false
+	}
+
+	idle := time.NewTimer(s.idle)
+	defer idle.Stop()
+	for {
+		if rsp, ok := s.early[s.next]; ok {
+			delete(s.early, s.next)
+			return s.read(rsp)
+		}
+
+		select {
+		case rsp := <-s.ch:
+			s.instance = rsp.InstanceID()
+			switch seq := rsp.Sequence(); {
+			case seq > s.next:
+				s.early[seq] = rsp
+				continue
+			case seq > 0 && seq < s.next:
+				log.Warnf("[Client] Ignoring duplicate reply %d on stream %s", seq, s.req.MessageID())
+				continue
+			}
+			return s.read(rsp)
+		case <-s.ctx.Done():
+			s.finish(s.c.contextError(s.ctx, s.req, fmt.Sprintf("client.%s.%s", s.req.service, s.req.endpoint),
+				time.Now()))
+			return false
+		case <-idle.C:
+			log.Errorf("[Client] Timeout waiting for reply %d on stream %s from %s.%s after %v", s.next,
+				s.req.MessageID(), s.req.Service(), s.req.Endpoint(), s.idle)
+			s.finish(errors.Timeout("com.HailoOSS.kernel.platform.timeout",
+				fmt.Sprintf("Stream timed out talking to %s.%s from %s (waited %v for a reply)", s.req.Service(),
+					s.req.Endpoint(), s.req.From(), s.idle),
+				s.req.Service(),
+				s.req.Endpoint()))
+			return false
+		}
+	}
+}
+
+// read deals with the next reply on the stream
+func (s *ResponseStream) read(rsp *Response) bool {
+	if rsp.IsError() {
+		s.ended = true
+		errorProto := &pe.PlatformError{}
+		if err := rsp.Unmarshal(errorProto); err != nil {
+			s.finish(errors.BadResponse("com.HailoOSS.kernel.platform.badresponse", err.Error()))
+		} else {
+			s.finish(errors.FromProtobuf(errorProto))
+		}
+		return false
+	}
+	if rsp.EndOfStream() {
+		s.ended = true
+		s.finish(nil)
+		return false
+	}
+
+	s.current = rsp
+	if rsp.Sequence() == 0 {
+		// a plain reply, from an endpoint that doesn't stream, is a stream of one
+		s.last, s.ended = true, true
+		return true
+	}
+
+	s.next++
+	s.unread++
+	if s.unread >= (s.window+1)/2 {
+		s.control(streamControl{Stream: s.req.MessageID(), Credit: s.unread})
+		s.unread = 0
+	}
+	return true
+}
+
+// Response returns the reply Next just read
+func (s *ResponseStream) Response() *Response {
+	return s.current
+}
+
+// Err returns why the stream failed, if it did, once Next returns false
+func (s *ResponseStream) Err() errors.Error {
+	return s.err
+}
+
+// Close stops reading the stream, telling the server to stop sending it if it hasn't finished. Like Next, it should be
+// called by whoever is reading the stream; to stop it from elsewhere, cancel its context
+func (s *ResponseStream) Close() {
+	s.closeOnce.Do(func() {
+		s.done, s.unseen = true, false
+		s.cancel()
+		if s.started && !s.ended {
+			if s.instance == "" {
+				// only the instance sending the stream can cancel it, and we won't know which that is until it replies
+				go s.cancelOnReply()
+				return
+			}
+			s.control(streamControl{Stream: s.req.MessageID(), Cancel: true})
+		}
+		s.c.responses.removeByRequest(s.req)
+	})
+}
+
+// cancelOnReply waits for the first reply to a stream closed before it arrived, to cancel the stream on the instance
+// sending it. If none turns up within the idle timeout, the server has either never started the stream or given up on
+// it already
+func (s *ResponseStream) cancelOnReply() {
+	defer s.c.responses.removeByRequest(s.req)
+
+	idle := time.NewTimer(s.idle)
+	defer idle.Stop()
+	select {
+	case rsp := <-s.ch:
+		if rsp.IsError() || rsp.EndOfStream() || rsp.Sequence() == 0 {
+			// the stream is already over
+			return
+		}
+		s.instance = rsp.InstanceID()
+		s.control(streamControl{Stream: s.req.MessageID(), Cancel: true})
+	case <-idle.C:
+	}
+}
+
+// finish ends the stream, with the error it failed with if it did
+func (s *ResponseStream) finish(err errors.Error) {
+	if err != nil {
+		log.Debugf("[Client] Stream %s to %s.%s failed: %v", s.req.MessageID(), s.req.Service(), s.req.Endpoint(), err)
+	}
+	s.err = err
+	s.Close()
+}
+
+// streamControl is what we send the server about a stream
+type streamControl struct {
+	Stream string `json:"stream"`
+	Credit int    `json:"credit,omitempty"`
+	Cancel bool   `json:"cancel,omitempty"`
+}
+
+// control sends the server instance sending the stream credit for more replies, or tells it to stop, on its control
+// queue. Until we have heard from the instance we don't know which it is, but it hasn't used any credit yet either
+func (s *ResponseStream) control(sc streamControl) {
+	if s.instance == "" {
+		return
+	}
+
+	b, _ := json.Marshal(sc)
+	req, err := NewJsonRequest(s.req.service, streamControlEndpoint, b)
+	if err != nil {
+		log.Warnf("[Client] Failed to build control message for stream %s: %v", s.req.MessageID(), err)
+		return
+	}
+	req.instance = raven.ControlQueue(s.instance)
+	if err := s.c.getTransport().SendRequest(req, s.c.instanceID); err != nil {
+		log.Warnf("[Client] Failed to send control message for stream %s: %v", s.req.MessageID(), err)
+	}
+}
@@ -0,0 +1,140 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/HailoOSS/platform/errors"
+	"github.com/HailoOSS/platform/raven"
+)
+
+type testStreamResponse struct {
+	testResponse
+	sequence    uint64
+	endOfStream bool
+}
+
+func (r *testStreamResponse) MessageType() string { return "stream" }
+func (r *testStreamResponse) Sequence() uint64    { return r.sequence }
+func (r *testStreamResponse) EndOfStream() bool   { return r.endOfStream }
+
+func TestStreamReordersReplies(t *testing.T) {
+	tr := raven.NewMemoryTransport(raven.NewMemoryBroker())
+	tr.Connect()
+
+	deliveries, err := tr.Consume("server-com.HailoOSS.service.stream")
+	if err != nil {
+		t.Fatalf("Unexpected error consuming: %v", err)
+	}
+	if err := tr.BindService("com.HailoOSS.service.stream", "server-com.HailoOSS.service.stream"); err != nil {
+		t.Fatalf("Unexpected error binding: %v", err)
+	}
+
+	// send three replies and the end of the stream, all out of order, in response to a stream request
+	windows := make(chan interface{}, 1)
+	go func() {
+		d := <-deliveries
+		windows <- d.Headers["streamWindow"]
+		for _, seq := range []uint64{2, 4, 1, 3} {
+			payload := []byte(`{"id":` + string('0'+rune(seq)) + `}`)
+			tr.SendResponse(&testStreamResponse{
+				testResponse: testResponse{replyTo: d.ReplyTo, messageID: d.MessageId, payload: payload},
+				sequence:     seq,
+				endOfStream:  seq == 4,
+			}, "server-com.HailoOSS.service.stream")
+		}
+	}()
+
+	c := NewTransportClient(tr)
+	req, _ := NewJsonRequest("com.HailoOSS.service.stream", "list", []byte(`{}`))
+	stream, serr := c.Stream(context.Background(), req, WithStreamWindow(8), WithAttemptTimeout(time.Second))
+	if serr != nil {
+		t.Fatalf("Unexpected error starting stream: %v", serr)
+	}
+	defer stream.Close()
+
+	expected := 1
+	for stream.Next() {
+		rsp := &echoPayload{}
+		stream.Response().Unmarshal(rsp)
+		if rsp.Id != expected {
+			t.Errorf("Expected reply %d, got %d", expected, rsp.Id)
+		}
+		expected++
+	}
+	if err := stream.Err(); err != nil {
+		t.Errorf("Unexpected error reading stream: %v", err)
+	}
+	if expected != 4 {
+		t.Errorf("Expected 3 replies before the end of the stream, got %d", expected-1)
+	}
+	if w := <-windows; w != "8" {
+		t.Errorf("Expected the request to ask for a window of 8, got %v", w)
+	}
+}
+
+func TestStreamCancelledBeforeFirstReply(t *testing.T) {
+	tr := raven.NewMemoryTransport(raven.NewMemoryBroker())
+	tr.Connect()
+
+	service, instance := "com.HailoOSS.service.slowstream", "server-com.HailoOSS.service.slowstream"
+	deliveries, err := tr.Consume(instance)
+	if err != nil {
+		t.Fatalf("Unexpected error consuming: %v", err)
+	}
+	if err := tr.BindService(service, instance); err != nil {
+		t.Fatalf("Unexpected error binding: %v", err)
+	}
+	controls, err := tr.Consume(raven.ControlQueue(instance))
+	if err != nil {
+		t.Fatalf("Unexpected error consuming: %v", err)
+	}
+
+	// only start the stream once the client has given up waiting for it
+	started := make(chan struct{})
+	go func() {
+		d := <-deliveries
+		<-started
+		tr.SendResponse(&testStreamResponse{
+			testResponse: testResponse{replyTo: d.ReplyTo, messageID: d.MessageId, payload: []byte(`{"id":1}`)},
+			sequence:     1,
+		}, instance)
+	}()
+
+	c := NewTransportClient(tr)
+	req, _ := NewJsonRequest(service, "list", []byte(`{}`))
+	if _, err := c.Stream(context.Background(), req, WithAttemptTimeout(50*time.Millisecond)); err == nil {
+		t.Fatalf("Expected the stream to time out waiting for its first reply")
+	}
+	close(started)
+
+	// the cancel waits until we know which instance to send it to
+	select {
+	case d := <-controls:
+		if d.Headers["endpoint"] != streamControlEndpoint {
+			t.Errorf("Expected a stream control message, got %v", d.Headers["endpoint"])
+		}
+		if want := `{"stream":"` + req.MessageID() + `","cancel":true}`; string(d.Body) != want {
+			t.Errorf("Expected %s, got %s", want, d.Body)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the stream to be cancelled on the instance that started it")
+	}
+}
+
+func TestStreamInterceptors(t *testing.T) {
+	fault := func(ctx context.Context, req *Request, next Invoker) (*Response, errors.Error) {
+		return nil, errors.NotFound("com.HailoOSS.service.foo.fault", "Injected fault")
+	}
+
+	c := newClient().(*client)
+	req, _ := NewJsonRequest("com.HailoOSS.service.stream", "list", []byte(`{}`))
+	if _, err := c.Stream(context.Background(), req, WithInterceptors(fault)); err == nil ||
+		err.Code() != "com.HailoOSS.service.foo.fault" {
+		t.Fatalf("Expected the injected fault, got %v", err)
+	}
+	if n := c.responses.stats().Requests; n != 0 {
+		t.Errorf("Expected no requests waited on, got %d", n)
+	}
+}
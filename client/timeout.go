@@ -33,12 +33,18 @@ type Timeout struct {
 	// "dial" settings
 	min, max   time.Duration
 	multiplier float64
+
+	// latencies holds the latency seen from each service.endpoint, to learn timeouts from when adaptive is on
+	latencyMtx sync.Mutex
+	latencies  map[string]*latencyWindow
+	adaptive   AdaptiveTimeoutOptions
 }
 
 // NewTimeout mints a blank timeout container from which we can calculate timeouts to use for requests
 func NewTimeout(c Client) *Timeout {
 	t := &Timeout{
 		endpoints: make(map[string]map[string]time.Duration),
+		latencies: make(map[string]*latencyWindow),
 		client:    c,
 	}
 
@@ -67,7 +73,8 @@ func NewTimeout(c Client) *Timeout {
 // Get timeout to use for an attempt made calling some service
 // our strategy is to always return a timeout immediately, and if we don't have
 // any knowledge of what a good timeout is, pick a default and trigger a background
-// load from the discovery service
+// load from the discovery service. With adaptive timeouts on, what we have learned
+// from the replies we've seen takes the place of the SLA
 func (t *Timeout) Get(service, endpoint string, attempt int) time.Duration {
 	d, exists := t.fetchSla(service, endpoint)
 	if !exists {
@@ -75,6 +82,9 @@ func (t *Timeout) Get(service, endpoint string, attempt int) time.Duration {
 		t.add(service, endpoint)
 		go t.reloadSlas()
 	}
+	if learned, ok := t.fetchLearned(service, endpoint); ok {
+		d = learned
+	}
 
 	// apply controls
 	d *= time.Duration(t.multiplier)
@@ -94,6 +104,8 @@ func (t *Timeout) Get(service, endpoint string, attempt int) time.Duration {
 
 // loadFromConfig will grab the configurable settings from config service
 func (t *Timeout) loadFromConfig() {
+	t.loadAdaptiveFromConfig()
+
 	min := config.AtPath("hailo", "platform", "timeout", "min").AsDuration(defaultMin)
 	max := config.AtPath("hailo", "platform", "timeout", "max").AsDuration(defaultMax)
 	multiplier := config.AtPath("hailo", "platform", "timeout", "multiplier").AsFloat64(defaultMultiplier)
@@ -1,8 +1,11 @@
 package client
 
 import (
+	"bytes"
 	"testing"
 	"time"
+
+	"github.com/HailoOSS/service/config"
 )
 
 func TestGetBacksOff(t *testing.T) {
@@ -47,3 +50,79 @@ func TestMsToDuration(t *testing.T) {
 		}
 	}
 }
+
+func TestAdaptiveTimeout(t *testing.T) {
+	config.Load(bytes.NewBufferString(`{"hailo":{"platform":{"timeout":{"adaptive":` +
+		`{"enabled":true,"percentile":90,"marginMs":5,"minSamples":10,"windowSize":20}}}}}`))
+	defer config.Load(bytes.NewBufferString(`{}`))
+
+	timeout := NewTimeout(DefaultClient)
+	timeout.add("foo", "bar")
+	timeout.endpoints["foo"]["bar"] = time.Second
+
+	for i := 1; i <= 9; i++ {
+		timeout.observe("foo", "bar", time.Duration(i)*time.Millisecond)
+	}
+	if d := timeout.Get("foo", "bar", 1); d != time.Second {
+		t.Errorf("Expected the SLA until we've seen enough replies, got %v", d)
+	}
+
+	for i := 10; i <= 20; i++ {
+		timeout.observe("foo", "bar", time.Duration(i)*time.Millisecond)
+	}
+	if d := timeout.Get("foo", "bar", 1); d != 23*time.Millisecond {
+		t.Errorf("Expected the 90th percentile plus margin, got %v", d)
+	}
+	if d := timeout.Get("foo", "bar", 2); d != 46*time.Millisecond {
+		t.Errorf("Expected the learned timeout to back off by attempt, got %v", d)
+	}
+
+	// only the most recent replies count
+	for i := 0; i < 20; i++ {
+		timeout.observe("foo", "bar", 100*time.Millisecond)
+	}
+	if d := timeout.Get("foo", "bar", 1); d != 105*time.Millisecond {
+		t.Errorf("Expected the timeout to follow recent latency, got %v", d)
+	}
+
+	learned := timeout.Learned()
+	if len(learned) != 1 {
+		t.Fatalf("Expected one learned timeout, got %+v", learned)
+	}
+	if lt := learned[0]; lt.Service != "foo" || lt.Endpoint != "bar" || lt.Samples != 20 ||
+		lt.Latency != 100*time.Millisecond || lt.Timeout != 105*time.Millisecond {
+		t.Errorf("Unexpected learned timeout %+v", lt)
+	}
+}
+
+func TestAdaptiveTimeoutLearnsFromTimeouts(t *testing.T) {
+	config.Load(bytes.NewBufferString(`{"hailo":{"platform":{"timeout":{"adaptive":` +
+		`{"enabled":true,"percentile":90,"marginMs":5,"minSamples":10,"windowSize":20}}}}}`))
+	defer config.Load(bytes.NewBufferString(`{}`))
+
+	timeout := NewTimeout(DefaultClient)
+	timeout.add("foo", "bar")
+	timeout.endpoints["foo"]["bar"] = time.Second
+
+	for i := 1; i <= 20; i++ {
+		timeout.observe("foo", "bar", time.Duration(i)*time.Millisecond)
+	}
+	learned := timeout.Get("foo", "bar", 1)
+	if learned != 23*time.Millisecond {
+		t.Fatalf("Expected the 90th percentile plus margin, got %v", learned)
+	}
+
+	// the endpoint goes slow, so every attempt times out; the timeout should grow rather than shrink
+	last := learned
+	for i := 0; i < 5; i++ {
+		d := timeout.Get("foo", "bar", 1)
+		if d < last {
+			t.Fatalf("Expected the timeout not to shrink as attempts time out, went from %v to %v", last, d)
+		}
+		timeout.observeTimeout("foo", "bar", d)
+		last = d
+	}
+	if d := timeout.Get("foo", "bar", 1); d <= learned {
+		t.Errorf("Expected the timeout to grow past %v once the endpoint went slow, got %v", learned, d)
+	}
+}
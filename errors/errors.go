@@ -19,6 +19,7 @@ const (
 	ErrorConflict       = "CONFLICT"
 	ErrorUnauthorized   = "UNAUTHORIZED"
 	ErrorCircuitBroken  = "CIRCUIT_BROKEN"
+	ErrorRateLimited    = "RATE_LIMITED"
 )
 
 // Error represents our customer error type
@@ -248,6 +249,23 @@ func IsCircuitBroken(err error) bool {
 	return isErrorOfType(err, ErrorCircuitBroken)
 }
 
+// RateLimited is returned by a client for a request it didn't send because it was over the rate limit for the
+// endpoint. The service never saw it, so it says nothing about the service, and retrying it straight away won't help
+func RateLimited(code string, errValue interface{}, context ...string) Error {
+	return LocalError{
+		errorType:   ErrorRateLimited,
+		code:        code,
+		description: descriptionFromErrValue(errValue),
+		context:     context,
+		httpCode:    429,
+		multiStack:  stackFromErrValue(errValue),
+	}
+}
+
+func IsRateLimited(err error) bool {
+	return isErrorOfType(err, ErrorRateLimited)
+}
+
 func isErrorOfType(err error, errorType string) bool {
 	localError, ok := err.(LocalError)
 	if !ok {
@@ -56,6 +56,19 @@ func TestConversion(t *testing.T) {
 	}
 }
 
+func TestRateLimitedConversion(t *testing.T) {
+	err := RateLimited("com.HailoOSS.test", "Too fast")
+	err2 := FromProtobuf(ToProtobuf(err))
+
+	if !IsRateLimited(err2) {
+		t.Errorf("Type() does not survive conversion: %#v vs %#v", err, err2)
+	}
+
+	if err.HttpCode() != err2.HttpCode() {
+		t.Errorf("HttpCode() does not match: %#v vs %#v", err, err2)
+	}
+}
+
 func TestErrTypeCheck(t *testing.T) {
 	testCases := []struct {
 		errCreator func(code string, errValue interface{}, context ...string) Error
@@ -85,6 +98,10 @@ func TestErrTypeCheck(t *testing.T) {
 			errCreator: NotFound,
 			errChecker: IsNotFound,
 		},
+		{
+			errCreator: RateLimited,
+			errChecker: IsRateLimited,
+		},
 	}
 
 	randomError := errors.New("Random")
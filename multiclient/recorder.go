@@ -0,0 +1,23 @@
+package multiclient
+
+import (
+	"github.com/HailoOSS/protobuf/proto"
+
+	"github.com/HailoOSS/platform/client"
+	"github.com/HailoOSS/platform/errors"
+)
+
+// RecordingCaller wraps a caller, recording every request made through it so they can be saved to a golden file
+func RecordingCaller(rec *client.Recorder, c Caller) Caller {
+	return func(req *client.Request, rsp proto.Message) errors.Error {
+		err := c(req, rsp)
+		rec.Record(req, rsp, err)
+		return err
+	}
+}
+
+// ReplayCaller serves back recorded responses rather than making any requests
+// Requests that weren't recorded get a `NotFound` error with code "replay.notfound"
+func ReplayCaller(r *client.Replayer) Caller {
+	return r.Replay
+}
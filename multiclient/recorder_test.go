@@ -0,0 +1,57 @@
+package multiclient
+
+import (
+	"testing"
+
+	"github.com/HailoOSS/protobuf/proto"
+
+	"github.com/HailoOSS/platform/client"
+	"github.com/HailoOSS/platform/errors"
+	"github.com/stretchr/testify/assert"
+
+	hcproto "github.com/HailoOSS/platform/proto/healthcheck"
+)
+
+func TestRecordingAndReplayCaller(t *testing.T) {
+	stub := &Stub{
+		Service:  mockFooService,
+		Endpoint: mockHealthEndpoint,
+		Response: &hcproto.Response{
+			Healthchecks: []*hcproto.HealthCheck{
+				{
+					Timestamp:      proto.Int64(1403629015),
+					ServiceName:    proto.String("foo"),
+					ServiceVersion: proto.Uint64(1403629015),
+					Hostname:       proto.String("localhost"),
+					InstanceId:     proto.String("foobar"),
+					HealthCheckId:  proto.String("boom"),
+					IsHealthy:      proto.Bool(true),
+				},
+			},
+		},
+	}
+	rec := client.NewRecorder()
+	caller := RecordingCaller(rec, NewMock().Stub(stub).Caller())
+
+	req, _ := client.NewRequest(mockFooService, mockHealthEndpoint, &hcproto.Request{})
+	e := caller(req, &hcproto.Response{})
+	assert.Nil(t, e, "Expecting stubbed response to be recorded, got err: %v", e)
+	missing, _ := client.NewRequest(mockFooService, "baz", &hcproto.Request{})
+	e = caller(missing, &hcproto.Response{})
+	assert.NotNil(t, e, "Expecting unstubbed endpoint to trigger an error")
+	assert.Len(t, rec.Recordings(), 2, "Expecting both calls to be recorded")
+
+	replay := ReplayCaller(client.NewReplayer(rec.Recordings()))
+	rsp := &hcproto.Response{}
+	e = replay(req, rsp)
+	assert.Nil(t, e, "Expecting recorded response to be replayed, got err: %v", e)
+	assert.Len(t, rsp.GetHealthchecks(), 1,
+		"Replayed response does not contain our recorded content: no healthchecks")
+	assert.Equal(t, rsp.GetHealthchecks()[0].GetHealthCheckId(), "boom",
+		"Replayed response does not contain our recorded content")
+
+	e = replay(missing, &hcproto.Response{})
+	assert.NotNil(t, e, "Expecting recorded error to be replayed")
+	assert.Equal(t, e.Code(), "mock.notfound", "Expecting recorded error code to be replayed")
+	assert.Equal(t, e.Type(), errors.ErrorNotFound, "Expecting recorded error type to be replayed")
+}
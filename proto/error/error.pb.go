@@ -32,6 +32,7 @@ const (
 	PlatformError_FORBIDDEN             PlatformError_ErrorType = 5
 	PlatformError_NOT_FOUND             PlatformError_ErrorType = 6
 	PlatformError_CONFLICT              PlatformError_ErrorType = 7
+	PlatformError_RATE_LIMITED          PlatformError_ErrorType = 8
 )
 
 var PlatformError_ErrorType_name = map[int32]string{
@@ -42,6 +43,7 @@ var PlatformError_ErrorType_name = map[int32]string{
 	5: "FORBIDDEN",
 	6: "NOT_FOUND",
 	7: "CONFLICT",
+	8: "RATE_LIMITED",
 }
 var PlatformError_ErrorType_value = map[string]int32{
 	"INTERNAL_SERVER_ERROR": 1,
@@ -51,6 +53,7 @@ var PlatformError_ErrorType_value = map[string]int32{
 	"FORBIDDEN":             5,
 	"NOT_FOUND":             6,
 	"CONFLICT":              7,
+	"RATE_LIMITED":          8,
 }
 
 func (x PlatformError_ErrorType) Enum() *PlatformError_ErrorType {
@@ -14,6 +14,7 @@ It has these top-level messages:
 	EndpointStats
 	RusageStats
 	RuntimeStats
+	RetryBudget
 	PlatformStats
 	Request
 */
@@ -252,6 +253,46 @@ func (m *RuntimeStats) GetNumGoRoutines() uint32 {
 	return 0
 }
 
+type RetryBudget struct {
+	Service          *string  `protobuf:"bytes,1,req,name=service" json:"service,omitempty"`
+	Tokens           *float32 `protobuf:"fixed32,2,req,name=tokens" json:"tokens,omitempty"`
+	Retries          *uint64  `protobuf:"varint,3,req,name=retries" json:"retries,omitempty"`
+	Dropped          *uint64  `protobuf:"varint,4,req,name=dropped" json:"dropped,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *RetryBudget) Reset()         { *m = RetryBudget{} }
+func (m *RetryBudget) String() string { return proto.CompactTextString(m) }
+func (*RetryBudget) ProtoMessage()    {}
+
+func (m *RetryBudget) GetService() string {
+	if m != nil && m.Service != nil {
+		return *m.Service
+	}
+	return ""
+}
+
+func (m *RetryBudget) GetTokens() float32 {
+	if m != nil && m.Tokens != nil {
+		return *m.Tokens
+	}
+	return 0
+}
+
+func (m *RetryBudget) GetRetries() uint64 {
+	if m != nil && m.Retries != nil {
+		return *m.Retries
+	}
+	return 0
+}
+
+func (m *RetryBudget) GetDropped() uint64 {
+	if m != nil && m.Dropped != nil {
+		return *m.Dropped
+	}
+	return 0
+}
+
 type PlatformStats struct {
 	ServiceName      *string          `protobuf:"bytes,1,req,name=serviceName" json:"serviceName,omitempty"`
 	ServiceVersion   *uint64          `protobuf:"varint,2,req,name=serviceVersion" json:"serviceVersion,omitempty"`
@@ -265,6 +306,8 @@ type PlatformStats struct {
 	Endpoints        []*EndpointStats `protobuf:"bytes,10,rep,name=endpoints" json:"endpoints,omitempty"`
 	ServiceType      *string          `protobuf:"bytes,11,opt,name=serviceType" json:"serviceType,omitempty"`
 	AzName           *string          `protobuf:"bytes,12,opt,name=azName" json:"azName,omitempty"`
+	BrokerNode       *string          `protobuf:"bytes,13,opt,name=brokerNode" json:"brokerNode,omitempty"`
+	RetryBudgets     []*RetryBudget   `protobuf:"bytes,14,rep,name=retryBudgets" json:"retryBudgets,omitempty"`
 	XXX_unrecognized []byte           `json:"-"`
 }
 
@@ -356,6 +399,20 @@ func (m *PlatformStats) GetAzName() string {
 	return ""
 }
 
+func (m *PlatformStats) GetBrokerNode() string {
+	if m != nil && m.BrokerNode != nil {
+		return *m.BrokerNode
+	}
+	return ""
+}
+
+func (m *PlatformStats) GetRetryBudgets() []*RetryBudget {
+	if m != nil {
+		return m.RetryBudgets
+	}
+	return nil
+}
+
 type Request struct {
 	XXX_unrecognized []byte `json:"-"`
 }
@@ -0,0 +1,402 @@
+package raven
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/streadway/amqp"
+)
+
+const (
+	// exchange kinds understood by the MemoryBroker
+	ExchangeDirect  = "direct"
+	ExchangeTopic   = "topic"
+	ExchangeHeaders = "headers"
+	ExchangeFanout  = "fanout"
+)
+
+// MemoryBroker is an in-process message broker which reproduces the exchange, binding and queue semantics that the
+// platform relies on from RabbitMQ, so that services and clients can talk to each other without a real broker
+type MemoryBroker struct {
+	sync.RWMutex
+	exchanges map[string]*memoryExchange
+	queues    map[string]*memoryQueue
+}
+
+type memoryExchange struct {
+	name     string
+	kind     string
+	bindings []*memoryBinding
+}
+
+type memoryBinding struct {
+	queue string
+	key   string
+	args  amqp.Table
+}
+
+// memoryMessage is a single message sitting on a queue
+type memoryMessage struct {
+	exchange   string
+	routingKey string
+	publishing amqp.Publishing
+	enqueued   time.Time
+}
+
+// NewMemoryBroker mints a broker with the h2o headers exchange, the h2o.direct reply exchange and the h2o.topic topic
+// exchange already declared
+func NewMemoryBroker() *MemoryBroker {
+	b := &MemoryBroker{
+		exchanges: make(map[string]*memoryExchange),
+		queues:    make(map[string]*memoryQueue),
+	}
+
+	b.ExchangeDeclare(EXCHANGE, ExchangeHeaders)
+	b.ExchangeDeclare(REPLY_EXCHANGE, ExchangeDirect)
+	b.ExchangeDeclare(TOPIC_EXCHANGE, ExchangeTopic)
+
+	return b
+}
+
+// ExchangeDeclare declares an exchange of the given kind, which is a no-op if it already exists with the same kind
+func (b *MemoryBroker) ExchangeDeclare(name, kind string) error {
+	switch kind {
+	case ExchangeDirect, ExchangeTopic, ExchangeHeaders, ExchangeFanout:
+	default:
+		return fmt.Errorf("[Raven] Unknown exchange kind \"%s\"", kind)
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if ex, ok := b.exchanges[name]; ok {
+		if ex.kind != kind {
+			return fmt.Errorf("[Raven] Exchange \"%s\" already declared as %s", name, ex.kind)
+		}
+		return nil
+	}
+	b.exchanges[name] = &memoryExchange{name: name, kind: kind}
+
+	return nil
+}
+
+// QueueDeclare declares a queue, which is a no-op if it already exists. The x-message-ttl, x-expires,
+// x-dead-letter-exchange and x-dead-letter-routing-key arguments are honoured, as is auto-delete once the last
+// consumer goes away. So is the expiration of messages published to it
+func (b *MemoryBroker) QueueDeclare(name string, autoDelete bool, args amqp.Table) error {
+	if len(name) == 0 {
+		return fmt.Errorf("[Raven] Cannot declare queue with no name")
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if q, ok := b.queues[name]; ok {
+		// redeclaring counts as using the queue
+		q.touch()
+		return nil
+	}
+
+	q := newMemoryQueue(b, name, autoDelete, args)
+	b.queues[name] = q
+	q.touch()
+
+	log.Tracef("[Raven] Memory broker declared queue \"%s\"", name)
+	return nil
+}
+
+// QueueDelete removes a queue and its bindings, closing the deliveries channel of anything consuming from it
+func (b *MemoryBroker) QueueDelete(name string) error {
+	b.Lock()
+	q, ok := b.queues[name]
+	if ok {
+		b.removeQueue(q)
+	}
+	b.Unlock()
+
+	if !ok {
+		return fmt.Errorf("[Raven] No queue \"%s\"", name)
+	}
+	q.delete()
+
+	return nil
+}
+
+// QueueBind binds a queue to an exchange, using the routing key and/or arguments depending on the exchange kind
+func (b *MemoryBroker) QueueBind(queue, key, exchange string, args amqp.Table) error {
+	b.Lock()
+	defer b.Unlock()
+
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return fmt.Errorf("[Raven] No exchange \"%s\"", exchange)
+	}
+	if _, ok := b.queues[queue]; !ok {
+		return fmt.Errorf("[Raven] No queue \"%s\"", queue)
+	}
+
+	for _, binding := range ex.bindings {
+		if binding.queue == queue && binding.key == key && tablesEqual(binding.args, args) {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, &memoryBinding{queue: queue, key: key, args: args})
+
+	return nil
+}
+
+// QueueUnbind removes a binding previously made with QueueBind
+func (b *MemoryBroker) QueueUnbind(queue, key, exchange string, args amqp.Table) error {
+	b.Lock()
+	defer b.Unlock()
+
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return fmt.Errorf("[Raven] No exchange \"%s\"", exchange)
+	}
+
+	for i, binding := range ex.bindings {
+		if binding.queue == queue && binding.key == key && tablesEqual(binding.args, args) {
+			ex.bindings = append(ex.bindings[:i], ex.bindings[i+1:]...)
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// Publish routes a message through an exchange onto all matching queues, returning how many queues it landed on. As
+// with AMQP, publishing to the "" exchange routes directly to the queue named by the routing key
+func (b *MemoryBroker) Publish(exchange, key string, msg amqp.Publishing) (int, error) {
+	b.RLock()
+	var targets []*memoryQueue
+	if exchange == "" {
+		if q, ok := b.queues[key]; ok {
+			targets = append(targets, q)
+		}
+	} else {
+		ex, ok := b.exchanges[exchange]
+		if !ok {
+			b.RUnlock()
+			return 0, fmt.Errorf("[Raven] No exchange \"%s\"", exchange)
+		}
+		seen := make(map[string]bool)
+		for _, binding := range ex.bindings {
+			if seen[binding.queue] || !ex.matches(binding, key, msg.Headers) {
+				continue
+			}
+			if q, ok := b.queues[binding.queue]; ok {
+				seen[binding.queue] = true
+				targets = append(targets, q)
+			}
+		}
+	}
+	b.RUnlock()
+
+	now := time.Now()
+	for _, q := range targets {
+		q.enqueue(&memoryMessage{
+			exchange:   exchange,
+			routingKey: key,
+			publishing: msg,
+			enqueued:   now,
+		})
+	}
+
+	return len(targets), nil
+}
+
+// Consume starts consuming from a queue; the returned channel is closed when the consumer is cancelled or the queue
+// is deleted. Without autoAck each delivery must be acked, and anything unacked is requeued when the consumer goes
+func (b *MemoryBroker) Consume(queue, consumerTag string, autoAck bool) (<-chan amqp.Delivery, error) {
+	b.RLock()
+	q, ok := b.queues[queue]
+	b.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("[Raven] No queue \"%s\"", queue)
+	}
+
+	return q.consume(consumerTag, autoAck)
+}
+
+// SetPrefetch limits how many unacked deliveries a consumer can have at once, zero meaning no limit
+func (b *MemoryBroker) SetPrefetch(queue, consumerTag string, count int) error {
+	b.RLock()
+	q, ok := b.queues[queue]
+	b.RUnlock()
+	if !ok {
+		return fmt.Errorf("[Raven] No queue \"%s\"", queue)
+	}
+
+	return q.setPrefetch(consumerTag, count)
+}
+
+// Cancel stops a consumer, closing its deliveries channel
+func (b *MemoryBroker) Cancel(queue, consumerTag string) error {
+	b.RLock()
+	q, ok := b.queues[queue]
+	b.RUnlock()
+	if !ok {
+		return fmt.Errorf("[Raven] No queue \"%s\"", queue)
+	}
+
+	return q.cancel(consumerTag)
+}
+
+// QueueLength returns how many messages are waiting on a queue, and whether the queue exists at all
+func (b *MemoryBroker) QueueLength(name string) (int, bool) {
+	b.RLock()
+	q, ok := b.queues[name]
+	b.RUnlock()
+	if !ok {
+		return 0, false
+	}
+
+	return q.length(), true
+}
+
+// removeQueue forgets about a queue and any bindings to it - must be called with the write lock held
+func (b *MemoryBroker) removeQueue(q *memoryQueue) {
+	if existing, ok := b.queues[q.name]; !ok || existing != q {
+		return
+	}
+	delete(b.queues, q.name)
+
+	for _, ex := range b.exchanges {
+		bindings := ex.bindings[:0]
+		for _, binding := range ex.bindings {
+			if binding.queue != q.name {
+				bindings = append(bindings, binding)
+			}
+		}
+		ex.bindings = bindings
+	}
+
+	log.Tracef("[Raven] Memory broker removed queue \"%s\"", q.name)
+}
+
+// expire deletes a queue if it is still unused once its x-expires period has passed
+func (b *MemoryBroker) expire(q *memoryQueue) {
+	b.Lock()
+	if !q.unusedFor(q.expires) {
+		b.Unlock()
+		return
+	}
+	b.removeQueue(q)
+	b.Unlock()
+
+	q.delete()
+}
+
+// autoDelete deletes a queue once it has had at least one consumer, and the last one has gone away
+func (b *MemoryBroker) autoDelete(q *memoryQueue) {
+	b.Lock()
+	b.removeQueue(q)
+	b.Unlock()
+
+	q.delete()
+}
+
+// matches decides if a message should be routed down a binding
+func (ex *memoryExchange) matches(binding *memoryBinding, key string, headers amqp.Table) bool {
+	switch ex.kind {
+	case ExchangeFanout:
+		return true
+	case ExchangeDirect:
+		return binding.key == key
+	case ExchangeTopic:
+		return topicMatches(binding.key, key)
+	case ExchangeHeaders:
+		return headersMatch(binding.args, headers)
+	}
+
+	return false
+}
+
+// topicMatches implements AMQP topic matching, where "*" matches exactly one word and "#" matches zero or more words
+func topicMatches(pattern, key string) bool {
+	return wordsMatch(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func wordsMatch(pattern, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		// try consuming zero or more words
+		for i := 0; i <= len(key); i++ {
+			if wordsMatch(pattern[1:], key[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(key) > 0 && wordsMatch(pattern[1:], key[1:])
+	default:
+		return len(key) > 0 && pattern[0] == key[0] && wordsMatch(pattern[1:], key[1:])
+	}
+}
+
+// headersMatch implements headers exchange matching, where x-match decides if all (the default) or any of the
+// binding arguments must be present with the same value in the message headers
+func headersMatch(args, headers amqp.Table) bool {
+	matchAny := false
+	if v, ok := args["x-match"]; ok && v == "any" {
+		matchAny = true
+	}
+
+	checked := 0
+	for k, v := range args {
+		if strings.HasPrefix(k, "x-") {
+			continue
+		}
+		checked++
+
+		hv, ok := headers[k]
+		matched := ok && hv == v
+		if matchAny && matched {
+			return true
+		}
+		if !matchAny && !matched {
+			return false
+		}
+	}
+
+	// with nothing to check, "all" trivially matches but "any" does not
+	return !matchAny || checked == 0
+}
+
+// tableDuration reads a millisecond argument (eg: x-message-ttl) from a table, whatever integer type it was sent as
+func tableDuration(args amqp.Table, key string) time.Duration {
+	var ms int64
+	switch v := args[key].(type) {
+	case int:
+		ms = int64(v)
+	case int32:
+		ms = int64(v)
+	case int64:
+		ms = v
+	default:
+		return 0
+	}
+
+	return time.Duration(ms) * time.Millisecond
+}
+
+func tablesEqual(a, b amqp.Table) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+
+	return true
+}
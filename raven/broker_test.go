@@ -0,0 +1,414 @@
+package raven
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestTopicMatches(t *testing.T) {
+	testCases := []struct {
+		pattern, key string
+		matches      bool
+	}{
+		{"com.hailo.foo", "com.hailo.foo", true},
+		{"com.hailo.foo", "com.hailo.bar", false},
+		{"com.*.foo", "com.hailo.foo", true},
+		{"com.*.foo", "com.hailo.baz.foo", false},
+		{"com.#", "com.hailo.baz.foo", true},
+		{"com.#", "com", true},
+		{"#.foo", "com.hailo.foo", true},
+		{"#", "anything.at.all", true},
+		{"com.#.foo", "com.foo", true},
+		{"com.#.foo", "com.a.b.foo", true},
+		{"com.#.foo", "com.a.b.bar", false},
+		{"*", "com.hailo", false},
+	}
+
+	for _, tc := range testCases {
+		if m := topicMatches(tc.pattern, tc.key); m != tc.matches {
+			t.Errorf("Topic %s against pattern %s: expected %v, got %v", tc.key, tc.pattern, tc.matches, m)
+		}
+	}
+}
+
+func TestHeadersMatch(t *testing.T) {
+	args := amqp.Table{"service": "com.hailo.foo", "x-match": "all"}
+
+	if !headersMatch(args, amqp.Table{"service": "com.hailo.foo", "endpoint": "bar"}) {
+		t.Error("Headers with matching service should match")
+	}
+	if headersMatch(args, amqp.Table{"service": "com.hailo.bar"}) {
+		t.Error("Headers with a different service should not match")
+	}
+	if headersMatch(args, amqp.Table{}) {
+		t.Error("Headers missing the service should not match")
+	}
+
+	anyArgs := amqp.Table{"service": "com.hailo.foo", "endpoint": "bar", "x-match": "any"}
+	if !headersMatch(anyArgs, amqp.Table{"endpoint": "bar"}) {
+		t.Error("x-match any should match on a single header")
+	}
+}
+
+func TestBrokerRoutesToBoundQueues(t *testing.T) {
+	b := NewMemoryBroker()
+	b.QueueDeclare("service-a", false, nil)
+	b.QueueDeclare("service-b", false, nil)
+	b.QueueDeclare("instance", false, nil)
+	b.QueueBind("service-a", "com.hailo.a", EXCHANGE, serviceBindingArgs("com.hailo.a"))
+	b.QueueBind("service-b", "com.hailo.b", EXCHANGE, serviceBindingArgs("com.hailo.b"))
+	b.QueueBind("instance", "instance", REPLY_EXCHANGE, nil)
+	b.QueueBind("service-a", "com.hailo.event.#", TOPIC_EXCHANGE, nil)
+
+	if n, _ := b.Publish(EXCHANGE, "", amqp.Publishing{Headers: amqp.Table{"service": "com.hailo.a"}}); n != 1 {
+		t.Errorf("Expected request to be routed to 1 queue, got %d", n)
+	}
+	if n, _ := b.Publish(REPLY_EXCHANGE, "instance", amqp.Publishing{}); n != 1 {
+		t.Errorf("Expected reply to be routed to 1 queue, got %d", n)
+	}
+	if n, _ := b.Publish(TOPIC_EXCHANGE, "com.hailo.event.created", amqp.Publishing{}); n != 1 {
+		t.Errorf("Expected publication to be routed to 1 queue, got %d", n)
+	}
+	if n, _ := b.Publish(EXCHANGE, "", amqp.Publishing{Headers: amqp.Table{"service": "com.hailo.c"}}); n != 0 {
+		t.Errorf("Expected request to unknown service to be unroutable, got %d", n)
+	}
+
+	if l, _ := b.QueueLength("service-a"); l != 2 {
+		t.Errorf("Expected 2 messages on service-a, got %d", l)
+	}
+	if l, _ := b.QueueLength("service-b"); l != 0 {
+		t.Errorf("Expected 0 messages on service-b, got %d", l)
+	}
+}
+
+func TestBrokerMessageTTL(t *testing.T) {
+	b := NewMemoryBroker()
+	b.QueueDeclare("q", false, amqp.Table{"x-message-ttl": int32(20)})
+	b.QueueBind("q", "q", REPLY_EXCHANGE, nil)
+	b.Publish(REPLY_EXCHANGE, "q", amqp.Publishing{MessageId: "stale"})
+
+	time.Sleep(40 * time.Millisecond)
+	b.Publish(REPLY_EXCHANGE, "q", amqp.Publishing{MessageId: "fresh"})
+
+	deliveries, err := b.Consume("q", "consumer", true)
+	if err != nil {
+		t.Fatalf("Unexpected error consuming: %v", err)
+	}
+
+	select {
+	case d := <-deliveries:
+		if d.MessageId != "fresh" {
+			t.Errorf("Expected stale message to have expired, got %s", d.MessageId)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for delivery")
+	}
+}
+
+func TestBrokerDeadLettersExpiredMessages(t *testing.T) {
+	b := NewMemoryBroker()
+	b.QueueDeclare("q", false, nil)
+	b.QueueDeclare("q.retry", false, amqp.Table{"x-dead-letter-exchange": "", "x-dead-letter-routing-key": "q"})
+	b.Publish("", "q.retry", amqp.Publishing{MessageId: "1", Expiration: "20"})
+
+	if l, _ := b.QueueLength("q.retry"); l != 1 {
+		t.Errorf("Expected the message to wait on the retry queue, got %d", l)
+	}
+
+	// nothing is consuming from the retry queue, but the message should still move on once it expires
+	time.Sleep(50 * time.Millisecond)
+	if l, _ := b.QueueLength("q.retry"); l != 0 {
+		t.Errorf("Expected the message to have expired, got %d", l)
+	}
+	deliveries, _ := b.Consume("q", "consumer", true)
+	select {
+	case d := <-deliveries:
+		if d.MessageId != "1" || d.Expiration != "" {
+			t.Errorf("Expected message 1 without an expiration, got %s expiring in %s", d.MessageId, d.Expiration)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the dead lettered message")
+	}
+}
+
+func TestBrokerDeadLettersRejectedMessages(t *testing.T) {
+	b := NewMemoryBroker()
+	b.QueueDeclare("q", false, amqp.Table{"x-dead-letter-exchange": "", "x-dead-letter-routing-key": "q.dead"})
+	b.QueueDeclare("q.dead", false, nil)
+	b.Publish("", "q", amqp.Publishing{MessageId: "1"})
+	b.Publish("", "q", amqp.Publishing{MessageId: "2"})
+
+	deliveries, _ := b.Consume("q", "consumer", false)
+	for i := 0; i < 2; i++ {
+		select {
+		case d := <-deliveries:
+			if err := d.Nack(false, false); err != nil {
+				t.Fatalf("Unexpected error rejecting: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for delivery")
+		}
+	}
+
+	dead, _ := b.Consume("q.dead", "consumer", true)
+	for _, id := range []string{"1", "2"} {
+		select {
+		case d := <-dead:
+			if d.MessageId != id {
+				t.Errorf("Expected rejected message %s to be dead lettered, got %s", id, d.MessageId)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for the dead lettered message")
+		}
+	}
+	if l, _ := b.QueueLength("q"); l != 0 {
+		t.Errorf("Expected rejected messages not to be requeued, got %d", l)
+	}
+}
+
+func TestBrokerAutoDelete(t *testing.T) {
+	b := NewMemoryBroker()
+	b.QueueDeclare("q", true, nil)
+	b.QueueBind("q", "q", REPLY_EXCHANGE, nil)
+
+	deliveries, _ := b.Consume("q", "consumer", true)
+	if err := b.Cancel("q", "consumer"); err != nil {
+		t.Fatalf("Unexpected error cancelling: %v", err)
+	}
+
+	if _, ok := <-deliveries; ok {
+		t.Error("Deliveries channel should be closed once cancelled")
+	}
+	if _, exists := b.QueueLength("q"); exists {
+		t.Error("Queue should have been auto-deleted after its last consumer went away")
+	}
+	if n, _ := b.Publish(REPLY_EXCHANGE, "q", amqp.Publishing{}); n != 0 {
+		t.Error("Bindings should have been removed with the queue")
+	}
+}
+
+func TestBrokerQueueExpires(t *testing.T) {
+	b := NewMemoryBroker()
+	b.QueueDeclare("q", false, amqp.Table{"x-expires": int32(20)})
+
+	time.Sleep(50 * time.Millisecond)
+	if _, exists := b.QueueLength("q"); exists {
+		t.Error("Unused queue should have expired")
+	}
+}
+
+func TestMemoryTransportConsume(t *testing.T) {
+	tr := NewMemoryTransport(NewMemoryBroker())
+	if _, err := tr.Consume("instance"); err == nil {
+		t.Error("Expected error consuming before connecting")
+	}
+
+	tr.Connect()
+	if !tr.IsConnected() {
+		t.Fatal("Memory transport should connect immediately")
+	}
+	deliveries, err := tr.Consume("instance")
+	if err != nil {
+		t.Fatalf("Unexpected error consuming: %v", err)
+	}
+	if err := tr.BindService("com.hailo.foo", "instance"); err != nil {
+		t.Fatalf("Unexpected error binding: %v", err)
+	}
+
+	tr.Broker().Publish(EXCHANGE, "", amqp.Publishing{
+		Headers:   amqp.Table{"service": "com.hailo.foo"},
+		MessageId: "123",
+	})
+
+	select {
+	case d := <-deliveries:
+		if d.MessageId != "123" {
+			t.Errorf("Expected message 123, got %s", d.MessageId)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for delivery")
+	}
+
+	tr.Disconnect()
+	if _, ok := <-deliveries; ok {
+		t.Error("Deliveries channel should be closed on disconnect")
+	}
+}
+
+func TestMemoryTransportReconnect(t *testing.T) {
+	tr := NewMemoryTransport(NewMemoryBroker())
+	changes := tr.Subscribe()
+	tr.Connect()
+
+	deliveries, err := tr.Consume("instance")
+	if err != nil {
+		t.Fatalf("Unexpected error consuming: %v", err)
+	}
+	if err := tr.BindService("com.hailo.foo", "instance"); err != nil {
+		t.Fatalf("Unexpected error binding: %v", err)
+	}
+	if err := tr.Reconnect(fmt.Errorf("connection reset")); err != nil {
+		t.Fatalf("Unexpected error reconnecting: %v", err)
+	}
+
+	expected := []State{StateConnecting, StateConnected, StateDisconnected, StateConnecting, StateConnected}
+	for _, s := range expected {
+		select {
+		case change := <-changes:
+			if change.To != s {
+				t.Errorf("Expected change to %v, got %v", s, change.To)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for change to %v", s)
+		}
+	}
+
+	// the service binding should have been re-established, and delivered down the same channel
+	tr.Broker().Publish(EXCHANGE, "", amqp.Publishing{
+		Headers:   amqp.Table{"service": "com.hailo.foo"},
+		MessageId: "123",
+	})
+	select {
+	case d := <-deliveries:
+		if d.MessageId != "123" {
+			t.Errorf("Expected message 123, got %s", d.MessageId)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for delivery after reconnecting")
+	}
+
+	tr.Unsubscribe(changes)
+	if _, ok := <-changes; ok {
+		t.Error("Changes channel should be closed once unsubscribed")
+	}
+}
+
+func TestBrokerManualAck(t *testing.T) {
+	b := NewMemoryBroker()
+	b.QueueDeclare("q", false, nil)
+	b.Publish("", "q", amqp.Publishing{MessageId: "1"})
+
+	deliveries, _ := b.Consume("q", "consumer", false)
+	d := <-deliveries
+	if err := d.Nack(false, true); err != nil {
+		t.Fatalf("Unexpected error nacking: %v", err)
+	}
+
+	// the nacked message should come straight back
+	d = <-deliveries
+	if d.MessageId != "1" {
+		t.Errorf("Expected requeued message 1, got %s", d.MessageId)
+	}
+
+	// cancelling with the delivery unacked should put it back on the queue
+	b.Cancel("q", "consumer")
+	if l, _ := b.QueueLength("q"); l != 1 {
+		t.Errorf("Expected unacked message back on the queue, got %d", l)
+	}
+
+	deliveries, _ = b.Consume("q", "consumer", false)
+	d = <-deliveries
+	if err := d.Ack(false); err != nil {
+		t.Fatalf("Unexpected error acking: %v", err)
+	}
+	if err := d.Ack(false); err == nil {
+		t.Error("Expected error acking the same delivery twice")
+	}
+	b.Cancel("q", "consumer")
+	if l, _ := b.QueueLength("q"); l != 0 {
+		t.Errorf("Expected acked message to be gone, got %d", l)
+	}
+}
+
+func TestMemoryTransportPrefetch(t *testing.T) {
+	tr := NewMemoryTransport(NewMemoryBroker())
+	tr.Connect()
+	tr.SetPrefetch(1)
+
+	deliveries, err := tr.ConsumeWithAck("instance")
+	if err != nil {
+		t.Fatalf("Unexpected error consuming: %v", err)
+	}
+	for _, id := range []string{"1", "2"} {
+		tr.Broker().Publish(REPLY_EXCHANGE, "instance", amqp.Publishing{MessageId: id})
+	}
+
+	d := <-deliveries
+	select {
+	case <-deliveries:
+		t.Fatal("Should not get a second delivery until the first is acked")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if l, _ := tr.Broker().QueueLength("instance"); l != 1 {
+		t.Errorf("Expected the second message to stay in the broker, got %d", l)
+	}
+
+	d.Ack(false)
+	select {
+	case d = <-deliveries:
+		if d.MessageId != "2" {
+			t.Errorf("Expected message 2, got %s", d.MessageId)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the second delivery")
+	}
+}
+
+func TestMemoryTransportPrefetchPerConsumer(t *testing.T) {
+	tr := NewMemoryTransport(NewMemoryBroker())
+	tr.Connect()
+	defer tr.Disconnect()
+	tr.SetPrefetch(1)
+
+	busy, _ := tr.ConsumeWithAck("busy")
+	idle, _ := tr.ConsumeWithAck("idle")
+	for _, queue := range []string{"busy", "idle"} {
+		tr.Broker().Publish(REPLY_EXCHANGE, queue, amqp.Publishing{MessageId: queue})
+	}
+
+	// leaving the busy queue's delivery unacked uses up its prefetch, but not the other queue's
+	<-busy
+	select {
+	case d := <-idle:
+		if d.MessageId != "idle" {
+			t.Errorf("Expected the idle queue's message, got %s", d.MessageId)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a delivery on one queue while another is at its prefetch limit")
+	}
+}
+
+type testPublication string
+
+func (p testPublication) ContentType() string { return "application/json" }
+func (p testPublication) Topic() string       { return string(p) }
+func (p testPublication) MessageID() string   { return "1" }
+func (p testPublication) Payload() []byte     { return []byte(`{}`) }
+func (p testPublication) SessionID() string   { return "" }
+
+func TestMemoryTransportDurablePublicationsArePersistent(t *testing.T) {
+	tr := NewMemoryTransport(NewMemoryBroker())
+	tr.Connect()
+	defer tr.Disconnect()
+
+	deliveries, err := tr.ConsumeDurable("service.created", "event.created")
+	if err != nil {
+		t.Fatalf("Unexpected error consuming: %v", err)
+	}
+	if err := tr.SendPublication(testPublication("event.created"), "instance"); err != nil {
+		t.Fatalf("Unexpected error publishing: %v", err)
+	}
+
+	select {
+	case d := <-deliveries:
+		if d.DeliveryMode != amqp.Persistent {
+			t.Errorf("Expected a persistent publication, got delivery mode %d", d.DeliveryMode)
+		}
+		d.Ack(false)
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the publication")
+	}
+}
@@ -0,0 +1,63 @@
+package raven
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/HailoOSS/service/config"
+	"github.com/streadway/amqp"
+)
+
+var (
+	// AmqpUris is an ordered list of broker URIs, eg: the nodes of a RabbitMQ cluster. We connect to the first that
+	// works, and fail over to the next when the connection is lost. Taken from RABBITMQ_URLS if set
+	AmqpUris []string
+
+	amqpUrisFlag = flag.String("amqp-uris", "", "Comma separated, ordered list of AMQP URIs to connect to")
+)
+
+func init() {
+	if urls := os.Getenv("RABBITMQ_URLS"); urls != "" {
+		AmqpUris = splitUris(urls)
+	}
+}
+
+// brokerUris returns the brokers to try in order, looked up each time we connect so flags and config are picked up.
+// The -amqp-uris flag wins, then RABBITMQ_URLS, then hailo.platform.raven.brokers from the config service, falling
+// back to the single AmqpUri
+func brokerUris() []string {
+	if uris := splitUris(*amqpUrisFlag); len(uris) > 0 {
+		return uris
+	}
+	if len(AmqpUris) > 0 {
+		return AmqpUris
+	}
+	if uris := config.AtPath("hailo", "platform", "raven", "brokers").AsStringArray(); len(uris) > 0 {
+		return uris
+	}
+
+	return []string{AmqpUri}
+}
+
+func splitUris(s string) []string {
+	var uris []string
+	for _, uri := range strings.Split(s, ",") {
+		if uri = strings.TrimSpace(uri); uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+
+	return uris
+}
+
+// nodeName gives a host:port for a broker URI, so we can say where we are connected without leaking credentials
+func nodeName(uri string) string {
+	u, err := amqp.ParseURI(uri)
+	if err != nil {
+		return "unknown"
+	}
+
+	return fmt.Sprintf("%s:%d", u.Host, u.Port)
+}
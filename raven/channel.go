@@ -12,6 +12,9 @@ type AMQPChannel struct {
 	name    string
 	conn    *AMQPConnection
 	channel *amqp.Channel
+	// confirmable channels go into confirm mode when confirms are enabled
+	confirmable bool
+	confirms    *confirmer
 }
 
 func (self *AMQPChannel) connect() (err error) {
@@ -19,19 +22,50 @@ func (self *AMQPChannel) connect() (err error) {
 	defer self.Unlock()
 
 	// get the channel
-	if self.channel, err = self.conn.Channel(); err == nil {
-		log.Debugf("[Raven] Channel \"%s\" connected", self.name)
+	if self.channel, err = self.conn.Channel(); err != nil {
+		return
 	}
 
+	self.confirms = nil
+	if self.confirmable && confirmsEnabled() {
+		if self.confirms, err = newConfirmer(self.channel); err != nil {
+			self.channel.Close()
+			return
+		}
+	}
+	log.Debugf("[Raven] Channel \"%s\" connected, confirms: %v", self.name, self.confirms != nil)
+
 	return
 }
 
+// publish sends a message on the channel. If confirm is set and the channel is in confirm mode, the message is
+// published as mandatory and we wait for the broker to confirm it, getting ErrNoRoute back if it was unroutable
+func (self *AMQPChannel) publish(exchange, key string, confirm bool, msg amqp.Publishing) error {
+	self.RLock()
+	ch, confirms := self.channel, self.confirms
+	self.RUnlock()
+
+	if confirms == nil {
+		return ch.Publish(exchange, key, false, false, msg)
+	}
+
+	return confirms.publish(ch, exchange, key, confirm, msg)
+}
+
+// Channel returns the underlying AMQP channel, which is replaced each time we reconnect
+func (self *AMQPChannel) Channel() *amqp.Channel {
+	self.RLock()
+	defer self.RUnlock()
+
+	return self.channel
+}
+
 // NotifyClose allows us to listen for the channel closing
 func (self *AMQPChannel) NotifyClose() chan *amqp.Error {
-	return self.channel.NotifyClose(make(chan *amqp.Error))
+	return self.Channel().NotifyClose(newCloseChan())
 }
 
 // Close allows us to close the channel
 func (self *AMQPChannel) Close() error {
-	return self.channel.Close()
+	return self.Channel().Close()
 }
@@ -0,0 +1,171 @@
+package raven
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/HailoOSS/service/config"
+	inst "github.com/HailoOSS/service/instrumentation"
+	log "github.com/cihub/seelog"
+	"github.com/golang/snappy"
+	"github.com/streadway/amqp"
+)
+
+const (
+	// GzipEncoding is the content encoding of gzip compressed messages
+	GzipEncoding = "gzip"
+	// SnappyEncoding is the content encoding of snappy compressed messages
+	SnappyEncoding = "snappy"
+
+	// defaultCompressionThreshold is the smallest payload we compress, in bytes
+	defaultCompressionThreshold = 64 * 1024
+
+	// acceptedEncodings are the content encodings we can decode, sent with every request in the acceptEncoding header
+	acceptedEncodings = GzipEncoding + "," + SnappyEncoding
+)
+
+// CompressionOptOut can be implemented by a request, response or publication to say it should never be compressed,
+// eg: for endpoints whose payloads are already compressed
+type CompressionOptOut interface {
+	CompressionDisabled() bool
+}
+
+// compressionConfig is how we compress payloads, read from config the first time we need it after it changes
+type compressionConfig struct {
+	encoding  string
+	threshold int
+}
+
+var (
+	compression   *compressionConfig
+	compressionMu sync.RWMutex
+)
+
+func init() {
+	// Forget our config when it changes, so it is read again next time we publish
+	ch := config.SubscribeChanges()
+	go func() {
+		for {
+			<-ch
+			compressionMu.Lock()
+			compression = nil
+			compressionMu.Unlock()
+		}
+	}()
+}
+
+// compressionEncoding says how we compress payloads at or above the threshold, if at all. Set
+// hailo.platform.raven.compression.encoding to gzip or snappy to turn this on
+func compressionEncoding() (encoding string, threshold int) {
+	compressionMu.RLock()
+	c := compression
+	compressionMu.RUnlock()
+
+	if c == nil {
+		c = &compressionConfig{
+			encoding:  config.AtPath("hailo", "platform", "raven", "compression", "encoding").AsString(""),
+			threshold: config.AtPath("hailo", "platform", "raven", "compression", "threshold").AsInt(defaultCompressionThreshold),
+		}
+		compressionMu.Lock()
+		compression = c
+		compressionMu.Unlock()
+	}
+
+	return c.encoding, c.threshold
+}
+
+// compress encodes the body of a message if compression is turned on, the body is big enough and the message hasn't
+// opted out. Replies are only compressed if the caller said it can decode them. If anything goes wrong we just send
+// it uncompressed
+func compress(msg interface{}, p amqp.Publishing) amqp.Publishing {
+	if o, ok := msg.(CompressionOptOut); ok && o.CompressionDisabled() {
+		return p
+	}
+
+	encoding, threshold := compressionEncoding()
+	if encoding == "" || len(p.Body) < threshold {
+		return p
+	}
+	if rsp, ok := msg.(Response); ok && !acceptsEncoding(rsp, encoding) {
+		return p
+	}
+
+	body, err := encode(encoding, p.Body)
+	if err != nil {
+		log.Warnf("[Raven] Failed to compress %s, sending uncompressed: %v", p.MessageId, err)
+		return p
+	}
+
+	inst.Counter(1.0, fmt.Sprintf("raven.compression.%s.bytesIn", encoding), len(p.Body))
+	inst.Counter(1.0, fmt.Sprintf("raven.compression.%s.bytesOut", encoding), len(body))
+	inst.Gauge(1.0, fmt.Sprintf("raven.compression.%s.ratio", encoding), 100*len(body)/len(p.Body))
+
+	p.Body = body
+	p.ContentEncoding = encoding
+	return p
+}
+
+// acceptsEncoding says whether the caller a reply is for can decode the encoding, going by the acceptEncoding header
+// of its request. Callers from before we compressed replies don't send it, so they get them uncompressed
+func acceptsEncoding(rsp Response, encoding string) bool {
+	n, ok := rsp.(EncodingNegotiated)
+	if !ok {
+		return false
+	}
+	for _, accepted := range strings.Split(n.AcceptEncoding(), ",") {
+		if strings.TrimSpace(accepted) == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+func encode(encoding string, body []byte) ([]byte, error) {
+	switch encoding {
+	case GzipEncoding:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case SnappyEncoding:
+		return snappy.Encode(nil, body), nil
+	}
+
+	return nil, fmt.Errorf("[Raven] Unknown content encoding: %s", encoding)
+}
+
+// Decompress decodes a message body according to its content encoding
+func Decompress(encoding string, body []byte) ([]byte, error) {
+	switch encoding {
+	case "":
+		return body, nil
+	case GzipEncoding:
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("[Raven] Failed to decompress gzip body: %v", err)
+		}
+		defer r.Close()
+		decoded, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("[Raven] Failed to decompress gzip body: %v", err)
+		}
+		return decoded, nil
+	case SnappyEncoding:
+		decoded, err := snappy.Decode(nil, body)
+		if err != nil {
+			return nil, fmt.Errorf("[Raven] Failed to decompress snappy body: %v", err)
+		}
+		return decoded, nil
+	}
+
+	return nil, fmt.Errorf("[Raven] Unknown content encoding: %s", encoding)
+}
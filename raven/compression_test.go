@@ -0,0 +1,123 @@
+package raven
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/HailoOSS/service/config"
+	"github.com/streadway/amqp"
+)
+
+type optOut bool
+
+func (o optOut) CompressionDisabled() bool {
+	return bool(o)
+}
+
+func TestCompress(t *testing.T) {
+	config.Load(bytes.NewBufferString(`{"hailo":{"platform":{"raven":{"compression":{"encoding":"gzip","threshold":10}}}}}`))
+	defer config.Load(bytes.NewBufferString(`{}`))
+	// don't wait for the config change to reach us
+	compressionMu.Lock()
+	compression = nil
+	compressionMu.Unlock()
+
+	body := bytes.Repeat([]byte("hailo"), 100)
+
+	p := compress(optOut(false), amqp.Publishing{Body: body})
+	if p.ContentEncoding != GzipEncoding {
+		t.Fatalf("Expected gzip encoding, got %q", p.ContentEncoding)
+	}
+	if len(p.Body) >= len(body) {
+		t.Errorf("Expected body to shrink from %d bytes, got %d", len(body), len(p.Body))
+	}
+	decoded, err := Decompress(p.ContentEncoding, p.Body)
+	if err != nil {
+		t.Fatalf("Unexpected error decompressing: %v", err)
+	}
+	if !bytes.Equal(decoded, body) {
+		t.Errorf("Decompressed body doesn't match original")
+	}
+
+	if p := compress(optOut(false), amqp.Publishing{Body: []byte("small")}); p.ContentEncoding != "" {
+		t.Errorf("Expected body under threshold to be left alone, got %q", p.ContentEncoding)
+	}
+	if p := compress(optOut(true), amqp.Publishing{Body: body}); p.ContentEncoding != "" {
+		t.Errorf("Expected opted out body to be left alone, got %q", p.ContentEncoding)
+	}
+}
+
+// testReply is a reply to a caller that accepts the given encodings
+type testReply string
+
+func (r testReply) ContentType() string    { return "application/json" }
+func (r testReply) MessageType() string    { return "reply" }
+func (r testReply) Payload() []byte        { return nil }
+func (r testReply) ReplyTo() string        { return "client" }
+func (r testReply) MessageID() string      { return "1" }
+func (r testReply) AcceptEncoding() string { return string(r) }
+
+// testRequest is an empty request
+type testRequest struct{}
+
+func (r *testRequest) ContentType() string      { return "application/json" }
+func (r *testRequest) Service() string          { return "com.HailoOSS.service.foo" }
+func (r *testRequest) Endpoint() string         { return "bar" }
+func (r *testRequest) MessageID() string        { return "1" }
+func (r *testRequest) From() string             { return "" }
+func (r *testRequest) RemoteAddr() string       { return "" }
+func (r *testRequest) TraceID() string          { return "" }
+func (r *testRequest) TraceShouldPersist() bool { return false }
+func (r *testRequest) SessionID() string        { return "" }
+func (r *testRequest) ParentMessageID() string  { return "" }
+func (r *testRequest) Payload() []byte          { return nil }
+func (r *testRequest) Authorised() bool         { return false }
+func (r *testRequest) Deadline() time.Time      { return time.Time{} }
+func (r *testRequest) Priority() uint8          { return 0 }
+
+func TestCompressReplies(t *testing.T) {
+	config.Load(bytes.NewBufferString(`{"hailo":{"platform":{"raven":{"compression":{"encoding":"snappy","threshold":10}}}}}`))
+	defer config.Load(bytes.NewBufferString(`{}`))
+	compressionMu.Lock()
+	compression = nil
+	compressionMu.Unlock()
+
+	body := bytes.Repeat([]byte("hailo"), 100)
+	if p := compress(testReply("gzip, snappy"), amqp.Publishing{Body: body}); p.ContentEncoding != SnappyEncoding {
+		t.Errorf("Expected a reply to a caller accepting snappy to be compressed, got %q", p.ContentEncoding)
+	}
+	if p := compress(testReply("gzip"), amqp.Publishing{Body: body}); p.ContentEncoding != "" {
+		t.Errorf("Expected a reply to a caller not accepting snappy to be left alone, got %q", p.ContentEncoding)
+	}
+	if p := compress(testReply(""), amqp.Publishing{Body: body}); p.ContentEncoding != "" {
+		t.Errorf("Expected a reply to a caller accepting nothing to be left alone, got %q", p.ContentEncoding)
+	}
+
+	// we tell services what we can decode
+	p := requestPublishing(&testRequest{}, "client")
+	if p.Headers["acceptEncoding"] != acceptedEncodings {
+		t.Errorf("Expected requests to accept %q, got %v", acceptedEncodings, p.Headers["acceptEncoding"])
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	body := []byte("some payload")
+	for _, encoding := range []string{GzipEncoding, SnappyEncoding} {
+		encoded, err := encode(encoding, body)
+		if err != nil {
+			t.Fatalf("Unexpected error encoding %s: %v", encoding, err)
+		}
+		decoded, err := Decompress(encoding, encoded)
+		if err != nil {
+			t.Fatalf("Unexpected error decoding %s: %v", encoding, err)
+		}
+		if !bytes.Equal(decoded, body) {
+			t.Errorf("Expected %s round trip to give %q, got %q", encoding, body, decoded)
+		}
+	}
+
+	if _, err := Decompress("bogus", body); err == nil {
+		t.Errorf("Expected an error for an unknown encoding")
+	}
+}
@@ -0,0 +1,160 @@
+package raven
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/HailoOSS/service/config"
+	log "github.com/cihub/seelog"
+	"github.com/streadway/amqp"
+)
+
+// ErrNoRoute is returned by SendRequest, when publisher confirms are enabled, if there is no queue bound to receive
+// requests for the service
+var ErrNoRoute = errors.New("[Raven] No route to service")
+
+// confirmTimeout is how long we wait for the broker to confirm a request before giving up on it
+const confirmTimeout = 5 * time.Second
+
+// confirmsEnabled says whether requests should be published as mandatory and confirmed by the broker, so that we find
+// out straight away if nothing is bound to receive them. Set hailo.platform.raven.confirms to turn this on; the AMQP
+// transport picks up changes the next time the publisher channel is established
+func confirmsEnabled() bool {
+	return config.AtPath("hailo", "platform", "raven", "confirms").AsBool()
+}
+
+// confirmer tracks publishes awaiting confirmation on a channel in confirm mode
+type confirmer struct {
+	sync.Mutex
+	seq     uint64
+	pending map[uint64]*pendingConfirm
+	byID    map[string]*pendingConfirm
+}
+
+type pendingConfirm struct {
+	messageID string
+	returned  bool
+	done      chan error
+}
+
+// newConfirmer puts a channel into confirm mode and starts listening for confirms and returns
+func newConfirmer(ch *amqp.Channel) (*confirmer, error) {
+	if err := ch.Confirm(false); err != nil {
+		return nil, fmt.Errorf("[Raven] Failed to put channel into confirm mode: %v", err)
+	}
+
+	c := &confirmer{
+		pending: make(map[uint64]*pendingConfirm),
+		byID:    make(map[string]*pendingConfirm),
+	}
+
+	// these must be unbuffered and read by a single goroutine, which guarantees we see the return for an unroutable
+	// message before its confirm
+	go c.listen(ch.NotifyPublish(make(chan amqp.Confirmation)), ch.NotifyReturn(make(chan amqp.Return)))
+
+	return c, nil
+}
+
+// publish sends a message. Every publish on a channel in confirm mode is numbered, but we only wait for (and publish
+// as mandatory) those where confirm is set
+func (c *confirmer) publish(ch *amqp.Channel, exchange, key string, confirm bool, msg amqp.Publishing) error {
+	c.Lock()
+	if err := ch.Publish(exchange, key, confirm, false, msg); err != nil {
+		c.Unlock()
+		return err
+	}
+	c.seq++
+	seq := c.seq
+
+	var pc *pendingConfirm
+	if confirm {
+		pc = &pendingConfirm{
+			messageID: msg.MessageId,
+			done:      make(chan error, 1),
+		}
+		c.pending[seq] = pc
+		c.byID[msg.MessageId] = pc
+	}
+	c.Unlock()
+
+	if pc == nil {
+		return nil
+	}
+
+	select {
+	case err := <-pc.done:
+		return err
+	case <-time.After(confirmTimeout):
+		c.Lock()
+		c.forget(seq, pc)
+		c.Unlock()
+		return fmt.Errorf("[Raven] Timed out waiting for broker to confirm %s", msg.MessageId)
+	}
+}
+
+func (c *confirmer) listen(confirms chan amqp.Confirmation, returns chan amqp.Return) {
+	for confirms != nil || returns != nil {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			c.returned(r)
+		case conf, ok := <-confirms:
+			if !ok {
+				confirms = nil
+				continue
+			}
+			c.confirmed(conf)
+		}
+	}
+
+	// the channel has gone away, so nothing else is going to be confirmed
+	c.Lock()
+	defer c.Unlock()
+	for seq, pc := range c.pending {
+		c.forget(seq, pc)
+		pc.done <- fmt.Errorf("[Raven] Channel closed before broker confirmed %s", pc.messageID)
+	}
+}
+
+func (c *confirmer) returned(r amqp.Return) {
+	c.Lock()
+	defer c.Unlock()
+
+	log.Debugf("[Raven] Message %s returned by broker: %d %s", r.MessageId, r.ReplyCode, r.ReplyText)
+	if pc, ok := c.byID[r.MessageId]; ok {
+		pc.returned = true
+	}
+}
+
+func (c *confirmer) confirmed(conf amqp.Confirmation) {
+	c.Lock()
+	defer c.Unlock()
+
+	pc, ok := c.pending[conf.DeliveryTag]
+	if !ok {
+		return
+	}
+	c.forget(conf.DeliveryTag, pc)
+
+	switch {
+	case pc.returned:
+		pc.done <- ErrNoRoute
+	case !conf.Ack:
+		pc.done <- fmt.Errorf("[Raven] Broker failed to accept %s", pc.messageID)
+	default:
+		pc.done <- nil
+	}
+}
+
+// forget stops tracking a publish - must be called with the lock held
+func (c *confirmer) forget(seq uint64, pc *pendingConfirm) {
+	delete(c.pending, seq)
+	if c.byID[pc.messageID] == pc {
+		delete(c.byID, pc.messageID)
+	}
+}
@@ -0,0 +1,32 @@
+package raven
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestConfirmerReturnedIsNoRoute(t *testing.T) {
+	c := &confirmer{
+		pending: make(map[uint64]*pendingConfirm),
+		byID:    make(map[string]*pendingConfirm),
+	}
+	routed := &pendingConfirm{messageID: "routed", done: make(chan error, 1)}
+	unroutable := &pendingConfirm{messageID: "unroutable", done: make(chan error, 1)}
+	c.pending[1], c.byID["routed"] = routed, routed
+	c.pending[2], c.byID["unroutable"] = unroutable, unroutable
+
+	c.returned(amqp.Return{MessageId: "unroutable", ReplyCode: 312, ReplyText: "NO_ROUTE"})
+	c.confirmed(amqp.Confirmation{DeliveryTag: 1, Ack: true})
+	c.confirmed(amqp.Confirmation{DeliveryTag: 2, Ack: true})
+
+	if err := <-routed.done; err != nil {
+		t.Errorf("Expected routed message to be confirmed, got %v", err)
+	}
+	if err := <-unroutable.done; err != ErrNoRoute {
+		t.Errorf("Expected unroutable message to get ErrNoRoute, got %v", err)
+	}
+	if len(c.pending) != 0 || len(c.byID) != 0 {
+		t.Error("Expected confirmed messages to be forgotten")
+	}
+}
@@ -1,36 +1,71 @@
 package raven
 
 import (
+	"fmt"
+	"sync"
+
 	log "github.com/cihub/seelog"
 	"github.com/streadway/amqp"
 )
 
 // AMQPConnection wraps an AMQP connection with state
 type AMQPConnection struct {
+	sync.RWMutex
 	conn *amqp.Connection
+	node string
 }
 
-func (self *AMQPConnection) connect() (err error) {
-	log.Tracef("[Raven] Connecting to %s", AmqpUri)
+func (self *AMQPConnection) connect(uri string) (err error) {
+	node := nodeName(uri)
+	log.Tracef("[Raven] Connecting to %s", node)
 
-	if self.conn, err = amqp.Dial(AmqpUri); err == nil {
-		log.Infof("[Raven] Online, connected to %s", AmqpUri)
+	conn, err := amqp.Dial(uri)
+	if err != nil {
+		return fmt.Errorf("[Raven] Failed to connect to %s: %v", node, err)
 	}
+	log.Infof("[Raven] Online, connected to %s", node)
+
+	self.Lock()
+	defer self.Unlock()
+	self.conn = conn
+	self.node = node
+
+	return nil
+}
+
+// Node returns the host:port of the broker we last connected to
+func (self *AMQPConnection) Node() string {
+	self.RLock()
+	defer self.RUnlock()
 
-	return
+	return self.node
 }
 
 // NotifyClose allows us to listen for the connection closing
 func (self *AMQPConnection) NotifyClose() chan *amqp.Error {
-	return self.conn.NotifyClose(make(chan *amqp.Error))
+	return self.amqpConn().NotifyClose(newCloseChan())
+}
+
+// newCloseChan makes a channel to be told about a connection or channel closing on. The close is sent while shutting
+// down, which would block forever, along with everything else shutting down, if we had stopped listening, so there is
+// room for it
+func newCloseChan() chan *amqp.Error {
+	return make(chan *amqp.Error, 1)
 }
 
 // Channel makes sure we are connected and gets a new channel
 func (self *AMQPConnection) Channel() (*amqp.Channel, error) {
-	return self.conn.Channel()
+	return self.amqpConn().Channel()
 }
 
 // Close allows us to close the connection
 func (self *AMQPConnection) Close() error {
-	return self.conn.Close()
+	return self.amqpConn().Close()
+}
+
+func (self *AMQPConnection) amqpConn() *amqp.Connection {
+	self.RLock()
+	defer self.RUnlock()
+
+	return self.conn
 }
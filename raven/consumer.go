@@ -2,83 +2,420 @@ package raven
 
 import (
 	"fmt"
+	"sync"
+	"time"
+
 	log "github.com/cihub/seelog"
 	"github.com/streadway/amqp"
 )
 
+// queueConsumer is a queue we are consuming from. Its deliveries channel outlives any single connection; each time
+// we reconnect a new consumer is started on the broker and fed into it
+type queueConsumer struct {
+	queue      string
+	tag        string
+	autoAck    bool
+	services   map[string]bool // services bound to the queue with BindService
+	topics     map[string]bool // topics bound to the queue with BindTopic
+	deliveries chan amqp.Delivery
+	feeders    sync.WaitGroup
+
+	// durable consumers read from a durable queue bound to a topic, and have to ack what they receive
+	durable bool
+	topic   string
+}
+
+func newQueueConsumer(queue string) *queueConsumer {
+	return &queueConsumer{
+		queue:      queue,
+		tag:        queue,
+		autoAck:    true,
+		services:   make(map[string]bool),
+		topics:     make(map[string]bool),
+		deliveries: make(chan amqp.Delivery),
+	}
+}
+
+func newDurableConsumer(queue, topic, tag string) *queueConsumer {
+	c := newQueueConsumer(queue)
+	c.tag = tag
+	c.autoAck = false
+	c.durable = true
+	c.topic = topic
+
+	return c
+}
+
+// DeadLetterQueue is the name of the queue that messages from a durable queue end up on once we give up on them
+func DeadLetterQueue(queue string) string {
+	return queue + ".deadletter"
+}
+
+// RetryQueue is the name of the queue on which messages sent with ForwardAfter wait for their delay, before expiring
+// onto the queue they were forwarded to. There is one per delay, as messages only expire from the front of a queue,
+// so would otherwise get stuck behind ones waiting longer
+func RetryQueue(queue string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%d", queue, delay/time.Millisecond)
+}
+
+// ControlQueue is the name of the queue an instance consumes control messages on, eg: credit for the streams it is
+// sending, apart from its requests so that they never wait behind them
+func ControlQueue(instance string) string {
+	return instance + ".control"
+}
+
+// retryQueueArgs are the arguments we declare a retry queue with, dead lettering expired messages to the queue
+func retryQueueArgs(queue string) amqp.Table {
+	return amqp.Table{"x-dead-letter-exchange": "", "x-dead-letter-routing-key": queue}
+}
+
+// feed forwards deliveries from a broker consumer until it goes away
+func (c *queueConsumer) feed(src <-chan amqp.Delivery) {
+	c.feeders.Add(1)
+	go func() {
+		defer c.feeders.Done()
+		for d := range src {
+			c.deliveries <- d
+		}
+	}()
+}
+
+// close closes the deliveries channel once nothing is feeding it any more
+func (c *queueConsumer) close() {
+	go func() {
+		c.feeders.Wait()
+		close(c.deliveries)
+	}()
+}
+
 // BindService is used when self-binding
-func BindService(serviceName, queue string) error {
+func (t *AMQPTransport) BindService(serviceName, queue string) error {
 	log.Tracef("[Raven] Self-binding %v to %v", serviceName, queue)
 
-	if !Connected {
+	if !t.IsConnected() {
 		return fmt.Errorf("[Raven] Error self-binding, raven not connected")
 	}
 
-	if err := Consumer.channel.QueueBind(
-		queue,       // name of the queue
-		serviceName, // bindingKey
-		EXCHANGE,    // sourceExchange
-		true,        // noWait
-		amqp.Table{
-			"service": serviceName,
-			"x-match": "all",
-		}, // arguments
-	); err != nil {
-		return fmt.Errorf("[Raven] Queue bind failed for \"%s\": %v", queue, err)
+	if err := bindService(serviceName, queue); err != nil {
+		return err
+	}
+
+	// remember the binding so it can be re-established when we reconnect
+	t.mtx.Lock()
+	if c, ok := t.consumers[queue]; ok {
+		c.services[serviceName] = true
 	}
+	t.mtx.Unlock()
+
+	return nil
+}
+
+// BindTopic binds a queue to receive publications on a topic
+func (t *AMQPTransport) BindTopic(topic, queue string) error {
+	log.Tracef("[Raven] Binding %v to topic %v", queue, topic)
+
+	if !t.IsConnected() {
+		return fmt.Errorf("[Raven] Error binding topic, raven not connected")
+	}
+
+	if err := bindTopic(topic, queue); err != nil {
+		return err
+	}
+
+	// remember the binding so it can be re-established when we reconnect
+	t.mtx.Lock()
+	if c, ok := t.consumers[queue]; ok {
+		c.topics[topic] = true
+	}
+	t.mtx.Unlock()
 
 	return nil
 }
 
 // Consume data from a queue
-func Consume(queue string) (deliveries <-chan amqp.Delivery, err error) {
+func (t *AMQPTransport) Consume(queue string) (<-chan amqp.Delivery, error) {
+	return t.consume(queue, true)
+}
+
+// ConsumeWithAck consumes from a queue in the same way as Consume, but deliveries must be acked
+func (t *AMQPTransport) ConsumeWithAck(queue string) (<-chan amqp.Delivery, error) {
+	return t.consume(queue, false)
+}
+
+func (t *AMQPTransport) consume(queue string, autoAck bool) (<-chan amqp.Delivery, error) {
 	log.Tracef("[Raven] Attempting to consume from %s", queue)
 
-	if !Connected {
+	if !t.IsConnected() {
 		return nil, fmt.Errorf("[Raven] Error consuming, raven not connected")
 	}
-	if _, err = Consumer.channel.QueueDeclare(
-		queue, // name of the queue
-		false, // durable
-		true,  // delete when usused
-		false, // exclusive
-		true,  // noWait
-		amqp.Table{"x-message-ttl": int32(5000), "x-expires": int32(30000)}, // arguments
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if c, ok := t.consumers[queue]; ok {
+		return c.deliveries, nil
+	}
+
+	c := newQueueConsumer(queue)
+	c.autoAck = autoAck
+	if err := startConsumer(c); err != nil {
+		return nil, err
+	}
+	t.consumers[queue] = c
+
+	log.Tracef("[Raven] Consuming from queue \"%s\"", queue)
+	return c.deliveries, nil
+}
+
+// SetPrefetch limits how many unacked deliveries the broker sends each of our consumers needing acks at once
+func (t *AMQPTransport) SetPrefetch(count int) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if count == t.prefetch {
+		return nil
+	}
+	t.prefetch = count
+	if !t.IsConnected() {
+		// applied when we connect
+		return nil
+	}
+
+	if err := applyPrefetch(count); err != nil {
+		return err
+	}
+
+	// the broker only applies QoS to consumers as they start, so restart those it matters to
+	for _, c := range t.consumers {
+		if c.autoAck {
+			continue
+		}
+		if err := restartConsumer(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyPrefetch sets QoS on the consumer channel, applied to each consumer started on it from then on
+func applyPrefetch(count int) error {
+	if err := Consumer.Channel().Qos(
+		count, // prefetch count
+		0,     // prefetch size
+		false, // global
 	); err != nil {
-		err = fmt.Errorf("[Raven] Queue declare failed \"%s\": %v", queue, err)
-		return
-	}
-
-	if deliveries, err = Consumer.channel.Consume(
-		queue, // queue name
-		queue, // consumer tag
-		true,  // auto ack
-		false, // exclusive
-		false, // no local
-		true,  // no wait
-		nil,   // args
+		return fmt.Errorf("[Raven] Failed to set prefetch to %d: %v", count, err)
+	}
+
+	return nil
+}
+
+// ConsumeDurable declares a durable queue bound to a topic, plus its dead letter queue, and starts consuming from it
+func (t *AMQPTransport) ConsumeDurable(queue, topic string) (<-chan amqp.Delivery, error) {
+	log.Tracef("[Raven] Attempting to consume durably from %s bound to %s", queue, topic)
+
+	if !t.IsConnected() {
+		return nil, fmt.Errorf("[Raven] Error consuming, raven not connected")
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if c, ok := t.consumers[queue]; ok {
+		return c.deliveries, nil
+	}
+
+	// consumer tags only need to be unique on our channel, even though every instance of a service shares the queue
+	c := newDurableConsumer(queue, topic, queue)
+	if err := startConsumer(c); err != nil {
+		return nil, err
+	}
+	t.consumers[queue] = c
+
+	log.Tracef("[Raven] Consuming durably from queue \"%s\"", queue)
+	return c.deliveries, nil
+}
+
+// restoreConsumers re-declares, consumes from and re-binds all of our queues after reconnecting
+func (t *AMQPTransport) restoreConsumers() error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.prefetch > 0 {
+		if err := applyPrefetch(t.prefetch); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range t.consumers {
+		if err := startConsumer(c); err != nil {
+			return err
+		}
+		log.Debugf("[Raven] Restored consumer on queue \"%s\"", c.queue)
+	}
+
+	return nil
+}
+
+// startConsumer declares the queue, starts consuming from it on the current consumer channel and binds it
+func startConsumer(c *queueConsumer) error {
+	if c.durable {
+		return startDurableConsumer(c)
+	}
+
+	ch := Consumer.Channel()
+
+	if _, err := ch.QueueDeclare(
+		c.queue,             // name of the queue
+		false,               // durable
+		true,                // delete when usused
+		false,               // exclusive
+		true,                // noWait
+		instanceQueueArgs(), // arguments
 	); err != nil {
-		err = fmt.Errorf("[Raven] Failed to consume from queue \"%s\": %v", queue, err)
-		return
+		return fmt.Errorf("[Raven] Queue declare failed \"%s\": %v", c.queue, err)
+	}
+
+	deliveries, err := ch.Consume(
+		c.queue,   // queue name
+		c.tag,     // consumer tag
+		c.autoAck, // auto ack
+		false,     // exclusive
+		false,     // no local
+		true,      // no wait
+		nil,       // args
+	)
+	if err != nil {
+		return fmt.Errorf("[Raven] Failed to consume from queue \"%s\": %v", c.queue, err)
 	}
 
 	// binding should come after consume because temp queues are only deleted once they have had at least once consumer
-	if err = Consumer.channel.QueueBind(
-		queue,          // name of the queue
-		queue,          // bindingKey
+	if err := ch.QueueBind(
+		c.queue,        // name of the queue
+		c.queue,        // bindingKey
 		REPLY_EXCHANGE, // sourceExchange
 		false,          // noWait
 		nil,            // arguments
 	); err != nil {
-		err = fmt.Errorf("[Raven] Queue bind failed for \"%s\": %v", queue, err)
-		return
+		return fmt.Errorf("[Raven] Queue bind failed for \"%s\": %v", c.queue, err)
 	}
 
-	log.Tracef("[Raven] Consuming from queue \"%s\"", queue)
-	return
+	for serviceName := range c.services {
+		if err := bindService(serviceName, c.queue); err != nil {
+			return err
+		}
+	}
+	for topic := range c.topics {
+		if err := bindTopic(topic, c.queue); err != nil {
+			return err
+		}
+	}
+	c.feed(deliveries)
+
+	return nil
+}
+
+// restartConsumer cancels a consumer and starts it again, so it picks up the current QoS. Anything delivered to it
+// but not yet acked can still be acked, as that is down to the channel rather than the consumer
+func restartConsumer(c *queueConsumer) error {
+	if err := Consumer.Channel().Cancel(c.tag, false); err != nil {
+		return fmt.Errorf("[Raven] Failed to cancel consumer on queue \"%s\": %v", c.queue, err)
+	}
+
+	return startConsumer(c)
+}
+
+// startDurableConsumer declares a durable queue and its dead letter queue, binds it to its topic and starts consuming
+// from it without auto-acking
+func startDurableConsumer(c *queueConsumer) error {
+	ch := Consumer.Channel()
+
+	for _, queue := range []string{c.queue, DeadLetterQueue(c.queue)} {
+		if _, err := ch.QueueDeclare(
+			queue, // name of the queue
+			true,  // durable
+			false, // delete when usused
+			false, // exclusive
+			false, // noWait
+			nil,   // arguments
+		); err != nil {
+			return fmt.Errorf("[Raven] Queue declare failed \"%s\": %v", queue, err)
+		}
+	}
+
+	if err := ch.QueueBind(
+		c.queue,        // name of the queue
+		c.topic,        // bindingKey
+		TOPIC_EXCHANGE, // sourceExchange
+		false,          // noWait
+		nil,            // arguments
+	); err != nil {
+		return fmt.Errorf("[Raven] Queue bind failed for \"%s\": %v", c.queue, err)
+	}
+
+	deliveries, err := ch.Consume(
+		c.queue, // queue name
+		c.tag,   // consumer tag
+		false,   // auto ack
+		false,   // exclusive
+		false,   // no local
+		false,   // no wait
+		nil,     // args
+	)
+	if err != nil {
+		return fmt.Errorf("[Raven] Failed to consume from queue \"%s\": %v", c.queue, err)
+	}
+	c.feed(deliveries)
+
+	return nil
+}
+
+// bindService binds a queue to the headers exchange for a service
+func bindService(serviceName, queue string) error {
+	if err := Consumer.Channel().QueueBind(
+		queue,                           // name of the queue
+		serviceName,                     // bindingKey
+		EXCHANGE,                        // sourceExchange
+		true,                            // noWait
+		serviceBindingArgs(serviceName), // arguments
+	); err != nil {
+		return fmt.Errorf("[Raven] Queue bind failed for \"%s\": %v", queue, err)
+	}
+
+	return nil
+}
+
+// bindTopic binds a queue to the topic exchange for a topic
+func bindTopic(topic, queue string) error {
+	if err := Consumer.Channel().QueueBind(
+		queue,          // name of the queue
+		topic,          // bindingKey
+		TOPIC_EXCHANGE, // sourceExchange
+		true,           // noWait
+		nil,            // arguments
+	); err != nil {
+		return fmt.Errorf("[Raven] Queue bind failed for \"%s\": %v", queue, err)
+	}
+
+	return nil
 }
 
 // ConsumerNotifyClose returns a go channel to notify when the amqp channel closes
 func ConsumerNotifyClose() chan *amqp.Error {
 	return Consumer.NotifyClose()
 }
+
+// instanceQueueArgs are the arguments we declare per-instance queues with; messages expire if not picked up within 5s
+// and the queue itself goes away 30s after it was last used
+func instanceQueueArgs() amqp.Table {
+	return amqp.Table{"x-message-ttl": int32(5000), "x-expires": int32(30000)}
+}
+
+// serviceBindingArgs are the arguments used to bind a queue to the headers exchange for some service
+func serviceBindingArgs(serviceName string) amqp.Table {
+	return amqp.Table{
+		"service": serviceName,
+		"x-match": "all",
+	}
+}
@@ -0,0 +1,372 @@
+package raven
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/streadway/amqp"
+)
+
+// MemoryTransport is a Transport which talks to an in-process MemoryBroker rather than RabbitMQ. Several transports
+// (eg: one for a server and one for a client) can share the same broker
+type MemoryTransport struct {
+	stateNotifier
+
+	sync.Mutex
+	broker    *MemoryBroker
+	consumers map[string]*queueConsumer
+	prefetch  int
+}
+
+// NewMemoryTransport mints a transport attached to the supplied broker
+func NewMemoryTransport(b *MemoryBroker) *MemoryTransport {
+	return &MemoryTransport{
+		broker:    b,
+		consumers: make(map[string]*queueConsumer),
+	}
+}
+
+// Broker returns the broker this transport is attached to, eg: for tests to bind topics or inspect queues
+func (t *MemoryTransport) Broker() *MemoryBroker {
+	return t.broker
+}
+
+// Connect marks the transport as connected; there is nothing to dial so this succeeds immediately
+func (t *MemoryTransport) Connect() {
+	t.setState(StateConnecting, nil)
+	t.setState(StateConnected, nil)
+}
+
+// Disconnect cancels all of our consumers, closing their deliveries channels, and marks us as closed
+func (t *MemoryTransport) Disconnect() {
+	t.Lock()
+	defer t.Unlock()
+
+	for queue, c := range t.consumers {
+		if err := t.broker.Cancel(queue, c.tag); err != nil {
+			log.Debugf("[Raven] Unable to cancel consumer on \"%s\": %v", queue, err)
+		}
+		c.close()
+		delete(t.consumers, queue)
+	}
+	t.setState(StateClosed, nil)
+}
+
+// Reconnect simulates the connection to the broker being lost and coming back, as happens to the AMQP transport when
+// RabbitMQ goes away. Our broker consumers are cancelled, then re-established once we come back
+func (t *MemoryTransport) Reconnect(err error) error {
+	t.Lock()
+	defer t.Unlock()
+
+	for queue, c := range t.consumers {
+		if cerr := t.broker.Cancel(queue, c.tag); cerr != nil {
+			log.Debugf("[Raven] Unable to cancel consumer on \"%s\": %v", queue, cerr)
+		}
+	}
+	t.setState(StateDisconnected, err)
+
+	t.setState(StateConnecting, nil)
+	for _, c := range t.consumers {
+		if err := t.startConsumer(c); err != nil {
+			t.setState(StateDisconnected, err)
+			return err
+		}
+	}
+	t.setState(StateConnected, nil)
+
+	return nil
+}
+
+// IsConnected returns whether we are connected
+func (t *MemoryTransport) IsConnected() bool {
+	return t.State() == StateConnected
+}
+
+// Node returns "memory" while we are connected, as there is only ever the one broker
+func (t *MemoryTransport) Node() string {
+	if !t.IsConnected() {
+		return ""
+	}
+
+	return "memory"
+}
+
+// Consume declares, consumes from and binds an instance queue in the same way as the AMQP transport
+func (t *MemoryTransport) Consume(queue string) (<-chan amqp.Delivery, error) {
+	return t.consume(queue, true)
+}
+
+// ConsumeWithAck consumes from a queue in the same way as Consume, but deliveries must be acked
+func (t *MemoryTransport) ConsumeWithAck(queue string) (<-chan amqp.Delivery, error) {
+	return t.consume(queue, false)
+}
+
+func (t *MemoryTransport) consume(queue string, autoAck bool) (<-chan amqp.Delivery, error) {
+	log.Tracef("[Raven] Attempting to consume from %s", queue)
+
+	if !t.IsConnected() {
+		return nil, fmt.Errorf("[Raven] Error consuming, raven not connected")
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if c, ok := t.consumers[queue]; ok {
+		return c.deliveries, nil
+	}
+
+	c := newQueueConsumer(queue)
+	c.autoAck = autoAck
+	if err := t.startConsumer(c); err != nil {
+		return nil, err
+	}
+	t.consumers[queue] = c
+
+	log.Tracef("[Raven] Consuming from queue \"%s\"", queue)
+	return c.deliveries, nil
+}
+
+// SetPrefetch limits how many unacked deliveries each of our consumers needing acks can have at once. As with AMQP,
+// the limit is per consumer, and applies straight away
+func (t *MemoryTransport) SetPrefetch(count int) error {
+	t.Lock()
+	defer t.Unlock()
+
+	t.prefetch = count
+	for queue, c := range t.consumers {
+		if c.autoAck {
+			continue
+		}
+		if err := t.broker.SetPrefetch(queue, c.tag, count); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ConsumeDurable declares a queue bound to a topic, plus its dead letter queue, and consumes from it without auto-acking
+func (t *MemoryTransport) ConsumeDurable(queue, topic string) (<-chan amqp.Delivery, error) {
+	log.Tracef("[Raven] Attempting to consume durably from %s bound to %s", queue, topic)
+
+	if !t.IsConnected() {
+		return nil, fmt.Errorf("[Raven] Error consuming, raven not connected")
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if c, ok := t.consumers[queue]; ok {
+		return c.deliveries, nil
+	}
+
+	// transports sharing a broker share durable queues, so need their own consumer tags
+	c := newDurableConsumer(queue, topic, fmt.Sprintf("%s-%p", queue, t))
+	if err := t.startConsumer(c); err != nil {
+		return nil, err
+	}
+	t.consumers[queue] = c
+
+	log.Tracef("[Raven] Consuming durably from queue \"%s\"", queue)
+	return c.deliveries, nil
+}
+
+// startConsumer declares the queue, consumes from it and binds it - must be called with the lock held
+func (t *MemoryTransport) startConsumer(c *queueConsumer) error {
+	if c.durable {
+		return t.startDurableConsumer(c)
+	}
+
+	if err := t.broker.QueueDeclare(c.queue, true, instanceQueueArgs()); err != nil {
+		return fmt.Errorf("[Raven] Queue declare failed \"%s\": %v", c.queue, err)
+	}
+
+	deliveries, err := t.broker.Consume(c.queue, c.tag, c.autoAck)
+	if err != nil {
+		return fmt.Errorf("[Raven] Failed to consume from queue \"%s\": %v", c.queue, err)
+	}
+	if !c.autoAck {
+		if err := t.broker.SetPrefetch(c.queue, c.tag, t.prefetch); err != nil {
+			return err
+		}
+	}
+
+	if err := t.broker.QueueBind(c.queue, c.queue, REPLY_EXCHANGE, nil); err != nil {
+		return fmt.Errorf("[Raven] Queue bind failed for \"%s\": %v", c.queue, err)
+	}
+
+	for serviceName := range c.services {
+		if err := t.broker.QueueBind(c.queue, serviceName, EXCHANGE, serviceBindingArgs(serviceName)); err != nil {
+			return fmt.Errorf("[Raven] Queue bind failed for \"%s\": %v", c.queue, err)
+		}
+	}
+	for topic := range c.topics {
+		if err := t.broker.QueueBind(c.queue, topic, TOPIC_EXCHANGE, nil); err != nil {
+			return fmt.Errorf("[Raven] Queue bind failed for \"%s\": %v", c.queue, err)
+		}
+	}
+	c.feed(deliveries)
+
+	return nil
+}
+
+// startDurableConsumer declares a queue and its dead letter queue, binds it to its topic and consumes from it - must
+// be called with the lock held
+func (t *MemoryTransport) startDurableConsumer(c *queueConsumer) error {
+	for _, queue := range []string{c.queue, DeadLetterQueue(c.queue)} {
+		if err := t.broker.QueueDeclare(queue, false, nil); err != nil {
+			return fmt.Errorf("[Raven] Queue declare failed \"%s\": %v", queue, err)
+		}
+	}
+
+	if err := t.broker.QueueBind(c.queue, c.topic, TOPIC_EXCHANGE, nil); err != nil {
+		return fmt.Errorf("[Raven] Queue bind failed for \"%s\": %v", c.queue, err)
+	}
+
+	deliveries, err := t.broker.Consume(c.queue, c.tag, false)
+	if err != nil {
+		return fmt.Errorf("[Raven] Failed to consume from queue \"%s\": %v", c.queue, err)
+	}
+	if err := t.broker.SetPrefetch(c.queue, c.tag, t.prefetch); err != nil {
+		return err
+	}
+	c.feed(deliveries)
+
+	return nil
+}
+
+// BindService binds a queue to the headers exchange for the named service
+func (t *MemoryTransport) BindService(serviceName, queue string) error {
+	log.Tracef("[Raven] Self-binding %v to %v", serviceName, queue)
+
+	if !t.IsConnected() {
+		return fmt.Errorf("[Raven] Error self-binding, raven not connected")
+	}
+
+	if err := t.broker.QueueBind(queue, serviceName, EXCHANGE, serviceBindingArgs(serviceName)); err != nil {
+		return fmt.Errorf("[Raven] Queue bind failed for \"%s\": %v", queue, err)
+	}
+
+	t.Lock()
+	if c, ok := t.consumers[queue]; ok {
+		c.services[serviceName] = true
+	}
+	t.Unlock()
+
+	return nil
+}
+
+// BindTopic binds a queue to the topic exchange for a topic
+func (t *MemoryTransport) BindTopic(topic, queue string) error {
+	log.Tracef("[Raven] Binding %v to topic %v", queue, topic)
+
+	if !t.IsConnected() {
+		return fmt.Errorf("[Raven] Error binding topic, raven not connected")
+	}
+
+	if err := t.broker.QueueBind(queue, topic, TOPIC_EXCHANGE, nil); err != nil {
+		return fmt.Errorf("[Raven] Queue bind failed for \"%s\": %v", queue, err)
+	}
+
+	t.Lock()
+	if c, ok := t.consumers[queue]; ok {
+		c.topics[topic] = true
+	}
+	t.Unlock()
+
+	return nil
+}
+
+// SendRequest to the headers exchange
+func (t *MemoryTransport) SendRequest(req Request, InstanceID string) error {
+	if !t.IsConnected() {
+		return fmt.Errorf("[Raven] Error sending request, raven not connected")
+	}
+
+	exchange, routingKey := requestRoute(req)
+	n, err := t.broker.Publish(exchange, routingKey, requestPublishing(req, InstanceID))
+	if err != nil {
+		return fmt.Errorf("Error sending request: %v", err)
+	}
+	if n == 0 && confirmsEnabled() {
+		return ErrNoRoute
+	}
+
+	return nil
+}
+
+// Forward republishes a delivery straight to a queue
+func (t *MemoryTransport) Forward(queue string, d amqp.Delivery, headers amqp.Table) error {
+	if !t.IsConnected() {
+		return fmt.Errorf("[Raven] Error forwarding, raven not connected")
+	}
+
+	n, err := t.broker.Publish("", queue, forwardPublishing(d, headers))
+	if err != nil {
+		return fmt.Errorf("[Raven] Error forwarding to %s: %v", queue, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("[Raven] Error forwarding to %s: %v", queue, ErrNoRoute)
+	}
+
+	return nil
+}
+
+// ForwardAfter republishes a delivery via a retry queue, so it arrives on the queue once delay has passed
+func (t *MemoryTransport) ForwardAfter(queue string, d amqp.Delivery, headers amqp.Table, delay time.Duration) error {
+	if !t.IsConnected() {
+		return fmt.Errorf("[Raven] Error forwarding, raven not connected")
+	}
+
+	retryQueue := RetryQueue(queue, delay)
+	if err := t.broker.QueueDeclare(retryQueue, false, retryQueueArgs(queue)); err != nil {
+		return fmt.Errorf("[Raven] Queue declare failed \"%s\": %v", retryQueue, err)
+	}
+
+	if _, err := t.broker.Publish("", retryQueue, delayedPublishing(d, headers, delay)); err != nil {
+		return fmt.Errorf("[Raven] Error forwarding to %s: %v", retryQueue, err)
+	}
+
+	return nil
+}
+
+// SendResponse to the reply exchange
+func (t *MemoryTransport) SendResponse(rsp Response, InstanceID string) error {
+	if !t.IsConnected() {
+		return fmt.Errorf("[Raven] Error sending response, raven not connected")
+	}
+
+	if _, err := t.broker.Publish(REPLY_EXCHANGE, rsp.ReplyTo(), responsePublishing(rsp, InstanceID)); err != nil {
+		return fmt.Errorf("Error sending response: %v", err)
+	}
+
+	return nil
+}
+
+// SendPublication to the topic exchange
+func (t *MemoryTransport) SendPublication(pub Publication, InstanceID string) error {
+	if !t.IsConnected() {
+		return fmt.Errorf("[Raven] Error sending publication, raven not connected")
+	}
+
+	if _, err := t.broker.Publish(TOPIC_EXCHANGE, pub.Topic(), publicationPublishing(pub, InstanceID)); err != nil {
+		return fmt.Errorf("Error sending publication: %s", err)
+	}
+
+	return nil
+}
+
+// SendHeartbeat to the reply exchange
+func (t *MemoryTransport) SendHeartbeat(hb Heartbeat, InstanceID string) error {
+	if !t.IsConnected() {
+		return fmt.Errorf("[Raven] Error sending heartbeat, raven not connected")
+	}
+
+	if _, err := t.broker.Publish(REPLY_EXCHANGE, hb.ID(), heartbeatPublishing(hb, InstanceID)); err != nil {
+		return fmt.Errorf("[Raven] Error sending heartbeat: %v", err)
+	}
+
+	return nil
+}
@@ -2,6 +2,8 @@ package raven
 
 import (
 	"fmt"
+	"strconv"
+	"time"
 
 	log "github.com/cihub/seelog"
 	"github.com/streadway/amqp"
@@ -12,10 +14,13 @@ const (
 	defaultPriority   = 0 // 0-9
 	heartbeatPriority = 5 // 0-9
 	contentEncoding   = ""
+
+	// publicationDeliveryMode is persistent, so publications on durable queues survive the broker restarting
+	publicationDeliveryMode = amqp.Persistent
 )
 
 // SendResponse back via AMQP
-func SendResponse(rsp Response, InstanceID string) error {
+func (t *AMQPTransport) SendResponse(rsp Response, InstanceID string) error {
 	messageName := rsp.MessageID()
 	if len(messageName) == 0 {
 		messageName = rsp.MessageType()
@@ -23,28 +28,15 @@ func SendResponse(rsp Response, InstanceID string) error {
 
 	log.Tracef("[Raven] Sending back response for %s to routing key %s", messageName, rsp.ReplyTo())
 
-	if !Connected {
+	if !t.IsConnected() {
 		return fmt.Errorf("[Raven] Error sending response, raven not connected")
 	}
 
-	err := Publisher.channel.Publish(
+	err := Publisher.publish(
 		REPLY_EXCHANGE, // publish to default exchange for reply-to
 		rsp.ReplyTo(),  // replyto becomes our routing key
-		false,          // mandatory
-		false,          // immediate
-		amqp.Publishing{
-			Headers: amqp.Table{
-				"messageType": rsp.MessageType(),
-			},
-			ContentType:     rsp.ContentType(),
-			ContentEncoding: contentEncoding,
-			Body:            rsp.Payload(),
-			DeliveryMode:    deliveryMode,
-			Priority:        defaultPriority,
-			CorrelationId:   rsp.MessageID(), // original msgid becomes the correlationid
-			ReplyTo:         InstanceID,      // incase they need to reply back; we say where it came from
-			// a bunch of application/implementation-specific fields
-		},
+		false,          // confirm
+		responsePublishing(rsp, InstanceID),
 	)
 
 	if err != nil {
@@ -55,53 +47,24 @@ func SendResponse(rsp Response, InstanceID string) error {
 }
 
 // SendRequest via AMQP
-func SendRequest(req Request, InstanceID string) error {
+func (t *AMQPTransport) SendRequest(req Request, InstanceID string) error {
 	log.Tracef("[Raven] Sending request %s to %s.%s, response back to %s", req.MessageID(), req.Service(), req.Endpoint(), InstanceID)
 
-	if !Connected {
+	if !t.IsConnected() {
 		return fmt.Errorf("[Raven] Error sending request, raven not connected")
 	}
 
-	// We only send string headers, so we can't send traceShouldPersistHeader as a bool
-	traceShouldPersistHeader := "0"
-	if req.TraceShouldPersist() {
-		traceShouldPersistHeader = "1"
-	}
-
-	authorisedHeader := "0"
-	if req.Authorised() {
-		authorisedHeader = "1"
-	}
-
-	err := Publisher.channel.Publish(
-		EXCHANGE, // publish to default exchange for reply-to
-		"",       // blank routing key
-		false,    // mandatory
-		false,    // immediate
-		amqp.Publishing{
-			Headers: amqp.Table{
-				"messageType":        "request",
-				"service":            req.Service(),
-				"endpoint":           req.Endpoint(),
-				"traceID":            req.TraceID(),
-				"traceShouldPersist": traceShouldPersistHeader,
-				"sessionID":          req.SessionID(),
-				"parentMessageID":    req.ParentMessageID(),
-				"from":               req.From(),
-				"remoteAddr":         req.RemoteAddr(),
-				"authorised":         authorisedHeader,
-			},
-			ContentType:     req.ContentType(),
-			ContentEncoding: contentEncoding,
-			Body:            req.Payload(),
-			DeliveryMode:    deliveryMode,
-			Priority:        defaultPriority,
-			MessageId:       req.MessageID(),
-			ReplyTo:         InstanceID,
-			// a bunch of application/implementation-specific fields
-		},
+	exchange, routingKey := requestRoute(req)
+	err := Publisher.publish(
+		exchange,   // the headers exchange, or the reply exchange to go straight to an instance
+		routingKey, // blank routing key, or the instance
+		true,       // confirm, if enabled
+		requestPublishing(req, InstanceID),
 	)
 
+	if err == ErrNoRoute {
+		return err
+	}
 	if err != nil {
 		return fmt.Errorf("Error sending request: %v", err)
 	}
@@ -110,33 +73,19 @@ func SendRequest(req Request, InstanceID string) error {
 }
 
 // SendPublication via AMQP
-func SendPublication(pub Publication, InstanceID string) error {
+func (t *AMQPTransport) SendPublication(pub Publication, InstanceID string) error {
 	log.Tracef("[Raven] Sending publication to topic: %s", pub.Topic())
 
-	if !Connected {
+	if !t.IsConnected() {
 		return fmt.Errorf("[Raven] Error sending publication, raven not connected")
 	}
 
-	err := Publisher.channel.Publish(
+	err := Publisher.publish(
 		TOPIC_EXCHANGE, // publish to topic exchange
 		pub.Topic(),    // routing key = topic
-		false,          // mandatory
-		false,          // immediate
-		amqp.Publishing{
-			Headers: amqp.Table{
-				"messageType": "publication",
-				"topic":       pub.Topic(),
-				"sessionID":   pub.SessionID(),
-			},
-			ContentType:     pub.ContentType(),
-			ContentEncoding: contentEncoding,
-			Body:            pub.Payload(),
-			DeliveryMode:    deliveryMode,
-			Priority:        defaultPriority,
-			MessageId:       pub.MessageID(),
-			ReplyTo:         InstanceID,
-			// a bunch of application/implementation-specific fields
-		})
+		false,          // confirm
+		publicationPublishing(pub, InstanceID),
+	)
 
 	if err != nil {
 		return fmt.Errorf("Error sending publication: %s", err)
@@ -146,31 +95,18 @@ func SendPublication(pub Publication, InstanceID string) error {
 }
 
 // SendHeartbeat via AMQP
-func SendHeartbeat(hb Heartbeat, InstanceID string) error {
+func (t *AMQPTransport) SendHeartbeat(hb Heartbeat, InstanceID string) error {
 	log.Tracef("[Raven] Sending heartbeat to: %s", hb.ID())
 
-	if !Connected {
+	if !t.IsConnected() {
 		return fmt.Errorf("[Raven] Error sending heartbeat, raven not connected")
 	}
 
-	err := Publisher.channel.Publish(
+	err := Publisher.publish(
 		REPLY_EXCHANGE, // publish to default exchange for reply-to
 		hb.ID(),        // routing key
-		false,          // mandatory
-		false,          // immediate
-		amqp.Publishing{
-			Headers: amqp.Table{
-				"messageType": "heartbeat",
-				"heartbeat":   "ping",
-			},
-			ContentType:     hb.ContentType(),
-			ContentEncoding: contentEncoding,
-			Body:            hb.Payload(),
-			DeliveryMode:    deliveryMode,
-			Priority:        heartbeatPriority,
-			ReplyTo:         InstanceID,
-			// a bunch of application/implementation-specific fields
-		},
+		false,          // confirm
+		heartbeatPublishing(hb, InstanceID),
 	)
 
 	if err != nil {
@@ -179,3 +115,205 @@ func SendHeartbeat(hb Heartbeat, InstanceID string) error {
 
 	return nil
 }
+
+// Forward republishes a delivery directly to a queue via AMQP
+func (t *AMQPTransport) Forward(queue string, d amqp.Delivery, headers amqp.Table) error {
+	log.Tracef("[Raven] Forwarding %s to queue %s", d.MessageId, queue)
+
+	if !t.IsConnected() {
+		return fmt.Errorf("[Raven] Error forwarding, raven not connected")
+	}
+
+	err := Publisher.publish(
+		"",    // default exchange routes straight to the queue
+		queue, // routing key = queue name
+		true,  // confirm, if enabled
+		forwardPublishing(d, headers),
+	)
+
+	if err != nil {
+		return fmt.Errorf("[Raven] Error forwarding to %s: %v", queue, err)
+	}
+
+	return nil
+}
+
+// ForwardAfter republishes a delivery via a retry queue, so it arrives on the queue once delay has passed
+func (t *AMQPTransport) ForwardAfter(queue string, d amqp.Delivery, headers amqp.Table, delay time.Duration) error {
+	retryQueue := RetryQueue(queue, delay)
+	log.Tracef("[Raven] Forwarding %s to queue %s via %s", d.MessageId, queue, retryQueue)
+
+	if !t.IsConnected() {
+		return fmt.Errorf("[Raven] Error forwarding, raven not connected")
+	}
+
+	if _, err := Publisher.Channel().QueueDeclare(
+		retryQueue,            // name of the queue
+		true,                  // durable
+		false,                 // delete when usused
+		false,                 // exclusive
+		false,                 // noWait
+		retryQueueArgs(queue), // arguments
+	); err != nil {
+		return fmt.Errorf("[Raven] Queue declare failed \"%s\": %v", retryQueue, err)
+	}
+
+	err := Publisher.publish(
+		"",         // default exchange routes straight to the queue
+		retryQueue, // routing key = queue name
+		true,       // confirm, if enabled
+		delayedPublishing(d, headers, delay),
+	)
+
+	if err != nil {
+		return fmt.Errorf("[Raven] Error forwarding to %s: %v", retryQueue, err)
+	}
+
+	return nil
+}
+
+// responsePublishing builds the message we send for a response, whichever transport it goes over
+func responsePublishing(rsp Response, InstanceID string) amqp.Publishing {
+	headers := amqp.Table{
+		"messageType": rsp.MessageType(),
+	}
+	if cc, ok := rsp.(CacheControlled); ok && cc.CacheControl() != "" {
+		headers["cacheControl"] = cc.CacheControl()
+	}
+	if sq, ok := rsp.(Sequenced); ok && sq.Sequence() > 0 {
+		headers["sequence"] = strconv.FormatUint(sq.Sequence(), 10)
+		if sq.EndOfStream() {
+			headers["endOfStream"] = "1"
+		}
+	}
+
+	return compress(rsp, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     rsp.ContentType(),
+		ContentEncoding: contentEncoding,
+		Body:            rsp.Payload(),
+		DeliveryMode:    deliveryMode,
+		Priority:        defaultPriority,
+		CorrelationId:   rsp.MessageID(), // original msgid becomes the correlationid
+		ReplyTo:         InstanceID,      // incase they need to reply back; we say where it came from
+		// a bunch of application/implementation-specific fields
+	})
+}
+
+// requestPublishing builds the message we send for a request, whichever transport it goes over
+func requestPublishing(req Request, InstanceID string) amqp.Publishing {
+	// We only send string headers, so we can't send traceShouldPersistHeader as a bool
+	traceShouldPersistHeader := "0"
+	if req.TraceShouldPersist() {
+		traceShouldPersistHeader = "1"
+	}
+
+	authorisedHeader := "0"
+	if req.Authorised() {
+		authorisedHeader = "1"
+	}
+
+	// The deadline is sent as unix nanoseconds, blank if there isn't one
+	deadlineHeader := ""
+	if deadline := req.Deadline(); !deadline.IsZero() {
+		deadlineHeader = strconv.FormatInt(deadline.UnixNano(), 10)
+	}
+
+	headers := amqp.Table{
+		"messageType":        "request",
+		"service":            req.Service(),
+		"endpoint":           req.Endpoint(),
+		"traceID":            req.TraceID(),
+		"traceShouldPersist": traceShouldPersistHeader,
+		"sessionID":          req.SessionID(),
+		"parentMessageID":    req.ParentMessageID(),
+		"from":               req.From(),
+		"remoteAddr":         req.RemoteAddr(),
+		"authorised":         authorisedHeader,
+		"deadline":           deadlineHeader,
+		"acceptEncoding":     acceptedEncodings,
+	}
+	if st, ok := req.(Streamed); ok && st.StreamWindow() > 0 {
+		headers["streamWindow"] = strconv.Itoa(st.StreamWindow())
+	}
+
+	return compress(req, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     req.ContentType(),
+		ContentEncoding: contentEncoding,
+		Body:            req.Payload(),
+		DeliveryMode:    deliveryMode,
+		Priority:        req.Priority(),
+		MessageId:       req.MessageID(),
+		ReplyTo:         InstanceID,
+		// a bunch of application/implementation-specific fields
+	})
+}
+
+// publicationPublishing builds the message we send for a publication, whichever transport it goes over
+func publicationPublishing(pub Publication, InstanceID string) amqp.Publishing {
+	return compress(pub, amqp.Publishing{
+		Headers: amqp.Table{
+			"messageType": "publication",
+			"topic":       pub.Topic(),
+			"sessionID":   pub.SessionID(),
+		},
+		ContentType:     pub.ContentType(),
+		ContentEncoding: contentEncoding,
+		Body:            pub.Payload(),
+		DeliveryMode:    publicationDeliveryMode,
+		Priority:        defaultPriority,
+		MessageId:       pub.MessageID(),
+		ReplyTo:         InstanceID,
+		// a bunch of application/implementation-specific fields
+	})
+}
+
+// heartbeatPublishing builds the message we send for a heartbeat, whichever transport it goes over
+func heartbeatPublishing(hb Heartbeat, InstanceID string) amqp.Publishing {
+	return amqp.Publishing{
+		Headers: amqp.Table{
+			"messageType": "heartbeat",
+			"heartbeat":   "ping",
+		},
+		ContentType:     hb.ContentType(),
+		ContentEncoding: contentEncoding,
+		Body:            hb.Payload(),
+		DeliveryMode:    deliveryMode,
+		Priority:        heartbeatPriority,
+		ReplyTo:         InstanceID,
+		// a bunch of application/implementation-specific fields
+	}
+}
+
+// forwardPublishing turns a delivery back into a persistent message, adding some headers, whichever transport it goes
+// over
+func forwardPublishing(d amqp.Delivery, extra amqp.Table) amqp.Publishing {
+	headers := make(amqp.Table, len(d.Headers)+len(extra))
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	for k, v := range extra {
+		headers[k] = v
+	}
+
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		Body:            d.Body,
+		DeliveryMode:    amqp.Persistent,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		MessageId:       d.MessageId,
+		ReplyTo:         d.ReplyTo,
+	}
+}
+
+// delayedPublishing is a forwardPublishing which expires after delay, whichever transport it goes over
+func delayedPublishing(d amqp.Delivery, extra amqp.Table, delay time.Duration) amqp.Publishing {
+	p := forwardPublishing(d, extra)
+	p.Expiration = strconv.FormatInt(int64(delay/time.Millisecond), 10)
+
+	return p
+}
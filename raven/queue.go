@@ -0,0 +1,445 @@
+package raven
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/streadway/amqp"
+)
+
+// memoryQueue is a queue within the MemoryBroker
+type memoryQueue struct {
+	sync.Mutex
+	broker      *MemoryBroker
+	name        string
+	autoDelete  bool
+	ttl         time.Duration // x-message-ttl, zero means messages never expire
+	expires     time.Duration // x-expires, zero means the queue never expires
+	messages    []*memoryMessage
+	consumers   map[string]*memoryConsumer
+	hadConsumer bool
+	lastUsed    time.Time
+	deliveryTag uint64
+	deleted     bool
+	// wait is closed (and replaced) whenever there is something new for consumers to look at
+	wait chan struct{}
+	// deadLetter is set when expired messages are republished to deadLetterExchange (x-dead-letter-exchange), with
+	// deadLetterKey (x-dead-letter-routing-key) or otherwise their original routing key
+	deadLetter         bool
+	deadLetterExchange string
+	deadLetterKey      string
+}
+
+// memoryConsumer is a single consumer of a memoryQueue
+type memoryConsumer struct {
+	tag        string
+	autoAck    bool
+	prefetch   int // how many unacked deliveries we can have at once, zero for no limit
+	deliveries chan amqp.Delivery
+	done       chan struct{}
+	// unacked are messages delivered but not yet acknowledged, by delivery tag, when not auto-acking
+	unacked map[uint64]*memoryMessage
+}
+
+// memoryAcknowledger settles deliveries made to a consumer which isn't auto-acking
+type memoryAcknowledger struct {
+	q *memoryQueue
+	c *memoryConsumer
+}
+
+func newMemoryQueue(b *MemoryBroker, name string, autoDelete bool, args amqp.Table) *memoryQueue {
+	q := &memoryQueue{
+		broker:     b,
+		name:       name,
+		autoDelete: autoDelete,
+		ttl:        tableDuration(args, "x-message-ttl"),
+		expires:    tableDuration(args, "x-expires"),
+		consumers:  make(map[string]*memoryConsumer),
+		wait:       make(chan struct{}),
+	}
+	if exchange, ok := args["x-dead-letter-exchange"].(string); ok {
+		q.deadLetter, q.deadLetterExchange = true, exchange
+		q.deadLetterKey, _ = args["x-dead-letter-routing-key"].(string)
+	}
+
+	return q
+}
+
+// touch marks the queue as used, and (re)starts the expiry timer if the queue is sitting idle
+func (q *memoryQueue) touch() {
+	q.Lock()
+	defer q.Unlock()
+
+	q.lastUsed = time.Now()
+	if q.expires > 0 && len(q.consumers) == 0 {
+		time.AfterFunc(q.expires, func() {
+			q.broker.expire(q)
+		})
+	}
+}
+
+// unusedFor returns whether the queue has had no consumers for at least d
+func (q *memoryQueue) unusedFor(d time.Duration) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	return !q.deleted && len(q.consumers) == 0 && time.Since(q.lastUsed) >= d
+}
+
+// enqueue adds a message to the back of the queue and wakes up consumers. When expired messages are dead lettered,
+// they have to go once their TTL is up whether or not anything is consuming, so we check back then
+func (q *memoryQueue) enqueue(m *memoryMessage) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.deleted {
+		return
+	}
+	q.messages = append(q.messages, m)
+	q.broadcast()
+
+	if ttl, ok := q.messageTTL(m); ok && q.deadLetter {
+		time.AfterFunc(ttl, q.expireMessages)
+	}
+}
+
+// requeue puts a message back on the front of the queue, eg: when the consumer it was headed for went away
+func (q *memoryQueue) requeue(m *memoryMessage) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.deleted {
+		return
+	}
+	q.messages = append([]*memoryMessage{m}, q.messages...)
+	q.broadcast()
+}
+
+// broadcast wakes up anything waiting on the queue - must be called with the lock held
+func (q *memoryQueue) broadcast() {
+	close(q.wait)
+	q.wait = make(chan struct{})
+}
+
+// length returns the number of (unexpired) messages waiting
+func (q *memoryQueue) length() int {
+	q.Lock()
+	expired := q.dropExpired()
+	l := len(q.messages)
+	q.Unlock()
+
+	q.deadLetterMessages(expired)
+	return l
+}
+
+// messageTTL returns how long a message lives on the queue, from the queue's TTL or its own expiration, whichever is
+// sooner, and whether it expires at all
+func (q *memoryQueue) messageTTL(m *memoryMessage) (time.Duration, bool) {
+	ttl, ok := q.ttl, q.ttl > 0
+	if ms, err := strconv.ParseInt(m.publishing.Expiration, 10, 64); err == nil && ms >= 0 {
+		if expiration := time.Duration(ms) * time.Millisecond; !ok || expiration < ttl {
+			ttl, ok = expiration, true
+		}
+	}
+
+	return ttl, ok
+}
+
+// dropExpired removes messages from the front of the queue which have outlived their TTL, returning them to be dead
+// lettered. As with RabbitMQ, only the front of the queue is checked - must be called with the lock held
+func (q *memoryQueue) dropExpired() []*memoryMessage {
+	i := 0
+	for i < len(q.messages) {
+		ttl, ok := q.messageTTL(q.messages[i])
+		if !ok || time.Since(q.messages[i].enqueued) < ttl {
+			break
+		}
+		i++
+	}
+
+	expired := q.messages[:i]
+	q.messages = q.messages[i:]
+	return expired
+}
+
+// expireMessages drops expired messages, dead lettering them
+func (q *memoryQueue) expireMessages() {
+	q.Lock()
+	expired := q.dropExpired()
+	q.Unlock()
+
+	q.deadLetterMessages(expired)
+}
+
+// deadLetterMessages republishes expired or rejected messages to the dead letter exchange, if the queue has one,
+// dropping them otherwise. Like RabbitMQ we strip their expiration, so they don't expire again - must be called without
+// the lock held
+func (q *memoryQueue) deadLetterMessages(messages []*memoryMessage) {
+	if !q.deadLetter {
+		return
+	}
+
+	for _, m := range messages {
+		p := m.publishing
+		p.Expiration = ""
+		key := q.deadLetterKey
+		if key == "" {
+			key = m.routingKey
+		}
+		if _, err := q.broker.Publish(q.deadLetterExchange, key, p); err != nil {
+			log.Warnf("[Raven] Failed to dead letter message %s from \"%s\": %v", p.MessageId, q.name, err)
+		}
+	}
+}
+
+// next blocks until there is a message to hand to a consumer (and it is within its prefetch limit), returning false if
+// the consumer or queue goes away
+func (q *memoryQueue) next(c *memoryConsumer) (*memoryMessage, uint64, bool) {
+	for {
+		q.Lock()
+		if q.deleted {
+			q.Unlock()
+			return nil, 0, false
+		}
+		if expired := q.dropExpired(); len(expired) > 0 {
+			q.Unlock()
+			q.deadLetterMessages(expired)
+			continue
+		}
+		if len(q.messages) > 0 && (c.prefetch <= 0 || len(c.unacked) < c.prefetch) {
+			m := q.messages[0]
+			q.messages = q.messages[1:]
+			q.deliveryTag++
+			tag := q.deliveryTag
+			if !c.autoAck {
+				c.unacked[tag] = m
+			}
+			q.Unlock()
+			return m, tag, true
+		}
+		wait := q.wait
+		q.Unlock()
+
+		select {
+		case <-wait:
+		case <-c.done:
+			return nil, 0, false
+		}
+	}
+}
+
+// consume registers a new consumer and starts feeding it messages. Unless autoAck is set, messages stay with the
+// consumer until acknowledged, and go back on the queue if rejected or the consumer goes away
+func (q *memoryQueue) consume(tag string, autoAck bool) (<-chan amqp.Delivery, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.deleted {
+		return nil, fmt.Errorf("[Raven] No queue \"%s\"", q.name)
+	}
+	if _, ok := q.consumers[tag]; ok {
+		return nil, fmt.Errorf("[Raven] Consumer tag \"%s\" already in use on queue \"%s\"", tag, q.name)
+	}
+
+	c := &memoryConsumer{
+		tag:        tag,
+		autoAck:    autoAck,
+		deliveries: make(chan amqp.Delivery),
+		done:       make(chan struct{}),
+		unacked:    make(map[uint64]*memoryMessage),
+	}
+	q.consumers[tag] = c
+	q.hadConsumer = true
+
+	go q.feed(c)
+
+	return c.deliveries, nil
+}
+
+// feed pushes messages to a consumer until it is cancelled or the queue is deleted
+func (q *memoryQueue) feed(c *memoryConsumer) {
+	defer close(c.deliveries)
+
+	for {
+		m, deliveryTag, ok := q.next(c)
+		if !ok {
+			return
+		}
+
+		d := m.delivery(c.tag, deliveryTag)
+		if !c.autoAck {
+			d.Acknowledger = &memoryAcknowledger{q: q, c: c}
+		}
+
+		select {
+		case c.deliveries <- d:
+		case <-c.done:
+			// unacked messages have already been put back by cancel
+			if c.autoAck {
+				q.requeue(m)
+			}
+			return
+		}
+	}
+}
+
+// cancel stops a consumer, auto-deleting the queue if that was the last one
+func (q *memoryQueue) cancel(tag string) error {
+	q.Lock()
+	c, ok := q.consumers[tag]
+	if !ok {
+		q.Unlock()
+		return fmt.Errorf("[Raven] No consumer \"%s\" on queue \"%s\"", tag, q.name)
+	}
+	delete(q.consumers, tag)
+	close(c.done)
+	remaining := len(q.consumers)
+	q.returnMessages(c.unacked)
+	q.Unlock()
+
+	if remaining == 0 {
+		if q.autoDelete {
+			q.broker.autoDelete(q)
+		} else {
+			q.touch()
+		}
+	}
+
+	return nil
+}
+
+// returnMessages puts delivered messages back on the front of the queue in their original order, removing them from
+// the map - must be called with the lock held
+func (q *memoryQueue) returnMessages(unacked map[uint64]*memoryMessage) {
+	if len(unacked) == 0 || q.deleted {
+		return
+	}
+
+	q.messages = append(inTagOrder(unacked), q.messages...)
+	q.broadcast()
+}
+
+// inTagOrder returns delivered messages in the order they were delivered, removing them from the map
+func inTagOrder(unacked map[uint64]*memoryMessage) []*memoryMessage {
+	tags := make([]uint64, 0, len(unacked))
+	for tag := range unacked {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+
+	messages := make([]*memoryMessage, 0, len(tags))
+	for _, tag := range tags {
+		messages = append(messages, unacked[tag])
+		delete(unacked, tag)
+	}
+	return messages
+}
+
+// settle acks or rejects one delivery (or with multiple, every delivery up to and including it), either putting
+// rejected messages back on the queue or dead lettering them, as RabbitMQ does
+func (q *memoryQueue) settle(c *memoryConsumer, deliveryTag uint64, multiple, reject, requeue bool) error {
+	q.Lock()
+
+	if _, ok := c.unacked[deliveryTag]; !ok {
+		q.Unlock()
+		return fmt.Errorf("[Raven] Unknown delivery tag %d on queue \"%s\"", deliveryTag, q.name)
+	}
+
+	settled := make(map[uint64]*memoryMessage)
+	for tag, m := range c.unacked {
+		if tag == deliveryTag || (multiple && tag < deliveryTag) {
+			settled[tag] = m
+			delete(c.unacked, tag)
+		}
+	}
+
+	var rejected []*memoryMessage
+	switch {
+	case reject && requeue:
+		q.returnMessages(settled)
+	case reject:
+		rejected = inTagOrder(settled)
+	}
+	// there may be room under the prefetch limit now
+	q.broadcast()
+	q.Unlock()
+
+	q.deadLetterMessages(rejected)
+	return nil
+}
+
+// setPrefetch changes how many unacked deliveries a consumer can have at once
+func (q *memoryQueue) setPrefetch(tag string, count int) error {
+	q.Lock()
+	defer q.Unlock()
+
+	c, ok := q.consumers[tag]
+	if !ok {
+		return fmt.Errorf("[Raven] No consumer \"%s\" on queue \"%s\"", tag, q.name)
+	}
+	c.prefetch = count
+	q.broadcast()
+
+	return nil
+}
+
+// Ack acknowledges a delivery, removing it for good
+func (a *memoryAcknowledger) Ack(tag uint64, multiple bool) error {
+	return a.q.settle(a.c, tag, multiple, false, false)
+}
+
+// Nack rejects a delivery, putting it back on the queue if requeue is set, or dead lettering it if not
+func (a *memoryAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	return a.q.settle(a.c, tag, multiple, true, requeue)
+}
+
+// Reject rejects a single delivery, putting it back on the queue if requeue is set, or dead lettering it if not
+func (a *memoryAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.q.settle(a.c, tag, false, true, requeue)
+}
+
+// delete marks the queue as gone, which drops any messages and closes all consumers
+func (q *memoryQueue) delete() {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.deleted {
+		return
+	}
+	q.deleted = true
+	q.messages = nil
+	for tag, c := range q.consumers {
+		close(c.done)
+		delete(q.consumers, tag)
+	}
+	q.broadcast()
+}
+
+// delivery turns a message into what a consumer receives
+func (m *memoryMessage) delivery(consumerTag string, deliveryTag uint64) amqp.Delivery {
+	p := m.publishing
+	return amqp.Delivery{
+		Headers:         p.Headers,
+		ContentType:     p.ContentType,
+		ContentEncoding: p.ContentEncoding,
+		DeliveryMode:    p.DeliveryMode,
+		Priority:        p.Priority,
+		CorrelationId:   p.CorrelationId,
+		ReplyTo:         p.ReplyTo,
+		Expiration:      p.Expiration,
+		MessageId:       p.MessageId,
+		Timestamp:       p.Timestamp,
+		Type:            p.Type,
+		UserId:          p.UserId,
+		AppId:           p.AppId,
+		ConsumerTag:     consumerTag,
+		DeliveryTag:     deliveryTag,
+		Exchange:        m.exchange,
+		RoutingKey:      m.routingKey,
+		Body:            p.Body,
+	}
+}
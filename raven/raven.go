@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/cenkalti/backoff"
 	log "github.com/cihub/seelog"
 	"github.com/streadway/amqp"
 )
@@ -38,10 +40,11 @@ var (
 	// Publisher represents the channel we send messages on
 	Publisher *AMQPChannel
 	// Consumer represents the channel we consume message on
-	Consumer  *AMQPChannel
+	Consumer *AMQPChannel
+	// Connected says whether the current transport is connected, kept up to date as its state changes
+	//
+	// Deprecated: use IsConnected, or Subscribe to hear about changes
 	Connected bool
-
-	quitChan chan struct{}
 )
 
 func init() {
@@ -72,8 +75,9 @@ func init() {
 
 	// connect Send channel
 	Publisher = &AMQPChannel{
-		name: "publisher",
-		conn: Connection,
+		name:        "publisher",
+		conn:        Connection,
+		confirmable: true,
 	}
 
 	// connect Consume channel
@@ -83,65 +87,146 @@ func init() {
 	}
 }
 
-// Connect to AMQP + channels
-func Connect() chan bool {
-	quitChan = make(chan struct{})
+// AMQPTransport is the default Transport, which talks to RabbitMQ over the package level Connection, Publisher and
+// Consumer. Whenever the connection drops it reconnects with backoff, re-declaring and re-binding the queues it was
+// consuming from
+type AMQPTransport struct {
+	stateNotifier
 
-	ch := make(chan bool)
-	go keepalive(ch)
-	return ch
+	mtx       sync.Mutex
+	running   bool
+	quit      chan struct{}
+	consumers map[string]*queueConsumer
+	prefetch  int
 }
 
-func Disconnect() {
-	quitChan <- struct{}{}
+// NewAMQPTransport mints a new, unconnected AMQP transport
+func NewAMQPTransport() *AMQPTransport {
+	return &AMQPTransport{
+		consumers: make(map[string]*queueConsumer),
+	}
 }
 
-func keepalive(ch chan bool) {
-	var (
-		conn  chan *amqp.Error
-		pubCh chan *amqp.Error
-		conCh chan *amqp.Error
-	)
+// Connect to AMQP + channels, and keep reconnecting until Disconnect is called
+func (t *AMQPTransport) Connect() {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
 
-	for {
-		// Attempt to connect if not already
-		if !Connected {
-			if err := connect(); err != nil {
-				log.Criticalf("[Raven] Failed to reconnect: %v", err)
-				time.Sleep(1 * time.Second)
-				continue
-			}
+	if t.running {
+		return
+	}
+	t.running = true
+	t.quit = make(chan struct{})
 
-			// Connection succesful
-			Connected = true
+	go t.keepalive(t.quit)
+}
 
-			// Attempt to handle the various connection errors
-			conn = Connection.NotifyClose()
-			pubCh = Publisher.NotifyClose()
-			conCh = Consumer.NotifyClose()
+// Disconnect stops us reconnecting. The current connection is left open so that in flight requests can still be
+// responded to, and we move to StateClosed once it goes away
+func (t *AMQPTransport) Disconnect() {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if !t.running {
+		return
+	}
+	t.running = false
+	close(t.quit)
+}
+
+// IsConnected returns the status of the raven connection
+func (t *AMQPTransport) IsConnected() bool {
+	return t.State() == StateConnected
+}
+
+// Node returns the host:port of the broker we are attached to, or an empty string if we are not connected
+func (t *AMQPTransport) Node() string {
+	if !t.IsConnected() {
+		return ""
+	}
+
+	return Connection.Node()
+}
+
+// reconnectBackoff is how long we wait between connection attempts; we never give up
+func reconnectBackoff() backoff.BackOff {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = 100 * time.Millisecond
+	b.MaxInterval = 10 * time.Second
+	b.MaxElapsedTime = 0
+	b.Reset()
+
+	return b
+}
+
+// keepalive connects, and reconnects each time the connection is lost, until quit is closed. We work through the
+// broker list in order, moving on to the next broker whenever we fail to connect or lose the connection
+func (t *AMQPTransport) keepalive(quit chan struct{}) {
+	b := reconnectBackoff()
+	node := 0
+
+	for {
+		t.setState(StateConnecting, nil)
+
+		uris := brokerUris()
+		err := connect(uris[node%len(uris)])
+		if err == nil {
+			if err = t.restoreConsumers(); err != nil {
+				closeConnection()
+			}
+		}
+		if err != nil {
+			node++
+			wait := b.NextBackOff()
+			log.Criticalf("[Raven] Failed to connect: %v, retrying in %v", err, wait)
+			t.setState(StateDisconnected, err)
 
-			// Notify our listeners that we are good to go
 			select {
-			case ch <- true:
-			case <-time.After(1 * time.Second):
+			case <-quit:
+				log.Criticalf("[Raven] Manually disconnected")
+				t.close(err)
+				return
+			case <-time.After(wait):
 			}
+			continue
 		}
 
+		// Connection succesful
+		b.Reset()
+		t.setState(StateConnected, nil)
+
+		err = t.supervise(quit, Connection.NotifyClose(), Publisher.NotifyClose(), Consumer.NotifyClose())
+		closeConnection()
+
 		select {
-		case <-quitChan:
-			log.Criticalf("[Raven] Manually disconnected")
-			ch <- false
+		case <-quit:
+			t.close(err)
 			return
-		case err := <-conn:
-			log.Criticalf("[Raven] Disconnected: %v, recoverable: %v", err, err.Recover)
-			Connected = false
-			// Notify our listeners
-			select {
-			case ch <- false:
-			case <-time.After(1 * time.Second):
+		default:
+		}
+		t.setState(StateDisconnected, err)
+
+		// fail over to the next broker
+		node++
+	}
+}
+
+// supervise watches a live connection, re-establishing channels as they close, until the connection itself is lost.
+// Once we return nobody reads the close channels, which is fine as they have room for the close (see newCloseChan)
+func (t *AMQPTransport) supervise(quit chan struct{}, conn, pubCh, conCh <-chan *amqp.Error) error {
+	for {
+		select {
+		case <-quit:
+			log.Criticalf("[Raven] Manually disconnected, will not reconnect")
+			// keep the connection for in flight requests, but stop listening for quit
+			quit = nil
+
+		case err, ok := <-conn:
+			if !ok {
+				return fmt.Errorf("[Raven] Connection closed")
 			}
-			// brute force for now until we work out why deliveries channel on consumer isn't being closed
-			die(err)
+			log.Criticalf("[Raven] Disconnected: %v, recoverable: %v", err, err.Recover)
+			return err
 
 		case err, ok := <-conCh:
 			if ok {
@@ -152,9 +237,13 @@ func keepalive(ch chan bool) {
 			if err := Consumer.Close(); err != nil {
 				log.Warnf("[Raven] Unable to forcefully close the consumer chan: %v", err)
 			}
-			// Attempt to reconnect if possible
+			// Attempt to reconnect if possible, otherwise start again with a new connection
 			if err := Consumer.connect(); err != nil {
-				die(err)
+				return err
+			}
+			// consumers go away with their channel, so start them up again
+			if err := t.restoreConsumers(); err != nil {
+				return err
 			}
 			// We are good again
 			conCh = Consumer.NotifyClose()
@@ -168,27 +257,30 @@ func keepalive(ch chan bool) {
 			if err := Publisher.Close(); err != nil {
 				log.Warnf("[Raven] Unable to forcefully close the publisher chan: %v", err)
 			}
-			// Attempt to reconnect if possible
+			// Attempt to reconnect if possible, otherwise start again with a new connection
 			if err := Publisher.connect(); err != nil {
-				die(err)
+				return err
 			}
 			// We are good again
 			pubCh = Publisher.NotifyClose()
 		}
-
 	}
-
 }
 
-// die would bruteforcefully kill the binary
-func die(err error) {
-	log.Criticalf("[Raven] Terminating due to connection error: %v", err)
-	log.Flush()
-	os.Exit(8)
+// close moves us to StateClosed and closes the deliveries channels handed out by Consume
+func (t *AMQPTransport) close(err error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	for queue, c := range t.consumers {
+		c.close()
+		delete(t.consumers, queue)
+	}
+	t.setState(StateClosed, err)
 }
 
-func connect() error {
-	if err := Connection.connect(); err != nil {
+func connect(uri string) error {
+	if err := Connection.connect(uri); err != nil {
 		return err
 	}
 
@@ -206,9 +298,9 @@ func connect() error {
 	return nil
 }
 
-// IsConnected returns the status of the raven connection
-// Todo: we should probably write a proper conn manager with
-// locking and all.
-func IsConnected() bool {
-	return Connected
+// closeConnection makes sure the connection is gone before we make a new one
+func closeConnection() {
+	if err := Connection.Close(); err != nil {
+		log.Debugf("[Raven] Error closing connection: %v", err)
+	}
 }
@@ -0,0 +1,80 @@
+package raven
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/streadway/amqp"
+)
+
+func TestSuperviseReturnsWhenConnectionLost(t *testing.T) {
+	tr := NewAMQPTransport()
+	conn, pubCh, conCh := newCloseChan(), newCloseChan(), newCloseChan()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- tr.supervise(make(chan struct{}), conn, pubCh, conCh)
+	}()
+
+	// this is how the connection tells us it has gone away
+	conn <- &amqp.Error{Code: amqp.ConnectionForced, Reason: "broker shutting down"}
+	select {
+	case err := <-errs:
+		if aerr, ok := err.(*amqp.Error); !ok || aerr.Code != amqp.ConnectionForced {
+			t.Errorf("Expected the connection error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected supervise to return once the connection was lost")
+	}
+
+	// the channels close as the connection shuts down, with nobody listening any more, which mustn't block
+	for name, ch := range map[string]chan *amqp.Error{"publisher": pubCh, "consumer": conCh} {
+		select {
+		case ch <- &amqp.Error{Code: amqp.ChannelError, Reason: "connection closed"}:
+		default:
+			t.Errorf("Expected the %s channel closing not to block once we have stopped supervising", name)
+		}
+	}
+}
+
+func TestSuperviseReturnsWhenConnectionClosed(t *testing.T) {
+	tr := NewAMQPTransport()
+	conn := newCloseChan()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- tr.supervise(make(chan struct{}), conn, newCloseChan(), newCloseChan())
+	}()
+
+	close(conn)
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("Expected an error once the connection was closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected supervise to return once the connection was closed")
+	}
+}
+
+func TestReconnectBackoffNeverGivesUp(t *testing.T) {
+	b := reconnectBackoff()
+
+	var last time.Duration
+	for i := 0; i < 100; i++ {
+		last = b.NextBackOff()
+		if last == backoff.Stop {
+			t.Fatalf("Expected to keep retrying, gave up after %d attempts", i)
+		}
+	}
+	// the max interval, with the default randomisation either side of it
+	if last > 15*time.Second {
+		t.Errorf("Expected the wait to be capped, got %v", last)
+	}
+
+	b.Reset()
+	if first := b.NextBackOff(); first > 150*time.Millisecond {
+		t.Errorf("Expected a short wait after a reset, got %v", first)
+	}
+}
@@ -1,5 +1,9 @@
 package raven
 
+import (
+	"time"
+)
+
 // Request interface
 type Request interface {
 	ContentType() string
@@ -14,4 +18,26 @@ type Request interface {
 	ParentMessageID() string
 	Payload() []byte
 	Authorised() bool
+	Deadline() time.Time
+	Priority() uint8
+}
+
+// DirectRequest can be implemented by a request to send it straight to one instance's queue, rather than to whichever
+// instance of the service picks it up
+type DirectRequest interface {
+	Instance() string
+}
+
+// Streamed can be implemented by a request to ask for a stream of replies, saying how many the server may send before
+// it has to wait for more credit. It is sent in the streamWindow header
+type Streamed interface {
+	StreamWindow() int
+}
+
+// requestRoute returns the exchange and routing key to send a request with
+func requestRoute(req Request) (exchange, routingKey string) {
+	if d, ok := req.(DirectRequest); ok && d.Instance() != "" {
+		return REPLY_EXCHANGE, d.Instance()
+	}
+	return EXCHANGE, ""
 }
@@ -8,3 +8,22 @@ type Response interface {
 	ReplyTo() string
 	MessageID() string
 }
+
+// CacheControlled can be implemented by a response to say how long clients may cache it for, as a cache-control style
+// directive, eg: max-age=60. It is sent in the cacheControl header
+type CacheControlled interface {
+	CacheControl() string
+}
+
+// Sequenced can be implemented by a response that is one of a stream of replies to the same request. The sequence,
+// counting from 1, is sent in the sequence header, and the last reply of the stream has the endOfStream header set
+type Sequenced interface {
+	Sequence() uint64
+	EndOfStream() bool
+}
+
+// EncodingNegotiated can be implemented by a response to say which content encodings the caller can decode, as a
+// comma separated list from the acceptEncoding header of its request. Replies are only compressed with one of them
+type EncodingNegotiated interface {
+	AcceptEncoding() string
+}
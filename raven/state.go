@@ -0,0 +1,115 @@
+package raven
+
+import (
+	"sync"
+
+	log "github.com/cihub/seelog"
+)
+
+// State is the state of a transport's connection to its broker
+type State int
+
+const (
+	// StateDisconnected means we are not connected, but will keep trying
+	StateDisconnected State = iota
+	// StateConnecting means a connection attempt is in progress
+	StateConnecting
+	// StateConnected means we are connected, and consumers and bindings are in place
+	StateConnected
+	// StateClosed means we have been disconnected and will not try to reconnect
+	StateClosed
+)
+
+// subscriberBuffer is how many state changes we buffer for each subscriber before dropping them
+const subscriberBuffer = 10
+
+func (s State) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateClosed:
+		return "closed"
+	}
+
+	return "unknown"
+}
+
+// StateChange is sent to subscribers each time the connection state changes
+type StateChange struct {
+	From State
+	To   State
+	// Err is what caused the change, if anything
+	Err error
+}
+
+// stateNotifier tracks the connection state of a transport and fans out changes to subscribers
+type stateNotifier struct {
+	stateMtx    sync.RWMutex
+	state       State
+	subscribers map[chan StateChange]bool
+}
+
+// State returns the current connection state
+func (n *stateNotifier) State() State {
+	n.stateMtx.RLock()
+	defer n.stateMtx.RUnlock()
+
+	return n.state
+}
+
+// Subscribe returns a channel on which all future state changes are sent. Slow subscribers will miss changes rather
+// than blocking the connection
+func (n *stateNotifier) Subscribe() <-chan StateChange {
+	n.stateMtx.Lock()
+	defer n.stateMtx.Unlock()
+
+	if n.subscribers == nil {
+		n.subscribers = make(map[chan StateChange]bool)
+	}
+	ch := make(chan StateChange, subscriberBuffer)
+	n.subscribers[ch] = true
+
+	return ch
+}
+
+// Unsubscribe stops sending state changes to a channel returned by Subscribe, and closes it
+func (n *stateNotifier) Unsubscribe(ch <-chan StateChange) {
+	n.stateMtx.Lock()
+	defer n.stateMtx.Unlock()
+
+	for sub := range n.subscribers {
+		if sub == ch {
+			delete(n.subscribers, sub)
+			close(sub)
+			return
+		}
+	}
+}
+
+// setState moves to a new state, notifying subscribers if it is actually a change
+func (n *stateNotifier) setState(s State, err error) {
+	n.stateMtx.Lock()
+	if n.state == s {
+		n.stateMtx.Unlock()
+		return
+	}
+	change := StateChange{From: n.state, To: s, Err: err}
+	n.state = s
+
+	log.Debugf("[Raven] Connection state %v -> %v", change.From, change.To)
+
+	for sub := range n.subscribers {
+		select {
+		case sub <- change:
+		default:
+			log.Warnf("[Raven] Dropping state change %v -> %v for slow subscriber", change.From, change.To)
+		}
+	}
+	n.stateMtx.Unlock()
+
+	syncConnected()
+}
@@ -0,0 +1,66 @@
+package raven
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestStateNotifier(t *testing.T) {
+	n := &stateNotifier{}
+	changes := n.Subscribe()
+
+	n.setState(StateConnecting, nil)
+	n.setState(StateConnecting, nil)
+	n.setState(StateDisconnected, fmt.Errorf("connection refused"))
+
+	if change := <-changes; change.From != StateDisconnected || change.To != StateConnecting {
+		t.Errorf("Expected disconnected -> connecting, got %v -> %v", change.From, change.To)
+	}
+	change := <-changes
+	if change.From != StateConnecting || change.To != StateDisconnected || change.Err == nil {
+		t.Errorf("Expected connecting -> disconnected with the error, got %+v", change)
+	}
+	select {
+	case change := <-changes:
+		t.Errorf("Expected no change when the state stays the same, got %+v", change)
+	default:
+	}
+	if s := n.State(); s != StateDisconnected {
+		t.Errorf("Expected to be disconnected, got %v", s)
+	}
+
+	n.Unsubscribe(changes)
+	if _, ok := <-changes; ok {
+		t.Error("Changes channel should be closed once unsubscribed")
+	}
+}
+
+func TestStateNotifierDropsForSlowSubscribers(t *testing.T) {
+	n := &stateNotifier{}
+	changes := n.Subscribe()
+
+	// nobody is reading, which mustn't hold up the connection
+	for i := 0; i < subscriberBuffer*2; i++ {
+		n.setState(StateConnecting, nil)
+		n.setState(StateDisconnected, nil)
+	}
+	if len(changes) != subscriberBuffer {
+		t.Errorf("Expected %d changes buffered, got %d", subscriberBuffer, len(changes))
+	}
+}
+
+func TestConnectedFollowsTransport(t *testing.T) {
+	orig := GetTransport()
+	defer SetTransport(orig)
+
+	tr := NewMemoryTransport(NewMemoryBroker())
+	SetTransport(tr)
+	tr.Connect()
+	if !Connected {
+		t.Error("Expected Connected once the transport connected")
+	}
+	tr.Disconnect()
+	if Connected {
+		t.Error("Expected not Connected once the transport disconnected")
+	}
+}
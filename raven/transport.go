@@ -0,0 +1,207 @@
+package raven
+
+import (
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Transport is the messaging layer that carries requests, responses, publications and heartbeats between services.
+// AMQP is the default implementation, but anything satisfying this interface can be swapped in via SetTransport
+type Transport interface {
+	// Connect starts connecting in the background, reconnecting whenever the connection is lost. Progress can be
+	// followed via Subscribe
+	Connect()
+	// Disconnect stops us from reconnecting
+	Disconnect()
+	// IsConnected returns whether we are currently connected
+	IsConnected() bool
+	// Node returns the broker node we are attached to, or an empty string if we are not connected
+	Node() string
+	// State returns the current connection state
+	State() State
+	// Subscribe returns a channel on which connection state changes are sent
+	Subscribe() <-chan StateChange
+	// Unsubscribe stops sending state changes to a channel returned by Subscribe
+	Unsubscribe(ch <-chan StateChange)
+
+	// Consume declares a queue for this instance and starts consuming from it. The deliveries channel survives
+	// reconnects, with the queue re-declared and consumed from again each time we come back
+	Consume(queue string) (<-chan amqp.Delivery, error)
+	// ConsumeWithAck is like Consume, except deliveries must be acked, so the prefetch limit applies to them
+	ConsumeWithAck(queue string) (<-chan amqp.Delivery, error)
+	// SetPrefetch limits how many unacked deliveries the broker will send each of our consumers needing acks at once,
+	// zero meaning no limit. The limit is per consumer, so one busy queue can't stop deliveries on the others. It can
+	// be changed at any time, and survives reconnects
+	SetPrefetch(count int) error
+	// BindService binds a queue to receive requests sent to the named service, which is re-established on reconnect
+	BindService(serviceName, queue string) error
+	// BindTopic binds a queue to receive publications on a topic, which is re-established on reconnect
+	BindTopic(topic, queue string) error
+	// ConsumeDurable declares a named durable queue bound to a topic, along with its dead letter queue, and starts
+	// consuming from it. Every delivery must be acked
+	ConsumeDurable(queue, topic string) (<-chan amqp.Delivery, error)
+	// Forward republishes a delivery straight to a queue as a persistent message, with some extra headers
+	Forward(queue string, d amqp.Delivery, headers amqp.Table) error
+	// ForwardAfter is like Forward, except the message only arrives on the queue once delay has passed. Until then it
+	// waits in the broker on a durable retry queue (see RetryQueue), so nothing is held in memory
+	ForwardAfter(queue string, d amqp.Delivery, headers amqp.Table, delay time.Duration) error
+
+	// SendRequest sends a request, with replies going back to the instance ID supplied. When publisher confirms are
+	// enabled it returns ErrNoRoute if nothing is bound to receive requests for the service
+	SendRequest(req Request, instanceID string) error
+	// SendResponse sends a response back to whoever made the original request
+	SendResponse(rsp Response, instanceID string) error
+	// SendPublication sends a publication to a topic
+	SendPublication(pub Publication, instanceID string) error
+	// SendHeartbeat sends a heartbeat to some instance
+	SendHeartbeat(hb Heartbeat, instanceID string) error
+}
+
+var (
+	transport    Transport = NewAMQPTransport()
+	transportMtx sync.RWMutex
+)
+
+// SetTransport swaps out the transport used by the package level functions, eg: to an in-memory transport for tests.
+// It should be called before connecting
+func SetTransport(t Transport) {
+	transportMtx.Lock()
+	transport = t
+	transportMtx.Unlock()
+
+	syncConnected()
+}
+
+// syncConnected keeps the deprecated Connected up to date with the current transport
+func syncConnected() {
+	Connected = IsConnected()
+}
+
+// GetTransport returns the transport currently in use
+func GetTransport() Transport {
+	transportMtx.RLock()
+	defer transportMtx.RUnlock()
+	return transport
+}
+
+// Connect starts the current Transport connecting, returning a channel on which true is sent each time we connect
+// and false each time we lose the connection. Subscribe gives the full state transitions
+func Connect() chan bool {
+	t := GetTransport()
+	changes := t.Subscribe()
+	t.Connect()
+
+	ch := make(chan bool)
+	go func() {
+		for change := range changes {
+			var status bool
+			switch change.To {
+			case StateConnected:
+				status = true
+			case StateDisconnected, StateClosed:
+				status = false
+			default:
+				continue
+			}
+
+			select {
+			case ch <- status:
+			case <-time.After(1 * time.Second):
+			}
+		}
+	}()
+
+	return ch
+}
+
+// Disconnect is a wrapper around the current Transport's Disconnect
+func Disconnect() {
+	GetTransport().Disconnect()
+}
+
+// IsConnected is a wrapper around the current Transport's IsConnected
+func IsConnected() bool {
+	return GetTransport().IsConnected()
+}
+
+// Node is a wrapper around the current Transport's Node
+func Node() string {
+	return GetTransport().Node()
+}
+
+// ConnectionState is a wrapper around the current Transport's State
+func ConnectionState() State {
+	return GetTransport().State()
+}
+
+// Subscribe is a wrapper around the current Transport's Subscribe
+func Subscribe() <-chan StateChange {
+	return GetTransport().Subscribe()
+}
+
+// Unsubscribe is a wrapper around the current Transport's Unsubscribe
+func Unsubscribe(ch <-chan StateChange) {
+	GetTransport().Unsubscribe(ch)
+}
+
+// Consume is a wrapper around the current Transport's Consume
+func Consume(queue string) (<-chan amqp.Delivery, error) {
+	return GetTransport().Consume(queue)
+}
+
+// ConsumeWithAck is a wrapper around the current Transport's ConsumeWithAck
+func ConsumeWithAck(queue string) (<-chan amqp.Delivery, error) {
+	return GetTransport().ConsumeWithAck(queue)
+}
+
+// SetPrefetch is a wrapper around the current Transport's SetPrefetch
+func SetPrefetch(count int) error {
+	return GetTransport().SetPrefetch(count)
+}
+
+// BindService is a wrapper around the current Transport's BindService
+func BindService(serviceName, queue string) error {
+	return GetTransport().BindService(serviceName, queue)
+}
+
+// BindTopic is a wrapper around the current Transport's BindTopic
+func BindTopic(topic, queue string) error {
+	return GetTransport().BindTopic(topic, queue)
+}
+
+// ConsumeDurable is a wrapper around the current Transport's ConsumeDurable
+func ConsumeDurable(queue, topic string) (<-chan amqp.Delivery, error) {
+	return GetTransport().ConsumeDurable(queue, topic)
+}
+
+// Forward is a wrapper around the current Transport's Forward
+func Forward(queue string, d amqp.Delivery, headers amqp.Table) error {
+	return GetTransport().Forward(queue, d, headers)
+}
+
+// ForwardAfter is a wrapper around the current Transport's ForwardAfter
+func ForwardAfter(queue string, d amqp.Delivery, headers amqp.Table, delay time.Duration) error {
+	return GetTransport().ForwardAfter(queue, d, headers, delay)
+}
+
+// SendRequest is a wrapper around the current Transport's SendRequest
+func SendRequest(req Request, instanceID string) error {
+	return GetTransport().SendRequest(req, instanceID)
+}
+
+// SendResponse is a wrapper around the current Transport's SendResponse
+func SendResponse(rsp Response, instanceID string) error {
+	return GetTransport().SendResponse(rsp, instanceID)
+}
+
+// SendPublication is a wrapper around the current Transport's SendPublication
+func SendPublication(pub Publication, instanceID string) error {
+	return GetTransport().SendPublication(pub, instanceID)
+}
+
+// SendHeartbeat is a wrapper around the current Transport's SendHeartbeat
+func SendHeartbeat(hb Heartbeat, instanceID string) error {
+	return GetTransport().SendHeartbeat(hb, instanceID)
+}
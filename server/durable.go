@@ -0,0 +1,172 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/streadway/amqp"
+
+	"github.com/HailoOSS/platform/errors"
+	"github.com/HailoOSS/platform/raven"
+	inst "github.com/HailoOSS/service/instrumentation"
+)
+
+const (
+	defaultMaxAttempts = 5
+	defaultRetryDelay  = time.Second
+	maxRetryDelay      = 5 * time.Minute
+
+	// attemptsHeader counts how many times we have tried to handle a durable publication
+	attemptsHeader = "attempts"
+	// deadLetterHeader says why a publication was dead lettered
+	deadLetterHeader = "deadLetterReason"
+)
+
+// Durable turns on durable subscription for an endpoint with Subscribe set. Publications are delivered via a named
+// durable queue shared by all instances, and only acked once Handler succeeds. Failures are retried with backoff,
+// waiting out the delay in the broker (see raven.RetryQueue), then dead lettered to an inspectable queue (see
+// raven.DeadLetterQueue)
+type Durable struct {
+	// MaxAttempts is how many times we try to handle a publication before dead lettering it, default 5
+	MaxAttempts int
+	// RetryDelay is how long we wait before the first retry, doubling with each attempt, default 1s
+	RetryDelay time.Duration
+}
+
+func (d *Durable) maxAttempts() int {
+	if d.MaxAttempts <= 0 {
+		return defaultMaxAttempts
+	}
+	return d.MaxAttempts
+}
+
+// retryDelay is how long to wait before the next attempt, once we have made some number of attempts
+func (d *Durable) retryDelay(attempts int) time.Duration {
+	delay := d.RetryDelay
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+
+	backoff := time.Duration(float64(delay) * math.Pow(2, float64(attempts-1)))
+	if backoff > maxRetryDelay || backoff <= 0 {
+		return maxRetryDelay
+	}
+	return backoff
+}
+
+// durableQueue is the name of the durable queue an endpoint subscribes with, shared by all instances of the service
+func durableQueue(ep *Endpoint) string {
+	return fmt.Sprintf("%s.%s", Name, ep.Name)
+}
+
+// subscribeDurable starts consuming publications for all endpoints with durable subscriptions, handling them with the
+// same workers as requests
+func subscribeDurable(t raven.Transport, p *workerPool) error {
+	for _, ep := range reg.iterate() {
+		if ep.Subscribe == "" || ep.Durable == nil {
+			continue
+		}
+
+		queue := durableQueue(ep)
+		deliveries, err := t.ConsumeDurable(queue, ep.Subscribe)
+		if err != nil {
+			return err
+		}
+		log.Infof("[Server] Durably subscribed %s to %s via %s", ep.Name, ep.Subscribe, queue)
+
+		go func(ep *Endpoint, queue string, deliveries <-chan amqp.Delivery) {
+			for d := range deliveries {
+				p.acquire()
+				go func(d amqp.Delivery) {
+					defer p.release()
+					handleDurable(t, ep, queue, d)
+				}(d)
+			}
+		}(ep, queue, deliveries)
+	}
+
+	return nil
+}
+
+// handleDurable calls the endpoint for a durable publication, acking it on success. On failure it is forwarded to
+// come back on the queue after a delay, or dead lettered once we have run out of attempts, and acked either way so it
+// doesn't hold up the deliveries behind it
+func handleDurable(t raven.Transport, ep *Endpoint, queue string, d amqp.Delivery) {
+	err := callDurable(ep, NewRequestFromDelivery(d))
+	if err == nil {
+		if aerr := d.Ack(false); aerr != nil {
+			log.Errorf("[Server] Failed to ack publication %s: %v", d.MessageId, aerr)
+		}
+		return
+	}
+
+	attempts := deliveryAttempts(d) + 1
+	if attempts >= ep.Durable.maxAttempts() {
+		log.Errorf("[Server] Dead lettering publication %s on %s after %d attempts: %v", d.MessageId, queue, attempts, err)
+		inst.Counter(1.0, fmt.Sprintf("subscription.%s.deadlettered", ep.Name), 1)
+		settleDurable(d, t.Forward(raven.DeadLetterQueue(queue), d, amqp.Table{
+			attemptsHeader:   int32(attempts),
+			deadLetterHeader: err.Error(),
+		}))
+		return
+	}
+
+	delay := ep.Durable.retryDelay(attempts)
+	log.Warnf("[Server] Failed to process publication %s on %s (attempt %d), retrying in %v: %v", d.MessageId, queue,
+		attempts, delay, err)
+	inst.Counter(1.0, fmt.Sprintf("subscription.%s.retried", ep.Name), 1)
+	settleDurable(d, t.ForwardAfter(queue, d, amqp.Table{attemptsHeader: int32(attempts)}, delay))
+}
+
+// settleDurable acks a publication once it has been forwarded on, or puts it straight back if that failed so it is
+// not lost
+func settleDurable(d amqp.Delivery, forwardErr error) {
+	if forwardErr != nil {
+		log.Errorf("[Server] Failed to forward publication %s, requeueing: %v", d.MessageId, forwardErr)
+		if err := d.Nack(false, true); err != nil {
+			log.Errorf("[Server] Failed to requeue publication %s: %v", d.MessageId, err)
+		}
+		return
+	}
+
+	if err := d.Ack(false); err != nil {
+		log.Errorf("[Server] Failed to ack publication %s: %v", d.MessageId, err)
+	}
+}
+
+// callDurable runs the endpoint handler for a publication, turning panics into errors
+func callDurable(ep *Endpoint, req *Request) (err errors.Error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Criticalf("[Server] Panic \"%v\" when handling publication %s on %s", r, req.MessageID(), ep.Name)
+			inst.Counter(1.0, "runtime.panic", 1)
+			publishFailure(r)
+			err = errors.InternalServerError("com.HailoOSS.kernel.server.panic", fmt.Sprintf("Panic: %v", r))
+		}
+	}()
+
+	data, err := ep.unmarshalRequest(req)
+	if err != nil {
+		return err
+	}
+	req.unmarshaledData = data
+
+	_, err = ep.Handler(req)
+	return err
+}
+
+// deliveryAttempts reads how many times we have already tried to handle a publication
+func deliveryAttempts(d amqp.Delivery) int {
+	switch v := d.Headers[attemptsHeader].(type) {
+	case int:
+		return v
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	}
+
+	return 0
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/HailoOSS/protobuf/proto"
+	"github.com/streadway/amqp"
+
+	"github.com/HailoOSS/platform/errors"
+	"github.com/HailoOSS/platform/raven"
+)
+
+func durableTestSetup(t *testing.T, handler Handler) (*raven.MemoryTransport, func()) {
+	origName, origReg := Name, reg
+	Name = "com.HailoOSS.service.foo"
+	reg = newRegistry()
+
+	reg.add(&Endpoint{
+		Name:      "created",
+		Subscribe: "com.HailoOSS.event.created",
+		Durable:   &Durable{MaxAttempts: 3, RetryDelay: 5 * time.Millisecond},
+		Handler:   handler,
+	})
+
+	tr := raven.NewMemoryTransport(raven.NewMemoryBroker())
+	tr.Connect()
+	if err := subscribeDurable(tr, newWorkerPool(defaultWorkers)); err != nil {
+		t.Fatalf("Unexpected error subscribing: %v", err)
+	}
+
+	return tr, func() {
+		tr.Disconnect()
+		Name, reg = origName, origReg
+	}
+}
+
+// waitForLength polls until a queue reaches the expected length
+func waitForLength(b *raven.MemoryBroker, queue string, expected int) int {
+	var l int
+	for i := 0; i < 100; i++ {
+		if l, _ = b.QueueLength(queue); l == expected {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return l
+}
+
+func TestDurableSubscriptionAcksOnSuccess(t *testing.T) {
+	var calls int32
+	tr, teardown := durableTestSetup(t, func(req *Request) (proto.Message, errors.Error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, nil
+	})
+	defer teardown()
+
+	tr.Broker().Publish(raven.TOPIC_EXCHANGE, "com.HailoOSS.event.created", amqp.Publishing{MessageId: "1"})
+
+	time.Sleep(50 * time.Millisecond)
+	if c := atomic.LoadInt32(&calls); c != 1 {
+		t.Errorf("Expected handler to be called once, got %d", c)
+	}
+	if l, _ := tr.Broker().QueueLength(raven.DeadLetterQueue("com.HailoOSS.service.foo.created")); l != 0 {
+		t.Errorf("Expected nothing dead lettered, got %d", l)
+	}
+
+	// once acked, the publication should not come back when we go away
+	tr.Disconnect()
+	if l, _ := tr.Broker().QueueLength("com.HailoOSS.service.foo.created"); l != 0 {
+		t.Errorf("Expected acked publication to be gone, got %d messages", l)
+	}
+}
+
+func TestDurableSubscriptionDeadLetters(t *testing.T) {
+	var calls int32
+	tr, teardown := durableTestSetup(t, func(req *Request) (proto.Message, errors.Error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, errors.InternalServerError("com.HailoOSS.service.foo.created", "Broken")
+	})
+	defer teardown()
+
+	tr.Broker().Publish(raven.TOPIC_EXCHANGE, "com.HailoOSS.event.created", amqp.Publishing{MessageId: "1"})
+
+	dlq := raven.DeadLetterQueue("com.HailoOSS.service.foo.created")
+	if l := waitForLength(tr.Broker(), dlq, 1); l != 1 {
+		t.Fatalf("Expected publication to be dead lettered, got %d", l)
+	}
+	if c := atomic.LoadInt32(&calls); c != 3 {
+		t.Errorf("Expected 3 attempts, got %d", c)
+	}
+
+	deliveries, err := tr.Broker().Consume(dlq, "inspector", true)
+	if err != nil {
+		t.Fatalf("Unexpected error consuming dead letters: %v", err)
+	}
+	d := <-deliveries
+	if d.MessageId != "1" || deliveryAttempts(d) != 3 || d.Headers[deadLetterHeader] == nil {
+		t.Errorf("Unexpected dead letter %s after %d attempts: %v", d.MessageId, deliveryAttempts(d), d.Headers)
+	}
+}
+
+func TestDurableSubscriptionRetriesViaBroker(t *testing.T) {
+	var calls int32
+	tr, teardown := durableTestSetup(t, func(req *Request) (proto.Message, errors.Error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return nil, errors.InternalServerError("com.HailoOSS.service.foo.created", "Broken")
+		}
+		return nil, nil
+	})
+	defer teardown()
+
+	tr.Broker().Publish(raven.TOPIC_EXCHANGE, "com.HailoOSS.event.created", amqp.Publishing{MessageId: "1"})
+
+	for i := 0; i < 100 && atomic.LoadInt32(&calls) < 2; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if c := atomic.LoadInt32(&calls); c != 2 {
+		t.Fatalf("Expected the publication to be retried once, got %d calls", c)
+	}
+	if _, ok := tr.Broker().QueueLength(raven.RetryQueue("com.HailoOSS.service.foo.created", 5*time.Millisecond)); !ok {
+		t.Error("Expected the retry to have waited on a retry queue")
+	}
+
+	// nothing should have been left unacked to come back when we go away
+	tr.Disconnect()
+	if l, _ := tr.Broker().QueueLength("com.HailoOSS.service.foo.created"); l != 0 {
+		t.Errorf("Expected retried publication to be gone, got %d messages", l)
+	}
+}
+
+func TestDurableRetryDelay(t *testing.T) {
+	d := &Durable{RetryDelay: time.Second}
+	for attempts, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 20: maxRetryDelay} {
+		if delay := d.retryDelay(attempts); delay != expected {
+			t.Errorf("Expected delay of %v after %d attempts, got %v", expected, attempts, delay)
+		}
+	}
+}
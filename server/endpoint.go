@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"reflect"
 	"sync"
+	"time"
 
 	"github.com/HailoOSS/protobuf/proto"
 
@@ -20,6 +21,9 @@ type Endpoint struct {
 	Upper95 int32
 	// Handler is the function that will be fed requests to respond to
 	Handler Handler
+	// StreamHandler, if set instead of Handler, can send any number of replies to each request, for clients reading
+	// them with client.Stream
+	StreamHandler StreamHandler
 	// RequestProtocol is a struct type into which an inbound request for this endpoint can be unmarshaled
 	RequestProtocol proto.Message
 	// ResponseProtocol is the struct type defining the response format for this endpoint
@@ -27,6 +31,15 @@ type Endpoint struct {
 	// Subscribe indicates this endpoint should subscribe to a PUB stream - and gives us the stream address to SUB from
 	//(topic name)
 	Subscribe string
+	// Durable, if set along with Subscribe, subscribes via a durable queue with acks, retries and dead lettering
+	// rather than on the instance queue
+	Durable *Durable
+	// DisableCompression stops replies from this endpoint being compressed, even when they are over the configured
+	// threshold, eg: if they are already compressed
+	DisableCompression bool
+	// CacheTTL lets clients cache replies from this endpoint for this long, to the second, for identical requests. Only
+	// set it for endpoints whose replies depend on nothing but the request
+	CacheTTL time.Duration
 	// Authoriser is something that can check authorisation for this endpoint -- defaulting to ADMIN only (if nothing
 	//specified by service)
 	Authoriser Authoriser
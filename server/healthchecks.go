@@ -8,6 +8,7 @@ import (
 
 	"github.com/HailoOSS/platform/circuitbreaker"
 	"github.com/HailoOSS/platform/errors"
+	"github.com/HailoOSS/platform/raven"
 	"github.com/HailoOSS/service/config"
 )
 
@@ -90,4 +91,17 @@ func initHealthChecks() {
 	})
 
 	HealthCheck("com.HailoOSS.kernel.client.circuit", circuitbreaker.CircuitHealthCheck)
+
+	// add default healthcheck (to report which broker node we are attached to)
+	HealthCheck("com.HailoOSS.kernel.raven.connected", func() (map[string]string, error) {
+		ret := map[string]string{
+			"node":  raven.Node(),
+			"state": raven.ConnectionState().String(),
+		}
+		if !raven.IsConnected() {
+			return ret, fmt.Errorf("Raven not connected, state: %v", raven.ConnectionState())
+		}
+
+		return ret, nil
+	})
 }
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/HailoOSS/platform/errors"
+	"github.com/HailoOSS/service/config"
+	inst "github.com/HailoOSS/service/instrumentation"
+)
+
+const (
+	// defaultMaxResponseSize is the biggest response payload we send, in bytes, unless configured otherwise. The
+	// broker drops our connection if we send something bigger than it allows, so this should stay under its limit
+	defaultMaxResponseSize = 16 * 1024 * 1024
+	// nearLimitPercent is how full a payload can get before we count it as close to the limit
+	nearLimitPercent = 80
+)
+
+// maxResponseSize is the biggest response payload we send, set via hailo.platform.server.maxResponseSize
+func maxResponseSize() int {
+	return config.AtPath("hailo", "platform", "server", "maxResponseSize").AsInt(defaultMaxResponseSize)
+}
+
+// checkResponseSize makes sure a reply isn't too big to send, before we publish it
+func checkResponseSize(req *Request, payload []byte) errors.Error {
+	size, limit := len(payload), maxResponseSize()
+	if size > limit {
+		inst.Counter(1.0, fmt.Sprintf("server.%s.responsetoolarge", req.Endpoint()), 1)
+		return errors.InternalServerError("com.HailoOSS.kernel.server.responsetoolarge",
+			fmt.Sprintf("Response from %s is %d bytes, over the limit of %d", req.Destination(), size, limit),
+			req.Service(),
+			req.Endpoint())
+	}
+	if size*100 >= limit*nearLimitPercent {
+		inst.Counter(1.0, fmt.Sprintf("server.%s.nearsizelimit", req.Endpoint()), 1)
+	}
+
+	return nil
+}
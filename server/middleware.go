@@ -149,6 +149,20 @@ func authMiddleware(ep *Endpoint, h Handler) Handler {
 	}
 }
 
+// deadlineMiddleware rejects requests whose caller has already given up waiting, rather than doing work nobody wants
+func deadlineMiddleware(ep *Endpoint, h Handler) Handler {
+	return func(req *Request) (proto.Message, errors.Error) {
+		if deadline := req.Deadline(); !deadline.IsZero() && time.Now().After(deadline) {
+			inst.Counter(1.0, fmt.Sprintf("server.%s.deadlineexceeded", ep.Name), 1)
+			return nil, errors.Timeout("com.HailoOSS.kernel.server.deadlineexceeded",
+				fmt.Sprintf("Deadline for %s passed %v ago", req.Destination(), time.Since(deadline)),
+				req.Service(),
+				req.Endpoint())
+		}
+		return h(req)
+	}
+}
+
 func waitGroupMiddleware(ep *Endpoint, h Handler) Handler {
 	return func(req *Request) (proto.Message, errors.Error) {
 		requestsWg.Add(1)
@@ -22,7 +22,8 @@ func newRegistry() *registry {
 	}
 }
 
-// add will add an endpoint and enforce some basic laws, like lowercase names, and some Authoriser
+// add will add an endpoint and enforce some basic laws, like lowercase names, not using a name the platform has
+// reserved, and some Authoriser
 func (r *registry) add(ep *Endpoint) (err error) {
 	if len(ep.Name) == 0 {
 		err = fmt.Errorf("Missing name in endpoint: %+v", ep)
@@ -33,12 +34,20 @@ func (r *registry) add(ep *Endpoint) (err error) {
 		err = fmt.Errorf("Endpoint name should be lowercase: %+v", ep)
 		return
 	}
+	if ep.Name == streamControlEndpoint {
+		err = fmt.Errorf("Endpoint name %s is reserved for stream control messages: %+v", ep.Name, ep)
+		return
+	}
 
 	// add a default Authoriser, if none
 	if ep.Authoriser == nil || reflect.ValueOf(ep.Authoriser).IsNil() {
 		ep.Authoriser = DefaultAuthoriser
 	}
 
+	if ep.StreamHandler != nil {
+		ep.Handler = streamingHandler(ep.StreamHandler)
+	}
+
 	// Apply any registered middleware
 	h := ep.Handler
 	for _, m := range r.middleware {
@@ -65,6 +74,10 @@ func (r *registry) addMiddleware(mw Middleware) (err error) {
 
 // find will find an endpoint by name from within the registry
 func (r *registry) find(epName string) (ep *Endpoint, ok bool) {
+	if r == nil { // not initialised yet
+		return nil, false
+	}
+
 	r.RLock()
 	defer r.RUnlock()
 
@@ -22,6 +22,16 @@ func TestEndpointNamesShouldBeLowercase(t *testing.T) {
 	}
 }
 
+func TestStreamControlEndpointNameIsReserved(t *testing.T) {
+	reg := newRegistry()
+	ep := &Endpoint{Name: streamControlEndpoint}
+	err := reg.add(ep)
+
+	if err == nil {
+		t.Error("Should not be allowed to add an endpoint with the name reserved for stream control")
+	}
+}
+
 func TestRegister(t *testing.T) {
 	reg := newRegistry()
 
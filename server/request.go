@@ -3,12 +3,15 @@ package server
 import (
 	json "encoding/json"
 	"fmt"
+	"strconv"
+	"time"
 
 	log "github.com/cihub/seelog"
 	"github.com/HailoOSS/protobuf/proto"
 	"github.com/streadway/amqp"
 
 	"github.com/HailoOSS/platform/client"
+	"github.com/HailoOSS/platform/raven"
 	"github.com/HailoOSS/service/auth"
 )
 
@@ -17,6 +20,7 @@ type Request struct {
 	delivery        amqp.Delivery
 	scope           auth.Scope
 	unmarshaledData proto.Message
+	stream          *Stream // if the endpoint streams its replies
 }
 
 // NewRequestFromDelivery creates the Request object based on an AMQP delivery object
@@ -128,6 +132,15 @@ func (self *Request) Authorised() bool {
 	return self.getHeader("authorised") == "1"
 }
 
+// Deadline returns when the caller will give up waiting for a response, or the zero time if they didn't say
+func (self *Request) Deadline() time.Time {
+	ns, err := strconv.ParseInt(self.getHeader("deadline"), 10, 64)
+	if err != nil || ns <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
 // shouldTrace determiens if we should trace this request, when handling
 func (self *Request) shouldTrace() bool {
 	return self.TraceID() != ""
@@ -148,17 +161,28 @@ func (self *Request) RemoteAddr() string {
 	return self.getHeader("remoteAddr")
 }
 
+// Payload returns the raw bytes of the request, decompressed if it was sent compressed
 func (self *Request) Payload() []byte {
-	return self.delivery.Body
+	body, err := raven.Decompress(self.delivery.ContentEncoding, self.delivery.Body)
+	if err != nil {
+		log.Warnf("[Server] Returning raw payload of request %s: %v", self.MessageID(), err)
+		return self.delivery.Body
+	}
+
+	return body
 }
 
 // Unmarshal the raw bytes payload of this request (into a protobuf)
 func (self *Request) Unmarshal(into proto.Message) (err error) {
+	body, err := raven.Decompress(self.delivery.ContentEncoding, self.delivery.Body)
+	if err != nil {
+		return
+	}
 	switch self.delivery.ContentType {
 	case "application/json":
-		err = json.Unmarshal(self.delivery.Body, into)
+		err = json.Unmarshal(body, into)
 	case "application/octetstream":
-		err = proto.Unmarshal(self.delivery.Body, into)
+		err = proto.Unmarshal(body, into)
 	default:
 		err = fmt.Errorf("Unknown content type: %s", self.delivery.ContentType)
 	}
@@ -217,6 +241,7 @@ func (self *Request) ScopedRequest(service, endpoint string, payload proto.Messa
 	r.SetTraceShouldPersist(self.TraceShouldPersist())
 	r.SetParentMessageID(self.MessageID())
 	r.SetRemoteAddr(self.RemoteAddr())
+	r.SetDeadline(self.Deadline())
 
 	// scope -- who WE are (not who sent it to us)
 	r.SetFrom(Name)
@@ -246,6 +271,7 @@ func (self *Request) ScopedJsonRequest(service, endpoint string, payload []byte)
 	r.SetTraceID(self.TraceID())
 	r.SetParentMessageID(self.MessageID())
 	r.SetRemoteAddr(self.RemoteAddr())
+	r.SetDeadline(self.Deadline())
 
 	// scope -- who WE are (not who sent it to us)
 	r.SetFrom(Name)
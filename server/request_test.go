@@ -1,11 +1,15 @@
 package server
 
 import (
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/HailoOSS/protobuf/proto"
 	"github.com/streadway/amqp"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/HailoOSS/platform/errors"
 	"github.com/HailoOSS/service/auth"
 )
 
@@ -171,3 +175,42 @@ func TestMockedScope(t *testing.T) {
 	assert.True(t, req.Auth().HasAccess("CUSTOMER"))
 	assert.Equal(t, "111", req.Auth().AuthUser().Id)
 }
+
+func TestDeadline(t *testing.T) {
+	deadline := time.Now().Add(time.Second)
+	req := NewRequestFromDelivery(amqp.Delivery{
+		Headers: amqp.Table{
+			"deadline": strconv.FormatInt(deadline.UnixNano(), 10),
+		},
+	})
+	assert.True(t, req.Deadline().Equal(deadline), "Deadline should be read from the header")
+
+	scoped, err := req.ScopedRequest("com.HailoOSS.service.foo", "bar", nil)
+	assert.NoError(t, err)
+	assert.True(t, scoped.Deadline().Equal(deadline), "Scoped request should inherit the deadline")
+
+	req = NewRequestFromDelivery(amqp.Delivery{Headers: amqp.Table{"deadline": ""}})
+	assert.True(t, req.Deadline().IsZero(), "Deadline should be zero without the header")
+}
+
+func TestDeadlineMiddleware(t *testing.T) {
+	called := false
+	h := deadlineMiddleware(&Endpoint{Name: "bar"}, func(req *Request) (proto.Message, errors.Error) {
+		called = true
+		return nil, nil
+	})
+
+	expired := NewRequestFromDelivery(amqp.Delivery{
+		Headers: amqp.Table{
+			"deadline": strconv.FormatInt(time.Now().Add(-time.Second).UnixNano(), 10),
+		},
+	})
+	_, err := h(expired)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorTimeout, err.Type())
+	assert.False(t, called, "Handler should not be called once the deadline has passed")
+
+	_, err = h(NewRequestFromDelivery(amqp.Delivery{Headers: amqp.Table{}}))
+	assert.Nil(t, err)
+	assert.True(t, called, "Handler should be called without a deadline")
+}
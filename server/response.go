@@ -3,6 +3,8 @@ package server
 import (
 	json "encoding/json"
 	"fmt"
+	"time"
+
 	log "github.com/cihub/seelog"
 	"github.com/HailoOSS/platform/errors"
 	"github.com/HailoOSS/protobuf/proto"
@@ -11,9 +13,13 @@ import (
 
 // Response wraps an AMQP delivery, with a payload & message type
 type Response struct {
-	messageType string
-	payload     []byte
-	delivery    amqp.Delivery
+	messageType  string
+	payload      []byte
+	delivery     amqp.Delivery
+	uncompressed bool
+	cacheTTL     time.Duration
+	sequence     uint64 // of a reply in a stream
+	endOfStream  bool
 }
 
 // ContentType returns the content type of the delivery
@@ -41,6 +47,35 @@ func (self *Response) MessageID() string {
 	return self.delivery.MessageId
 }
 
+// CompressionDisabled returns whether the endpoint has opted out of compressed replies
+func (self *Response) CompressionDisabled() bool {
+	return self.uncompressed
+}
+
+// AcceptEncoding returns the content encodings the caller can decode, as it said in its request
+func (self *Response) AcceptEncoding() string {
+	encoding, _ := self.delivery.Headers["acceptEncoding"].(string)
+	return encoding
+}
+
+// CacheControl says how long clients may cache the reply for, if the endpoint allows it
+func (self *Response) CacheControl() string {
+	if self.messageType != "reply" || self.cacheTTL < time.Second {
+		return ""
+	}
+	return fmt.Sprintf("max-age=%d", int64(self.cacheTTL/time.Second))
+}
+
+// Sequence returns where a reply comes in its stream, counting from 1, or 0 if it isn't part of one
+func (self *Response) Sequence() uint64 {
+	return self.sequence
+}
+
+// EndOfStream returns whether this is the last reply in its stream
+func (self *Response) EndOfStream() bool {
+	return self.endOfStream
+}
+
 // PongResponse sends a PONG message
 func PongResponse(replyTo *Request) *Response {
 	return &Response{
@@ -55,7 +90,8 @@ func ErrorResponse(replyTo *Request, err errors.Error) (*Response, error) {
 	return response(replyTo, errors.ToProtobuf(err), "error")
 }
 
-// ReplyResponse sends a normal response
+// ReplyResponse sends a normal response, returning an errors.Error with code com.HailoOSS.kernel.server.responsetoolarge
+// if the payload is over the size limit. If the endpoint has a CacheTTL the reply says clients may cache it
 func ReplyResponse(replyTo *Request, payload proto.Message) (*Response, error) {
 	return response(replyTo, payload, "reply")
 }
@@ -65,6 +101,10 @@ func response(replyTo *Request, payload proto.Message, messageType string) (rsp
 		messageType: messageType,
 		delivery:    replyTo.delivery,
 	}
+	if ep, ok := reg.find(replyTo.Endpoint()); ok {
+		rsp.uncompressed = ep.DisableCompression
+		rsp.cacheTTL = ep.CacheTTL
+	}
 
 	switch replyTo.delivery.ContentType {
 	case "application/json":
@@ -78,6 +118,14 @@ func response(replyTo *Request, payload proto.Message, messageType string) (rsp
 	if err != nil {
 		rsp = nil
 		log.Criticalf("[Server] Failed to marshal payload: %v", err)
+		return
+	}
+
+	if messageType == "reply" || messageType == "stream" {
+		if serr := checkResponseSize(replyTo, rsp.payload); serr != nil {
+			log.Errorf("[Server] Not sending reply to %s: %v", replyTo.MessageID(), serr)
+			return nil, serr
+		}
 	}
 
 	return
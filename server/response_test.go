@@ -1,9 +1,14 @@
 package server
 
 import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
 	"github.com/HailoOSS/platform/errors"
+	"github.com/HailoOSS/service/config"
 	"github.com/streadway/amqp"
-	"testing"
 )
 
 type TestPayload struct{}
@@ -85,3 +90,65 @@ func TestInvalidContentType(t *testing.T) {
 		t.Errorf("Wrong error message: %v", err)
 	}
 }
+
+type BigPayload struct {
+	Data string `json:"data"`
+}
+
+func (*BigPayload) Reset()         {}
+func (*BigPayload) String() string { return "" }
+func (*BigPayload) ProtoMessage()  {}
+
+func TestReplyResponseTooLarge(t *testing.T) {
+	config.Load(bytes.NewBufferString(`{"hailo":{"platform":{"server":{"maxResponseSize":100}}}}`))
+	defer config.Load(bytes.NewBufferString(`{}`))
+
+	request := &Request{
+		delivery: amqp.Delivery{
+			ContentType: "application/json",
+		},
+	}
+
+	if _, err := ReplyResponse(request, &BigPayload{Data: "small"}); err != nil {
+		t.Fatalf("Unexpected error for a small response: %v", err)
+	}
+
+	_, err := ReplyResponse(request, &BigPayload{Data: strings.Repeat("x", 200)})
+	perr, ok := err.(errors.Error)
+	if !ok {
+		t.Fatalf("Expected a platform error for an oversized response, got %v", err)
+	}
+	if perr.Code() != "com.HailoOSS.kernel.server.responsetoolarge" || perr.Type() != errors.ErrorInternalServer {
+		t.Errorf("Wrong error for an oversized response: %s %s", perr.Type(), perr.Code())
+	}
+}
+
+func TestReplyResponseCacheControl(t *testing.T) {
+	origReg := reg
+	reg = newRegistry()
+	defer func() { reg = origReg }()
+
+	reg.add(&Endpoint{Name: "cached", CacheTTL: 90 * time.Second})
+	reg.add(&Endpoint{Name: "uncached"})
+
+	for ep, expected := range map[string]string{"cached": "max-age=90", "uncached": ""} {
+		request := &Request{
+			delivery: amqp.Delivery{
+				ContentType: "application/json",
+				Headers:     amqp.Table{"endpoint": ep},
+			},
+		}
+		rsp, err := ReplyResponse(request, &TestPayload{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cc := rsp.CacheControl(); cc != expected {
+			t.Errorf("Expected %s to give cache control %q, got %q", ep, expected, cc)
+		}
+
+		rsp, _ = ErrorResponse(request, errors.NotFound("com.HailoOSS.service.foo.notfound", "Not found"))
+		if cc := rsp.CacheControl(); cc != "" {
+			t.Errorf("Expected errors never to be cached, got %q", cc)
+		}
+	}
+}
@@ -126,16 +126,38 @@ func tokensChan(callingService string) chan bool {
 	return result
 }
 
-// monitorRaven monitors our raven connection status and just logs it atm
-func monitorRaven(ch chan bool) {
-	for {
-		select {
-		case status := <-ch:
-			log.Warnf("[Server] Raven connection status: %v", status)
+// monitorRaven monitors our raven connection state and just logs it atm; the raven reconnects by itself
+func monitorRaven(changes <-chan raven.StateChange) {
+	for change := range changes {
+		if change.Err != nil {
+			log.Warnf("[Server] Raven connection %v -> %v: %v", change.From, change.To, change.Err)
+		} else {
+			log.Warnf("[Server] Raven connection %v -> %v", change.From, change.To)
 		}
 	}
 }
 
+// connectRaven connects the raven, blocking until we are connected, and returns the channel on which further state
+// changes are sent. The transport may already be connected, in which case there is no change to wait for
+func connectRaven() <-chan raven.StateChange {
+	changes := raven.Subscribe()
+	raven.GetTransport().Connect()
+	if raven.IsConnected() {
+		return changes
+	}
+
+	for change := range changes {
+		if change.To == raven.StateConnected {
+			break
+		}
+		if change.To == raven.StateDisconnected {
+			log.Warnf("[Server] Failed to connect the raven, retrying: %v", change.Err)
+		}
+	}
+
+	return changes
+}
+
 // Init is a local init call that handles setup
 func Init() {
 	// Parse flags and handle them. No other code should be calling flag.Parse()
@@ -173,11 +195,7 @@ func Init() {
 	inst.Counter(1.0, "runtime.started", 1)
 
 	// Connect the raven and keep checking its status
-	ch := raven.Connect()
-	if online := <-ch; !online {
-		log.Warn("[Server] Failed to connect the raven on first attempt")
-	}
-	go monitorRaven(ch)
+	go monitorRaven(connectRaven())
 
 	// Create a new registry for the endpoints
 	reg = newRegistry()
@@ -185,6 +203,7 @@ func Init() {
 	// Add default middleware
 	registerMiddleware(authMiddleware)
 	registerMiddleware(tracingMiddleware)
+	registerMiddleware(deadlineMiddleware)
 	registerMiddleware(instrumentedMiddleware)
 	registerMiddleware(tokenConstrainedMiddleware)
 	registerMiddleware(waitGroupMiddleware)
@@ -342,6 +361,11 @@ reqProcessor:
 		log.Tracef("[Server] Inbound publication on topic: %s", req.Topic())
 
 		if endpoint, ok := reg.find(req.Topic()); ok { // Match + call handler
+			if endpoint.Durable != nil {
+				log.Tracef("[Server] Ignoring publication on %s, which is handled by a durable subscription", req.Topic())
+				break reqProcessor
+			}
+
 			if data, err := endpoint.unmarshalRequest(req); err != nil {
 				log.Warnf("[Server] Failed to unmarshal published message: %s", err.Error())
 				break reqProcessor
@@ -355,6 +379,9 @@ reqProcessor:
 			}
 		}
 
+	case req.Endpoint() == streamControlEndpoint:
+		handleStreamControl(req)
+
 	default:
 		log.Tracef("[Server] Inbound message %s from %s", req.MessageID(), req.ReplyTo())
 
@@ -394,6 +421,11 @@ reqProcessor:
 		}
 
 		if err != nil {
+			if req.stream != nil && req.stream.Cancelled() {
+				// nobody is reading the stream any more
+				return
+			}
+
 			switch err.Type() {
 			case errors.ErrorBadRequest, errors.ErrorForbidden, errors.ErrorNotFound:
 				log.Debugf("[Server] Handler error %s calling %v.%v from %v: %v", err.Type(), req.Service(),
@@ -409,14 +441,24 @@ reqProcessor:
 			if rsp, err := ErrorResponse(req, err); err != nil {
 				log.Criticalf("[Server] Unable to build response: %v", err)
 			} else {
+				req.stream.end(rsp)
 				raven.SendResponse(rsp, InstanceID)
 			}
 
 			return
 		}
 
+		if req.stream != nil {
+			raven.SendResponse(req.stream.endResponse(), InstanceID)
+			return
+		}
+
 		if rsp, err := ReplyResponse(req, rspData); err != nil {
-			if rsp, err2 := ErrorResponse(req, errors.InternalServerError("com.HailoOSS.kernel.marshal.error", fmt.Sprintf("Could not marshal response %v", err))); err2 != nil {
+			perr, ok := err.(errors.Error)
+			if !ok {
+				perr = errors.InternalServerError("com.HailoOSS.kernel.marshal.error", fmt.Sprintf("Could not marshal response %v", err))
+			}
+			if rsp, err2 := ErrorResponse(req, perr); err2 != nil {
 				log.Criticalf("[Server] Unable to build error response: %v", err2)
 			} else { // Send the error response
 				raven.SendResponse(rsp, InstanceID)
@@ -499,21 +541,41 @@ func doRun(opts *Options) {
 		os.Exit(3)
 	}
 
-	// start listening for incoming messages
-	deliveries, err := raven.Consume(InstanceID)
+	// start listening for incoming messages, within the configured flow control
+	t := raven.GetTransport()
+	workers, prefetch := flowControl()
+	pool := newWorkerPool(workers)
+	if err := t.SetPrefetch(prefetch); err != nil {
+		log.Errorf("[Server] Failed to set prefetch: %v", err)
+	}
+	go watchFlowControl(pool, t)
+
+	deliveries, err := t.ConsumeWithAck(InstanceID)
 	if err != nil {
 		log.Critical("[Server] Failed to consume: %v", err)
 		os.Exit(5)
 	}
+	controls, err := t.Consume(raven.ControlQueue(InstanceID))
+	if err != nil {
+		log.Criticalf("[Server] Failed to consume control messages: %v", err)
+		os.Exit(5)
+	}
+	go handleControls(controls)
 
 	if opts.SelfBind {
 		// binding should come after you've started consuming
-		if err := raven.BindService(Name, InstanceID); err != nil {
+		if err := t.BindService(Name, InstanceID); err != nil {
 			log.Criticalf("[Server] Failed to bind itself: %v", err)
 			os.Exit(7)
 		}
 	}
 
+	// durable subscriptions have their own queues
+	if err := subscribeDurable(t, pool); err != nil {
+		log.Criticalf("[Server] Failed to subscribe: %v", err)
+		os.Exit(7)
+	}
+
 	// announce ourselves to the discovery service
 	dsc = newDiscovery(opts)
 	go dsc.connect()
@@ -529,11 +591,8 @@ func doRun(opts *Options) {
 	// listen for SIGQUIT
 	go signalCatcher()
 
-	// consume messages
-	for d := range deliveries {
-		req := NewRequestFromDelivery(d)
-		go HandleRequest(req)
-	}
+	// consume messages; the raven keeps this channel fed across reconnects, so it only closes if the raven gives up
+	handleDeliveries(pool, deliveries)
 
 	log.Critical("[Server] Stopping due to channel closing")
 	os.Exit(6)
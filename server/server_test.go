@@ -0,0 +1,31 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/HailoOSS/platform/raven"
+)
+
+func TestConnectRavenAlreadyConnected(t *testing.T) {
+	origTransport := raven.GetTransport()
+	defer raven.SetTransport(origTransport)
+
+	// connected before we get going, so there will be no state change to wait for
+	tr := raven.NewMemoryTransport(raven.NewMemoryBroker())
+	tr.Connect()
+	defer tr.Disconnect()
+	raven.SetTransport(tr)
+
+	connected := make(chan bool)
+	go func() {
+		connectRaven()
+		connected <- true
+	}()
+
+	select {
+	case <-connected:
+	case <-time.After(time.Second):
+		t.Fatal("Expected connecting an already connected raven to return straight away")
+	}
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/HailoOSS/protobuf/proto"
+	log "github.com/cihub/seelog"
+
+	"github.com/HailoOSS/platform/errors"
+	"github.com/HailoOSS/platform/raven"
+)
+
+// StreamHandler handles a request by sending any number of replies on the stream before returning. Returning nil ends
+// the stream cleanly, and returning an error ends it with that error
+type StreamHandler func(req *Request, stream *Stream) errors.Error
+
+// streamControlEndpoint is where clients send credit for, or cancel, the streams they are reading. These messages
+// are sent to our control queue, and handled straight away rather than by an endpoint, so they aren't stuck behind the
+// streams they control. The name is reserved, so no endpoint can be registered with it
+const streamControlEndpoint = "streamcontrol"
+
+var (
+	streams   = make(map[string]*Stream) // Maps the message ID of the request to its stream
+	streamsMu sync.RWMutex
+
+	// streamStallTimeout is how long Send waits for the client to give us more credit before giving up on it
+	streamStallTimeout = 30 * time.Second
+)
+
+// Stream sends a sequence of replies to a request. The client gives us credit for how many replies it has room for,
+// and Send waits for more once we have used it up
+type Stream struct {
+	sync.Mutex
+	req       *Request
+	credit    int
+	sent      uint64
+	cancelled bool
+	wake      chan struct{} // closed when we get more credit, or are cancelled
+}
+
+// streamControl is what clients send to streamControlEndpoint
+type streamControl struct {
+	Stream string `json:"stream"`
+	Credit int    `json:"credit,omitempty"`
+	Cancel bool   `json:"cancel,omitempty"`
+}
+
+// Send sends the next reply on the stream, waiting for the client to have room for it. It returns an error if the
+// client has cancelled the stream or stops reading it, after which the handler should give up
+func (s *Stream) Send(payload proto.Message) errors.Error {
+	rsp, err := response(s.req, payload, "stream")
+	if err != nil {
+		if perr, ok := err.(errors.Error); ok {
+			return perr
+		}
+		return errors.InternalServerError("com.HailoOSS.kernel.marshal.error", fmt.Sprintf("Could not marshal response %v", err))
+	}
+
+	if err := s.waitForCredit(); err != nil {
+		return err
+	}
+
+	s.Lock()
+	s.sent++
+	rsp.sequence = s.sent
+	s.Unlock()
+
+	if err := raven.SendResponse(rsp, InstanceID); err != nil {
+		log.Errorf("[Server] Failed to send reply %d on stream %s: %v", rsp.sequence, s.req.MessageID(), err)
+		return errors.InternalServerError("com.HailoOSS.kernel.server.streamsendfailed", err.Error(),
+			s.req.Service(),
+			s.req.Endpoint())
+	}
+	return nil
+}
+
+// Cancelled returns whether the client has cancelled the stream
+func (s *Stream) Cancelled() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.cancelled
+}
+
+// waitForCredit takes a credit, once we have one
+func (s *Stream) waitForCredit() errors.Error {
+	for {
+		s.Lock()
+		if s.cancelled {
+			s.Unlock()
+			return errors.Timeout("com.HailoOSS.kernel.server.streamcancelled",
+				fmt.Sprintf("Stream %s cancelled by %s", s.req.MessageID(), s.req.From()),
+				s.req.Service(),
+				s.req.Endpoint())
+		}
+		if s.credit > 0 {
+			s.credit--
+			s.Unlock()
+			return nil
+		}
+		if s.wake == nil {
+			s.wake = make(chan struct{})
+		}
+		wake := s.wake
+		s.Unlock()
+
+		select {
+		case <-wake:
+		case <-time.After(streamStallTimeout):
+			return errors.Timeout("com.HailoOSS.kernel.server.streamstalled",
+				fmt.Sprintf("Stream %s stalled, no credit from %s for %v", s.req.MessageID(), s.req.From(),
+					streamStallTimeout),
+				s.req.Service(),
+				s.req.Endpoint())
+		}
+	}
+}
+
+// control applies what the client sent us about the stream
+func (s *Stream) control(c streamControl) {
+	s.Lock()
+	defer s.Unlock()
+
+	if c.Cancel {
+		s.cancelled = true
+	}
+	s.credit += c.Credit
+	if s.wake != nil {
+		close(s.wake)
+		s.wake = nil
+	}
+}
+
+// end makes a response the last one of the stream, if the request has one
+func (s *Stream) end(rsp *Response) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	rsp.sequence, rsp.endOfStream = s.sent+1, true
+}
+
+// endResponse marks the end of a stream that finished cleanly
+func (s *Stream) endResponse() *Response {
+	rsp := &Response{
+		messageType: "stream",
+		delivery:    s.req.delivery,
+	}
+	s.end(rsp)
+	return rsp
+}
+
+// streamingHandler adapts a StreamHandler to a Handler, so middleware wraps streams just like any other request
+func streamingHandler(h StreamHandler) Handler {
+	return func(req *Request) (proto.Message, errors.Error) {
+		s, err := openStream(req)
+		if err != nil {
+			return nil, err
+		}
+		defer closeStream(s)
+
+		req.stream = s
+		return nil, h(req, s)
+	}
+}
+
+// openStream starts a stream of replies to a request, with the credit the client asked for
+func openStream(req *Request) (*Stream, errors.Error) {
+	window, err := strconv.Atoi(req.getHeader("streamWindow"))
+	if err != nil || window <= 0 {
+		return nil, errors.BadRequest("com.HailoOSS.kernel.server.streamrequired",
+			fmt.Sprintf("%s streams its replies, so must be called with a stream request", req.Destination()),
+			req.Service(),
+			req.Endpoint())
+	}
+
+	s := &Stream{req: req, credit: window}
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+	streams[req.MessageID()] = s
+	return s, nil
+}
+
+func closeStream(s *Stream) {
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+	delete(streams, s.req.MessageID())
+}
+
+// handleStreamControl gives a stream the credit the client sent, or cancels it. Only the client that asked for the
+// stream, which gets its replies, can control it. Nothing is sent back
+func handleStreamControl(req *Request) {
+	var c streamControl
+	if err := json.Unmarshal(req.Payload(), &c); err != nil {
+		log.Warnf("[Server] Bad stream control message %s from %s: %v", req.MessageID(), req.From(), err)
+		return
+	}
+
+	streamsMu.RLock()
+	s, ok := streams[c.Stream]
+	streamsMu.RUnlock()
+	if !ok {
+		log.Debugf("[Server] Stream control message for %s, which has finished", c.Stream)
+		return
+	}
+	if req.ReplyTo() != s.req.ReplyTo() {
+		log.Warnf("[Server] Ignoring stream control message %s for %s from %s, which didn't ask for the stream",
+			req.MessageID(), c.Stream, req.ReplyTo())
+		return
+	}
+	s.control(c)
+}
@@ -0,0 +1,294 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/HailoOSS/protobuf/proto"
+	"github.com/streadway/amqp"
+
+	"github.com/HailoOSS/platform/client"
+	"github.com/HailoOSS/platform/errors"
+	"github.com/HailoOSS/platform/raven"
+)
+
+type streamItem struct {
+	Id int `json:"id"`
+}
+
+func (*streamItem) Reset()         {}
+func (*streamItem) String() string { return "" }
+func (*streamItem) ProtoMessage()  {}
+
+// streamTestSetup serves the endpoints over a memory transport with a single worker, so a stream waiting for credit
+// would block anything else that needed a worker
+func streamTestSetup(t *testing.T, eps ...*Endpoint) (client.Client, func()) {
+	return streamTestSetupWorkers(t, 1, eps...)
+}
+
+func streamTestSetupWorkers(t *testing.T, workers int, eps ...*Endpoint) (client.Client, func()) {
+	origName, origReg, origInstanceID, origTransport := Name, reg, InstanceID, raven.GetTransport()
+	Name, InstanceID = "com.HailoOSS.service.foo", "server-com.HailoOSS.service.foo-test"
+	reg = newRegistry()
+	for _, ep := range eps {
+		reg.add(ep)
+	}
+
+	tr := raven.NewMemoryTransport(raven.NewMemoryBroker())
+	tr.Connect()
+	raven.SetTransport(tr)
+	deliveries, err := tr.Consume(InstanceID)
+	if err != nil {
+		t.Fatalf("Unexpected error consuming: %v", err)
+	}
+	if err := tr.BindService(Name, InstanceID); err != nil {
+		t.Fatalf("Unexpected error binding: %v", err)
+	}
+	controls, err := tr.Consume(raven.ControlQueue(InstanceID))
+	if err != nil {
+		t.Fatalf("Unexpected error consuming control messages: %v", err)
+	}
+	go handleControls(controls)
+	pool, done := newWorkerPool(workers), make(chan struct{})
+	go func() {
+		handleDeliveries(pool, deliveries)
+		close(done)
+	}()
+
+	return client.NewTransportClient(tr), func() {
+		tr.Disconnect()
+		// wait for anything still being handled, before putting things back
+		<-done
+		for i := 0; i < workers; i++ {
+			pool.acquire()
+		}
+		raven.SetTransport(origTransport)
+		Name, reg, InstanceID = origName, origReg, origInstanceID
+	}
+}
+
+func TestStream(t *testing.T) {
+	c, teardown := streamTestSetup(t, &Endpoint{
+		Name: "list",
+		StreamHandler: func(req *Request, stream *Stream) errors.Error {
+			for i := 1; i <= 10; i++ {
+				if err := stream.Send(&streamItem{Id: i}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+	defer teardown()
+
+	req, _ := client.NewJsonRequest("com.HailoOSS.service.foo", "list", []byte(`{}`))
+	stream, err := c.Stream(context.Background(), req, client.WithStreamWindow(2),
+		client.WithAttemptTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("Unexpected error starting stream: %v", err)
+	}
+	defer stream.Close()
+
+	expected := 1
+	for stream.Next() {
+		item := &streamItem{}
+		if err := stream.Response().Unmarshal(item); err != nil {
+			t.Fatalf("Unexpected error unmarshaling reply: %v", err)
+		}
+		if item.Id != expected {
+			t.Errorf("Expected reply %d, got %d", expected, item.Id)
+		}
+		expected++
+	}
+	if err := stream.Err(); err != nil {
+		t.Errorf("Unexpected error reading stream: %v", err)
+	}
+	if expected != 11 {
+		t.Errorf("Expected 10 replies, got %d", expected-1)
+	}
+}
+
+func TestStreamError(t *testing.T) {
+	c, teardown := streamTestSetup(t, &Endpoint{
+		Name: "fail",
+		StreamHandler: func(req *Request, stream *Stream) errors.Error {
+			stream.Send(&streamItem{Id: 1})
+			return errors.BadRequest("com.HailoOSS.service.foo.fail", "Failed part way")
+		},
+	})
+	defer teardown()
+
+	req, _ := client.NewJsonRequest("com.HailoOSS.service.foo", "fail", []byte(`{}`))
+	stream, err := c.Stream(context.Background(), req, client.WithAttemptTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("Unexpected error starting stream: %v", err)
+	}
+	defer stream.Close()
+
+	replies := 0
+	for stream.Next() {
+		replies++
+	}
+	if replies != 1 {
+		t.Errorf("Expected the reply sent before the error, got %d", replies)
+	}
+	if err := stream.Err(); err == nil || err.Code() != "com.HailoOSS.service.foo.fail" {
+		t.Errorf("Expected the stream to end with the handler's error, got %v", err)
+	}
+
+	// a plain request can't read a stream
+	req, _ = client.NewJsonRequest("com.HailoOSS.service.foo", "fail", []byte(`{}`))
+	if err := c.Req(req, &streamItem{}, client.WithRetries(0)); err == nil ||
+		err.Code() != "com.HailoOSS.kernel.server.streamrequired" {
+		t.Errorf("Expected a plain request to a streaming endpoint to be refused, got %v", err)
+	}
+}
+
+func TestStreamCancel(t *testing.T) {
+	finished := make(chan errors.Error, 1)
+	c, teardown := streamTestSetup(t, &Endpoint{
+		Name: "forever",
+		StreamHandler: func(req *Request, stream *Stream) errors.Error {
+			for i := 1; ; i++ {
+				if err := stream.Send(&streamItem{Id: i}); err != nil {
+					finished <- err
+					return err
+				}
+			}
+		},
+	})
+	defer teardown()
+
+	req, _ := client.NewJsonRequest("com.HailoOSS.service.foo", "forever", []byte(`{}`))
+	stream, err := c.Stream(context.Background(), req, client.WithStreamWindow(2),
+		client.WithAttemptTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("Unexpected error starting stream: %v", err)
+	}
+	for i := 0; i < 5 && stream.Next(); i++ {
+	}
+	stream.Close()
+	if stream.Next() {
+		t.Errorf("Expected nothing more from a closed stream")
+	}
+
+	select {
+	case err := <-finished:
+		if err.Code() != "com.HailoOSS.kernel.server.streamcancelled" {
+			t.Errorf("Expected the server to see the stream cancelled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the server to stop sending a cancelled stream")
+	}
+}
+
+func TestStreamsUsingEveryWorker(t *testing.T) {
+	c, teardown := streamTestSetupWorkers(t, 2, &Endpoint{
+		Name: "list",
+		StreamHandler: func(req *Request, stream *Stream) errors.Error {
+			for i := 1; i <= 10; i++ {
+				if err := stream.Send(&streamItem{Id: i}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}, &Endpoint{
+		Name: "get",
+		Handler: func(req *Request) (proto.Message, errors.Error) {
+			return &streamItem{Id: 1}, nil
+		},
+	})
+	defer teardown()
+
+	// each stream holds a worker until it has sent everything, needing credit to get there
+	var streams []*client.ResponseStream
+	for i := 0; i < 2; i++ {
+		req, _ := client.NewJsonRequest("com.HailoOSS.service.foo", "list", []byte(`{}`))
+		stream, err := c.Stream(context.Background(), req, client.WithStreamWindow(2),
+			client.WithAttemptTimeout(time.Second))
+		if err != nil {
+			t.Fatalf("Unexpected error starting stream: %v", err)
+		}
+		defer stream.Close()
+		if !stream.Next() {
+			t.Fatalf("Expected the first reply on stream %d, got %v", i, stream.Err())
+		}
+		streams = append(streams, stream)
+	}
+
+	// with every worker busy, a plain request waits for one, and must not hold up the credit the streams need
+	answered := make(chan errors.Error, 1)
+	go func() {
+		req, _ := client.NewJsonRequest("com.HailoOSS.service.foo", "get", []byte(`{}`))
+		answered <- c.Req(req, &streamItem{}, client.WithRetries(0), client.WithTimeout(5*time.Second))
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	for i, stream := range streams {
+		replies := 1
+		for stream.Next() {
+			replies++
+		}
+		if err := stream.Err(); err != nil {
+			t.Errorf("Unexpected error reading stream %d: %v", i, err)
+		}
+		if replies != 10 {
+			t.Errorf("Expected 10 replies on stream %d, got %d", i, replies)
+		}
+	}
+	if err := <-answered; err != nil {
+		t.Errorf("Expected the plain request to be answered once the streams finished, got %v", err)
+	}
+}
+
+func TestStreamCloseBeforeFirstReply(t *testing.T) {
+	started, cancelled := make(chan struct{}), make(chan bool, 1)
+	c, teardown := streamTestSetup(t, &Endpoint{
+		Name: "slowstart",
+		StreamHandler: func(req *Request, stream *Stream) errors.Error {
+			close(started)
+			for deadline := time.Now().Add(time.Second); !stream.Cancelled() && time.Now().Before(deadline); {
+				time.Sleep(time.Millisecond)
+			}
+			cancelled <- stream.Cancelled()
+			return nil
+		},
+	})
+	defer teardown()
+
+	req, _ := client.NewJsonRequest("com.HailoOSS.service.foo", "slowstart", []byte(`{}`))
+	stream, err := c.Stream(context.Background(), req, client.WithAttemptTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("Unexpected error starting stream: %v", err)
+	}
+	<-started
+	stream.Close()
+
+	if !<-cancelled {
+		t.Errorf("Expected the server to see the stream cancelled, though it hadn't sent anything yet")
+	}
+}
+
+func TestStreamControlOnlyFromCaller(t *testing.T) {
+	s, err := openStream(NewRequestFromDelivery(amqp.Delivery{
+		MessageId: "stream-1",
+		ReplyTo:   "client-caller",
+		Headers:   amqp.Table{"streamWindow": "1"},
+	}))
+	if err != nil {
+		t.Fatalf("Unexpected error opening stream: %v", err)
+	}
+	defer closeStream(s)
+
+	cancel := []byte(`{"stream":"stream-1","cancel":true}`)
+	handleStreamControl(NewRequestFromDelivery(amqp.Delivery{ReplyTo: "client-other", Body: cancel}))
+	if s.Cancelled() {
+		t.Errorf("Expected a control message from another caller to be ignored")
+	}
+	handleStreamControl(NewRequestFromDelivery(amqp.Delivery{ReplyTo: "client-caller", Body: cancel}))
+	if !s.Cancelled() {
+		t.Errorf("Expected the caller to be able to cancel its stream")
+	}
+}
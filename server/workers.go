@@ -0,0 +1,202 @@
+package server
+
+import (
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"github.com/streadway/amqp"
+
+	"github.com/HailoOSS/platform/raven"
+	"github.com/HailoOSS/service/config"
+	inst "github.com/HailoOSS/service/instrumentation"
+)
+
+const (
+	// defaultWorkers is how many deliveries we handle at once, unless configured otherwise
+	defaultWorkers = 1000
+)
+
+// workerPool bounds how many deliveries we handle at once. Its size can be changed at runtime
+type workerPool struct {
+	sync.Mutex
+	cond *sync.Cond
+	size int
+	busy int
+}
+
+func newWorkerPool(size int) *workerPool {
+	p := &workerPool{size: size}
+	p.cond = sync.NewCond(&p.Mutex)
+	return p
+}
+
+// acquire blocks until there is a free worker
+func (p *workerPool) acquire() {
+	p.Lock()
+	defer p.Unlock()
+
+	for p.busy >= p.size {
+		p.cond.Wait()
+	}
+	p.busy++
+	inst.Gauge(1.0, "server.workers.busy", p.busy)
+}
+
+// release hands a worker back
+func (p *workerPool) release() {
+	p.Lock()
+	defer p.Unlock()
+
+	p.busy--
+	inst.Gauge(1.0, "server.workers.busy", p.busy)
+	p.cond.Signal()
+}
+
+// resize changes the number of workers; shrinking takes effect as busy workers finish
+func (p *workerPool) resize(size int) {
+	p.Lock()
+	defer p.Unlock()
+
+	if size == p.size {
+		return
+	}
+	log.Infof("[Server] Resizing worker pool from %d to %d", p.size, size)
+	p.size = size
+	p.cond.Broadcast()
+}
+
+// flowControl reads the worker pool size and prefetch from config. Prefetch is how many unacked deliveries the broker
+// sends us at once, defaulting to the number of workers, so anything beyond that stays in the broker
+func flowControl() (workers, prefetch int) {
+	workers = config.AtPath("hailo", "platform", "server", "workers").AsInt(defaultWorkers)
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	prefetch = config.AtPath("hailo", "platform", "server", "prefetch").AsInt(workers)
+
+	return
+}
+
+// loadFlowControl applies the configured flow control to the pool and transport
+func loadFlowControl(p *workerPool, t raven.Transport) {
+	workers, prefetch := flowControl()
+	p.resize(workers)
+	if err := t.SetPrefetch(prefetch); err != nil {
+		log.Errorf("[Server] Failed to set prefetch: %v", err)
+	}
+}
+
+// watchFlowControl keeps the flow control up to date with config changes
+func watchFlowControl(p *workerPool, t raven.Transport) {
+	ch := config.SubscribeChanges()
+	for {
+		<-ch
+		loadFlowControl(p, t)
+	}
+}
+
+// handleDeliveries hands each delivery to a worker, acking it as the worker picks it up so the broker can send us
+// another. Deliveries wait here for a worker in the order they came in, and the prefetch limit keeps everything else in
+// the broker. Heartbeats and stream control messages are quick, and handled straight away instead, so they are never
+// stuck behind requests waiting for a worker
+func handleDeliveries(p *workerPool, deliveries <-chan amqp.Delivery) {
+	waiting := newDeliveryQueue()
+	dispatched := make(chan struct{})
+	go func() {
+		defer close(dispatched)
+		for {
+			d, ok := waiting.pop()
+			if !ok {
+				return
+			}
+
+			p.acquire()
+			if err := d.Ack(false); err != nil {
+				log.Warnf("[Server] Failed to ack delivery %s: %v", d.MessageId, err)
+			}
+			go func(req *Request) {
+				defer p.release()
+				HandleRequest(req)
+			}(NewRequestFromDelivery(d))
+		}
+	}()
+
+	for d := range deliveries {
+		// heartbeats don't wait, so that discovery still hears from us when every worker is busy, and nor do stream
+		// control messages, as the workers may be waiting on them. Most of those come in on the control queue, but a
+		// client cancelling a stream before it knows which instance has it sends to the service
+		if req := NewRequestFromDelivery(d); req.isHeartbeat() || req.Endpoint() == streamControlEndpoint {
+			if err := d.Ack(false); err != nil {
+				log.Warnf("[Server] Failed to ack delivery %s: %v", d.MessageId, err)
+			}
+			HandleRequest(req)
+			continue
+		}
+
+		waiting.push(d)
+	}
+
+	waiting.close()
+	<-dispatched
+}
+
+// deliveryQueue holds the deliveries waiting for a worker
+type deliveryQueue struct {
+	sync.Mutex
+	cond       *sync.Cond
+	deliveries []amqp.Delivery
+	closed     bool
+}
+
+func newDeliveryQueue() *deliveryQueue {
+	q := &deliveryQueue{}
+	q.cond = sync.NewCond(&q.Mutex)
+	return q
+}
+
+func (q *deliveryQueue) push(d amqp.Delivery) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.deliveries = append(q.deliveries, d)
+	q.cond.Signal()
+}
+
+// pop waits for the next delivery, returning false once the queue is closed and there are none left
+func (q *deliveryQueue) pop() (amqp.Delivery, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	for len(q.deliveries) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.deliveries) == 0 {
+		return amqp.Delivery{}, false
+	}
+	d := q.deliveries[0]
+	q.deliveries[0] = amqp.Delivery{}
+	q.deliveries = q.deliveries[1:]
+	return d, true
+}
+
+// close wakes pop once the deliveries have run out
+func (q *deliveryQueue) close() {
+	q.Lock()
+	defer q.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// handleControls handles control messages as they arrive on our control queue (see raven.ControlQueue). They have a
+// queue of their own, which doesn't need acks, so they are never stuck behind requests waiting for a worker
+func handleControls(deliveries <-chan amqp.Delivery) {
+	for d := range deliveries {
+		req := NewRequestFromDelivery(d)
+		if req.Endpoint() != streamControlEndpoint {
+			log.Warnf("[Server] Ignoring %s sent to %s on our control queue", req.MessageID(), req.Destination())
+			continue
+		}
+		handleStreamControl(req)
+	}
+}
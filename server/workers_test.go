@@ -0,0 +1,116 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/HailoOSS/platform/raven"
+)
+
+func TestWorkerPoolBounds(t *testing.T) {
+	p := newWorkerPool(2)
+	p.acquire()
+	p.acquire()
+
+	acquired := make(chan bool)
+	go func() {
+		p.acquire()
+		acquired <- true
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("Should not be able to acquire more workers than the pool size")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	p.release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("Expected to acquire a worker once one was released")
+	}
+}
+
+func TestWorkerPoolResize(t *testing.T) {
+	p := newWorkerPool(1)
+	p.acquire()
+
+	acquired := make(chan bool)
+	go func() {
+		p.acquire()
+		acquired <- true
+	}()
+
+	p.resize(2)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("Expected to acquire a worker once the pool grew")
+	}
+
+	// shrinking leaves busy workers alone, but holds back new ones until we are under the limit
+	p.resize(1)
+	p.release()
+	go func() {
+		p.acquire()
+		acquired <- true
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("Should not acquire until busy workers drop below the new size")
+	case <-time.After(20 * time.Millisecond):
+	}
+	p.release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("Expected to acquire a worker once under the new size")
+	}
+}
+
+func TestHeartbeatsSkipBusyWorkers(t *testing.T) {
+	origTransport, origDsc := raven.GetTransport(), dsc
+	defer func() {
+		raven.SetTransport(origTransport)
+		dsc = origDsc
+	}()
+	dsc = &discovery{connected: true, hb: newHeartbeat(lostContactInterval)}
+
+	tr := raven.NewMemoryTransport(raven.NewMemoryBroker())
+	tr.Connect()
+	raven.SetTransport(tr)
+	pongs, err := tr.Consume("discovery-test")
+	if err != nil {
+		t.Fatalf("Unexpected error consuming: %v", err)
+	}
+
+	// every worker is busy, and a request is already waiting for one
+	p := newWorkerPool(1)
+	p.acquire()
+	deliveries := make(chan amqp.Delivery, 2)
+	deliveries <- amqp.Delivery{MessageId: "waiting", Headers: amqp.Table{"endpoint": "slow"}}
+	deliveries <- amqp.Delivery{MessageType: "heartbeat", Body: []byte("PING"), ReplyTo: "discovery-test"}
+	close(deliveries)
+	done := make(chan struct{})
+	go func() {
+		handleDeliveries(p, deliveries)
+		close(done)
+	}()
+
+	select {
+	case d := <-pongs:
+		if string(d.Body) != "PONG" {
+			t.Errorf("Expected a pong, got %q", d.Body)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected the heartbeat to be answered while the workers were busy")
+	}
+
+	// the waiting request gets the worker once it's free
+	p.release()
+	<-done
+	p.acquire()
+}
@@ -17,6 +17,7 @@ import (
 	metrics "github.com/rcrowley/go-metrics"
 
 	"github.com/HailoOSS/platform/client"
+	"github.com/HailoOSS/platform/raven"
 	"github.com/HailoOSS/platform/util"
 
 	pstats "github.com/HailoOSS/platform/proto/stats"
@@ -259,6 +260,7 @@ func (s *stats) get(status string) *pstats.PlatformStats {
 		ServiceVersion: proto.Uint64(ServiceVersion),
 		ServiceType:    proto.String(ServiceType),
 		AzName:         proto.String(AzName),
+		BrokerNode:     proto.String(raven.Node()),
 		Hostname:       proto.String(hostname),
 		InstanceId:     proto.String(InstanceID),
 		Status:         proto.String(status),
@@ -267,9 +269,26 @@ func (s *stats) get(status string) *pstats.PlatformStats {
 		Rusage:         rusageStats,
 		Runtime:        runtimeStats,
 		Endpoints:      endpointStats,
+		RetryBudgets:   retryBudgets(),
 	}
 }
 
+// retryBudgets returns the state of our client retry budgets
+func retryBudgets() []*pstats.RetryBudget {
+	budgets := client.RetryBudgets()
+	ret := make([]*pstats.RetryBudget, 0, len(budgets))
+	for _, b := range budgets {
+		ret = append(ret, &pstats.RetryBudget{
+			Service: proto.String(b.Service),
+			Tokens:  proto.Float32(float32(b.Tokens)),
+			Retries: proto.Uint64(b.Retries),
+			Dropped: proto.Uint64(b.Dropped),
+		})
+	}
+
+	return ret
+}
+
 func (s *stats) start() {
 	// Register GC stats.
 	registerGCStats(s.registry)